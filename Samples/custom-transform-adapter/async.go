@@ -0,0 +1,145 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DeliveryModeSync  = "sync"
+	DeliveryModeAsync = "async"
+)
+
+const (
+	defaultAsyncWorkers   = 10
+	defaultAsyncQueueSize = 1000
+	asyncSendTimeout      = 30 * time.Second
+)
+
+// ErrAsyncQueueFull is returned when a message is submitted to an async worker pool whose queue is full.
+var ErrAsyncQueueFull = errors.New("transform-adapter: async queue is full")
+
+// asyncMessage is a message accepted by an async route, waiting to be sent to the Bridge by a worker.
+type asyncMessage struct {
+	ctx      context.Context // Context of the request that accepted the message, detached from its cancellation
+	logger   *log.Entry      // Logger of the request that accepted the message, so failures are logged with its request Id
+	route    string
+	deviceId string
+	send     func(ctx context.Context) error
+}
+
+// AsyncPool sends the messages of async routes to the Bridge in the background, through a fixed number of workers. Messages wait in
+// a bounded in-memory queue, so they're lost if the adapter stops before they're sent. Routes that can't lose messages should use
+// store-and-forward instead.
+type AsyncPool struct {
+	messages chan asyncMessage
+	metrics  *Metrics
+	workers  sync.WaitGroup
+
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// NewAsyncPool creates a pool of workers sending the messages of async routes, and starts its workers. A zero number of workers
+// or queue size uses the default value.
+func NewAsyncPool(workers int, queueSize int, metrics *Metrics) *AsyncPool {
+	if workers == 0 {
+		workers = defaultAsyncWorkers
+	}
+
+	if queueSize == 0 {
+		queueSize = defaultAsyncQueueSize
+	}
+
+	pool := &AsyncPool{messages: make(chan asyncMessage, queueSize), metrics: metrics}
+	pool.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+// Submit queues a message to be sent by a worker, or returns ErrAsyncQueueFull without blocking if the queue is full.
+func (pool *AsyncPool) Submit(message asyncMessage) error {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	if pool.closed {
+		return ErrAsyncQueueFull
+	}
+
+	select {
+	case pool.messages <- message:
+		return nil
+	default:
+		return ErrAsyncQueueFull
+	}
+}
+
+// Depth returns the number of messages waiting to be sent.
+func (pool *AsyncPool) Depth() int {
+	return len(pool.messages)
+}
+
+// Close stops accepting messages and waits until the queued messages are sent.
+func (pool *AsyncPool) Close() {
+	pool.mutex.Lock()
+	if !pool.closed {
+		pool.closed = true
+		close(pool.messages)
+	}
+
+	pool.mutex.Unlock()
+	pool.workers.Wait()
+}
+
+func (pool *AsyncPool) work() {
+	defer pool.workers.Done()
+
+	for message := range pool.messages {
+		ctx, cancel := context.WithTimeout(message.ctx, asyncSendTimeout)
+		if err := message.send(ctx); err != nil {
+			message.logger.WithFields(log.Fields{"error": err, "deviceId": message.deviceId}).Errorf("Failed to send async message of device %s: %s", message.deviceId, err)
+			pool.metrics.asyncFailure(message.route)
+		}
+
+		cancel()
+	}
+}
+
+// submitAsync queues a message to be sent to the Bridge by the async worker pool, responding with 202 once queued, or 503 if the queue is full.
+func (adapter *Adapter) submitAsync(logger *log.Entry, w http.ResponseWriter, r *http.Request, message AugmentedD2CMessage, bridgeClient BridgeClient, deviceId string, dedupKey string, bridgePayload *bridge.MessageBody) {
+	err := adapter.Services.Async.Submit(asyncMessage{
+		ctx:      context.WithoutCancel(r.Context()),
+		logger:   logger,
+		route:    routeLabel(r),
+		deviceId: deviceId,
+		send: func(ctx context.Context) error {
+			if bridgeResponse, err := bridgeClient.SendMessage(ctx, deviceId, bridgePayload); err != nil {
+				adapter.releaseDedupKey(dedupKey)
+				return fmt.Errorf("call to Device Bridge failed with status %d: %w", bridgeStatusCode(bridgeResponse), err)
+			}
+
+			adapter.recordForwarded(logger, message, dedupKey)
+			return nil
+		},
+	})
+
+	if err != nil {
+		adapter.releaseDedupKey(dedupKey)
+		respondError(logger, w, http.StatusServiceUnavailable, errors.New("async queue is full"))
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// BridgeWithBlockedSend blocks SendMessage calls until released, signaling each call that started.
+type BridgeWithBlockedSend struct {
+	BridgeClientMock
+	started chan struct{}
+	release chan struct{}
+}
+
+func (client *BridgeWithBlockedSend) SendMessage(ctx context.Context, deviceID string, body *bridge.MessageBody) (autorest.Response, error) {
+	client.started <- struct{}{}
+	<-client.release
+	return autorest.Response{}, nil
+}
+
+func TestAsyncMode(t *testing.T) {
+	metrics := NewMetrics()
+	pool := NewAsyncPool(2, 10, metrics)
+	recorder := &BridgeClientRecorder{FailingDevices: map[string]int{"failing-device": 400}}
+	adapter, err := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", Transform: "{ data: . }", Mode: DeliveryModeAsync},
+	}}, "localhost:1000", &Services{Metrics: metrics, Async: pool})
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+	assert.Equal(t, 202, sendTestMessage(adapter.Router, "/device-1/message", `{"t": 1}`).Code)
+	assert.Equal(t, 202, sendTestMessage(adapter.Router, "/device-1/message", `{"t": 2}`).Code)
+	assert.Equal(t, 202, sendTestMessage(adapter.Router, "/failing-device/message", `{"t": 3}`).Code)
+
+	// Requests are still validated and transformed before being accepted.
+	assert.Equal(t, 400, sendTestMessage(adapter.Router, "/device-1/message", `{"t": `).Code)
+
+	pool.Close()
+	assert.Len(t, recorder.Messages["device-1"], 2)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.asyncFailures.WithLabelValues("/{id}/message")))
+}
+
+func TestAsyncQueueFull(t *testing.T) {
+	pool := NewAsyncPool(1, 1, nil)
+	client := &BridgeWithBlockedSend{started: make(chan struct{}, 3), release: make(chan struct{})}
+	adapter, _ := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", Mode: DeliveryModeAsync},
+	}}, "localhost:1000", &Services{Async: pool})
+
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+
+	// The first message is taken by the only worker, and the second one fills the queue.
+	assert.Equal(t, 202, sendTestMessage(adapter.Router, "/device/message", `{"data": {}}`).Code)
+	<-client.started
+	assert.Equal(t, 202, sendTestMessage(adapter.Router, "/device/message", `{"data": {}}`).Code)
+
+	response := sendTestMessage(adapter.Router, "/device/message", `{"data": {}}`)
+	assert.Equal(t, 503, response.Code)
+	assert.JSONEq(t, `{"error": "async queue is full"}`, response.Body.String())
+
+	close(client.release)
+	pool.Close()
+	assert.Len(t, client.started, 1)
+}
+
+func TestAsyncPoolRequired(t *testing.T) {
+	_, err := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/message", DeviceIdBodyQuery: ".device", AuthHeader: "key", Mode: DeliveryModeAsync},
+	}}, "localhost:1000")
+
+	assert.EqualError(t, err, "transform-adapter: route /message uses async mode, but no async worker pool is configured")
+}
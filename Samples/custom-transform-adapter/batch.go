@@ -0,0 +1,309 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const maxBatchErrors = 1000 // Maximum number of record errors reported in the response of a batch request
+
+var errBatchRecordTooLarge = fmt.Errorf("record exceeds the maximum size of %d bytes", maxBodySize)
+
+// BatchError is the failure of one of the records of a batch request.
+type BatchError struct {
+	Index    int    `json:"index"`          // Position of the record in the batch, starting at 0
+	Line     int    `json:"line,omitempty"` // Line of the record, in NDJSON bodies
+	DeviceId string `json:"deviceId,omitempty"`
+	Status   int    `json:"status"`
+	Error    string `json:"error"`
+}
+
+// BatchResponseBody summarizes the outcome of a batch request. Only the first errors are reported, in order of the records.
+type BatchResponseBody struct {
+	Records         int          `json:"records"`
+	Succeeded       int          `json:"succeeded"`
+	Failed          int          `json:"failed"`
+	Duplicates      int          `json:"duplicates"` // Records dropped as duplicates of already forwarded messages, counted as succeeded
+	Errors          []BatchError `json:"errors"`
+	ErrorsTruncated bool         `json:"errorsTruncated,omitempty"`
+}
+
+// batchRecord is a record read from the body of a batch request, or the error that prevented reading it.
+type batchRecord struct {
+	index int
+	line  int
+	value interface{}
+	err   error
+}
+
+// batchReader reads the records of a batch body one at a time, so bodies of any size are processed with bounded memory.
+type batchReader interface {
+	// next returns the next record, or false once the body is exhausted.
+	next() (batchRecord, bool)
+}
+
+// newBatchReader returns a reader of the records of a batch body: either the elements of a top-level JSON array, or the lines of
+// an NDJSON body. The format is picked from the Content-Type header if it's NDJSON, and otherwise from the first character of the body.
+func newBatchReader(r *http.Request) batchReader {
+	reader := bufio.NewReaderSize(r.Body, maxBodySize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" || mediaType == "application/jsonl" {
+		return &ndjsonReader{reader: reader}
+	}
+
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return &ndjsonReader{reader: reader}
+		}
+
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			reader.UnreadByte()
+			if b == '[' {
+				limit := &recordLimitReader{reader: reader}
+				return &jsonArrayReader{decoder: json.NewDecoder(limit), limit: limit}
+			}
+
+			return &ndjsonReader{reader: reader}
+		}
+	}
+}
+
+// ndjsonReader reads one record per line. Blank lines are skipped, and a malformed or oversized line only fails its own record.
+type ndjsonReader struct {
+	reader *bufio.Reader
+	index  int
+	line   int
+	done   bool
+}
+
+func (records *ndjsonReader) next() (batchRecord, bool) {
+	for !records.done {
+		records.line++
+		data, err := records.reader.ReadSlice('\n')
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = records.reader.ReadSlice('\n')
+			}
+
+			records.done = err != nil
+			return records.record(nil, errBatchRecordTooLarge), true
+		}
+
+		if err != nil {
+			records.done = true
+			if err != io.EOF {
+				return records.record(nil, fmt.Errorf("failed to read body: %w", err)), true
+			}
+		}
+
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return records.record(nil, fmt.Errorf("failed to decode JSON record: %w", err)), true
+		}
+
+		return records.record(value, nil), true
+	}
+
+	return batchRecord{}, false
+}
+
+func (records *ndjsonReader) record(value interface{}, err error) batchRecord {
+	record := batchRecord{index: records.index, line: records.line, value: value, err: err}
+	records.index++
+	return record
+}
+
+// jsonArrayReader reads the elements of a top-level JSON array. Oversized elements fail their own record but, since the array can't
+// be resynchronized after a syntax error, a malformed element fails its record and ends the batch.
+type jsonArrayReader struct {
+	decoder *json.Decoder
+	limit   *recordLimitReader
+	index   int
+	started bool
+	done    bool
+}
+
+func (records *jsonArrayReader) next() (batchRecord, bool) {
+	if records.done {
+		return batchRecord{}, false
+	}
+
+	records.limit.remaining = maxBodySize
+	if !records.started {
+		records.started = true
+		if _, err := records.decoder.Token(); err != nil {
+			return records.fail(err), true
+		}
+	}
+
+	if !records.decoder.More() {
+		records.done = true
+		if _, err := records.decoder.Token(); err != nil {
+			return records.fail(err), true
+		}
+
+		return batchRecord{}, false
+	}
+
+	var value interface{}
+	offset := records.decoder.InputOffset()
+	if err := records.decoder.Decode(&value); err != nil {
+		return records.fail(err), true
+	}
+
+	record := batchRecord{index: records.index, value: value}
+	if records.decoder.InputOffset()-offset > maxBodySize {
+		record = batchRecord{index: records.index, err: errBatchRecordTooLarge}
+	}
+
+	records.index++
+	return record, true
+}
+
+func (records *jsonArrayReader) fail(err error) batchRecord {
+	records.done = true
+	if !errors.Is(err, errBatchRecordTooLarge) {
+		err = fmt.Errorf("failed to decode JSON array: %w", err)
+	}
+
+	return batchRecord{index: records.index, err: err}
+}
+
+// recordLimitReader limits the bytes read while decoding a single record, so the decoder never buffers much more than the maximum
+// record size. Elements that are only slightly oversized are read, and then rejected by their size.
+type recordLimitReader struct {
+	reader    io.Reader
+	remaining int
+}
+
+func (limit *recordLimitReader) Read(p []byte) (int, error) {
+	if limit.remaining <= 0 {
+		return 0, errBatchRecordTooLarge
+	}
+
+	if len(p) > limit.remaining {
+		p = p[:limit.remaining]
+	}
+
+	n, err := limit.reader.Read(p)
+	limit.remaining -= n
+	return n, err
+}
+
+// buildBatchHandler builds the HTTP handler for a batch D2C route definition, where the body is a stream of records (NDJSON or a
+// JSON array) and each record is transformed and sent to the Bridge as a separate message. The body is read incrementally while
+// records are sent, so it isn't subject to the maximum body size, only each record is.
+//
+// Responds with 200 if all records were sent successfully or 207 (with the errors of the failed records) otherwise.
+func (adapter *Adapter) buildBatchHandler(message AugmentedD2CMessage) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	concurrency := message.FanOutConcurrency
+	if concurrency == 0 {
+		concurrency = defaultFanOutConcurrency
+	}
+
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		apiKey, err := resolveApiKey(r, message.AuthHeader, message.AuthQueryParam)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
+			return
+		}
+
+		response := BatchResponseBody{Errors: []BatchError{}}
+		var mutex sync.Mutex
+		addResult := func(record batchRecord, result FanOutResult) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			response.Records++
+			if result.Error == "" {
+				response.Succeeded++
+				if result.Duplicate {
+					response.Duplicates++
+				}
+
+				return
+			}
+
+			response.Failed++
+			if len(response.Errors) == maxBatchErrors {
+				response.ErrorsTruncated = true
+				return
+			}
+
+			response.Errors = append(response.Errors, BatchError{Index: record.index, Line: record.line, DeviceId: result.DeviceId, Status: result.Status, Error: result.Error})
+			logger.Errorf("Batch record %d for device %s failed with status %d: %s", record.index, result.DeviceId, result.Status, result.Error)
+		}
+
+		// Records are handed over to the workers one at a time, so at most one record per worker is held in memory.
+		queue := make(chan batchRecord)
+		var wg sync.WaitGroup
+		for worker := 0; worker < concurrency; worker++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for record := range queue {
+					addResult(record, adapter.sendBatchRecord(logger, r, message, apiKey, record))
+				}
+			}()
+		}
+
+		records := newBatchReader(r)
+		for record, ok := records.next(); ok; record, ok = records.next() {
+			if record.err != nil {
+				addResult(record, FanOutResult{Status: http.StatusBadRequest, Error: record.err.Error()})
+				continue
+			}
+
+			queue <- record
+		}
+
+		close(queue)
+		wg.Wait()
+
+		sort.Slice(response.Errors, func(i, j int) bool { return response.Errors[i].Index < response.Errors[j].Index })
+		logger.Infof("Batch of %d records processed: %d succeeded, %d failed", response.Records, response.Succeeded, response.Failed)
+
+		statusCode := http.StatusOK
+		if response.Failed > 0 {
+			statusCode = http.StatusMultiStatus
+		}
+
+		respondJson(logger, w, statusCode, response)
+	}
+}
+
+// sendBatchRecord transforms a single record of a batch request and sends it to the Bridge on behalf of its device.
+func (adapter *Adapter) sendBatchRecord(logger *log.Entry, r *http.Request, message AugmentedD2CMessage, apiKey string, record batchRecord) FanOutResult {
+	payload := record.value
+	if message.TransformId != "" {
+		_, done := adapter.startTransform(r, message.TransformLanguage)
+		var err error
+		payload, err = adapter.Engine.ExecuteWithVariables(message.TransformId, record.value, requestVariables(r))
+		done(err)
+		if err != nil {
+			return FanOutResult{Status: http.StatusBadRequest, Error: fmt.Errorf("payload transformation failed: %w", err).Error()}
+		}
+	}
+
+	return adapter.sendItem(logger, r, message, apiKey, record.value, payload)
+}
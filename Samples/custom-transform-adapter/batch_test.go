@@ -0,0 +1,162 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendBatchRequest(t *testing.T, adapter *Adapter, contentType string, body string) (int, BatchResponseBody) {
+	req, _ := http.NewRequest("POST", "/batch", bytes.NewBufferString(body))
+	req.Header.Add("key", "test_key")
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+
+	var response BatchResponseBody
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	return recorder.Code, response
+}
+
+func buildBatchTestAdapter(t *testing.T, recorder *BridgeClientRecorder) *Adapter {
+	adapter, err := NewAdapter(&Config{D2CMessages: []D2CMessage{{
+		Path:              "/batch",
+		DeviceIdBodyQuery: ".device",
+		AuthHeader:        "key",
+		Transform:         "if .t == null then error(\"missing t\") else { data: { t } } end",
+		Batch:             true,
+		FanOutConcurrency: 3,
+	}}}, "localhost:1000")
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+	return adapter
+}
+
+func TestBatchNdjson(t *testing.T) {
+	recorder := &BridgeClientRecorder{FailingDevices: map[string]int{"failing-device": 404}}
+	adapter := buildBatchTestAdapter(t, recorder)
+
+	body := strings.Join([]string{
+		`{"device": "d1", "t": 1}`,
+		``,
+		`{"device": "d1", "t": 2`,
+		`{"device": "d2", "t": 3}`,
+		`{"device": "failing-device", "t": 4}`,
+		`{"device": "d2"}`,
+		`{"device": "d1", "t": 5}`,
+	}, "\n")
+
+	code, response := sendBatchRequest(t, adapter, "application/x-ndjson", body)
+	assert.Equal(t, 207, code)
+	assert.Equal(t, 6, response.Records)
+	assert.Equal(t, 3, response.Succeeded)
+	assert.Equal(t, 3, response.Failed)
+	assert.Len(t, recorder.Messages["d1"], 2)
+	assert.Len(t, recorder.Messages["d2"], 1)
+
+	require.Len(t, response.Errors, 3)
+	assert.Equal(t, BatchError{Index: 1, Line: 3, Status: 400, Error: "failed to decode JSON record: unexpected end of JSON input"}, response.Errors[0])
+	assert.Equal(t, 3, response.Errors[1].Index)
+	assert.Equal(t, 5, response.Errors[1].Line)
+	assert.Equal(t, "failing-device", response.Errors[1].DeviceId)
+	assert.Equal(t, 404, response.Errors[1].Status)
+	assert.Equal(t, 6, response.Errors[2].Line)
+	assert.Contains(t, response.Errors[2].Error, "missing t")
+}
+
+func TestBatchJsonArray(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter := buildBatchTestAdapter(t, recorder)
+
+	code, response := sendBatchRequest(t, adapter, "", ` [{"device": "d1", "t": 1}, {"device": "d2", "t": 2}, {"device": "d1", "t": 3}]`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, BatchResponseBody{Records: 3, Succeeded: 3, Errors: []BatchError{}}, response)
+	assert.Len(t, recorder.Messages["d1"], 2)
+
+	// Records can't be read past a syntax error.
+	code, response = sendBatchRequest(t, adapter, "application/json", `[{"device": "d1", "t": 1}, {"device": "d1", "t": }, {"device": "d1", "t": 3}]`)
+	assert.Equal(t, 207, code)
+	assert.Equal(t, 2, response.Records)
+	assert.Equal(t, 1, response.Succeeded)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, 1, response.Errors[0].Index)
+	assert.Contains(t, response.Errors[0].Error, "failed to decode JSON array")
+}
+
+func TestBatchTransformMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	adapter, err := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{{
+		Path:              "/batch",
+		DeviceIdBodyQuery: ".device",
+		AuthHeader:        "key",
+		Transform:         "if .t == null then error(\"missing t\") else { data: { t } } end",
+		Batch:             true,
+	}}}, "localhost:1000", &Services{Metrics: metrics})
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return &BridgeClientRecorder{} }
+
+	// Every record is transformed separately, so each one is observed.
+	code, _ := sendBatchRequest(t, adapter, "application/x-ndjson", "{\"device\": \"d1\", \"t\": 1}\n{\"device\": \"d1\"}")
+	assert.Equal(t, 207, code)
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.transformDuration))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.transformFailures.WithLabelValues("/batch", "jq")))
+}
+
+func TestBatchStreamsLargeBodies(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter := buildBatchTestAdapter(t, recorder)
+
+	// The body as a whole may exceed the maximum body size, but each record may not.
+	var body strings.Builder
+	body.WriteString(fmt.Sprintf(`{"device": "d1", "t": "%s"}`+"\n", strings.Repeat("x", maxBodySize)))
+	for i := 0; i < 50000; i++ {
+		body.WriteString(fmt.Sprintf(`{"device": "d%d", "t": %d}`+"\n", i%10, i))
+	}
+
+	require.Greater(t, body.Len(), 2*maxBodySize)
+	code, response := sendBatchRequest(t, adapter, "", body.String())
+	assert.Equal(t, 207, code)
+	assert.Equal(t, 50001, response.Records)
+	assert.Equal(t, 50000, response.Succeeded)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, BatchError{Index: 0, Line: 1, Status: 400, Error: errBatchRecordTooLarge.Error()}, response.Errors[0])
+	assert.Len(t, recorder.Messages["d3"], 5000)
+
+	code, response = sendBatchRequest(t, adapter, "", fmt.Sprintf(`[{"device": "d1", "t": 1}, {"device": "d1", "t": "%s"}]`, strings.Repeat("x", maxBodySize)))
+	assert.Equal(t, 207, code)
+	assert.Equal(t, 1, response.Succeeded)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, errBatchRecordTooLarge.Error(), response.Errors[0].Error)
+
+	// Elements far beyond the maximum size end the batch, since they're not read.
+	code, response = sendBatchRequest(t, adapter, "", fmt.Sprintf(`[{"device": "d1", "t": "%s"}, {"device": "d1", "t": 1}]`, strings.Repeat("x", 3*maxBodySize)))
+	assert.Equal(t, 207, code)
+	assert.Equal(t, 1, response.Records)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, errBatchRecordTooLarge.Error(), response.Errors[0].Error)
+}
+
+func TestBatchErrorsTruncated(t *testing.T) {
+	adapter := buildBatchTestAdapter(t, &BridgeClientRecorder{})
+
+	code, response := sendBatchRequest(t, adapter, "", strings.Repeat("{}\n", maxBatchErrors+5))
+	assert.Equal(t, 207, code)
+	assert.Equal(t, maxBatchErrors+5, response.Failed)
+	assert.Len(t, response.Errors, maxBatchErrors)
+	assert.True(t, response.ErrorsTruncated)
+}
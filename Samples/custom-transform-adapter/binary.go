@@ -0,0 +1,231 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/itchyny/gojq"
+)
+
+// maxBitsLength is the maximum length of the bit fields read by the bits function.
+const maxBitsLength = 32
+
+// binaryReader is a jq function reading a number of a fixed size from an array of bytes.
+type binaryReader struct {
+	name string
+	size int
+	read func([]byte) interface{}
+}
+
+var binaryReaders = []binaryReader{
+	{"readint8", 1, func(b []byte) interface{} { return int(int8(b[0])) }},
+	{"readuint8", 1, func(b []byte) interface{} { return int(b[0]) }},
+	{"readint16le", 2, func(b []byte) interface{} { return int(int16(binary.LittleEndian.Uint16(b))) }},
+	{"readint16be", 2, func(b []byte) interface{} { return int(int16(binary.BigEndian.Uint16(b))) }},
+	{"readuint16le", 2, func(b []byte) interface{} { return int(binary.LittleEndian.Uint16(b)) }},
+	{"readuint16be", 2, func(b []byte) interface{} { return int(binary.BigEndian.Uint16(b)) }},
+	{"readint32le", 4, func(b []byte) interface{} { return int(int32(binary.LittleEndian.Uint32(b))) }},
+	{"readint32be", 4, func(b []byte) interface{} { return int(int32(binary.BigEndian.Uint32(b))) }},
+	{"readuint32le", 4, func(b []byte) interface{} { return int(binary.LittleEndian.Uint32(b)) }},
+	{"readuint32be", 4, func(b []byte) interface{} { return int(binary.BigEndian.Uint32(b)) }},
+	{"readfloat32le", 4, readFloat32(binary.LittleEndian)},
+	{"readfloat32be", 4, readFloat32(binary.BigEndian)},
+	{"readfloat64le", 8, readFloat64(binary.LittleEndian)},
+	{"readfloat64be", 8, readFloat64(binary.BigEndian)},
+}
+
+// binaryFunctions returns the options that add the custom jq functions decoding binary payloads. Bytes are represented as arrays of
+// integers between 0 and 255:
+//   - frombase64bytes and fromhex decode a base64 (standard or URL-safe, padded or not) or hex string into an array of bytes.
+//   - tohex encodes an array of bytes as a lowercase hex string (e.g., to format a device EUI).
+//   - readint8, readuint16le, readfloat32be, etc. read a number from an array of bytes, at the offset given as argument (0 if omitted).
+//   - bits(offset; length) reads an unsigned bit field from an array of bytes. Bit 0 is the most significant bit of the first byte.
+func binaryFunctions() []gojq.CompilerOption {
+	options := []gojq.CompilerOption{
+		gojq.WithFunction("frombase64bytes", 0, 0, fromBase64Bytes),
+		gojq.WithFunction("fromhex", 0, 0, fromHex),
+		gojq.WithFunction("tohex", 0, 0, toHex),
+		gojq.WithFunction("bits", 2, 2, readBits),
+	}
+
+	for _, reader := range binaryReaders {
+		reader := reader
+		options = append(options, gojq.WithFunction(reader.name, 0, 1, func(input interface{}, args []interface{}) interface{} {
+			bytes, err := toBytes(reader.name, input)
+			if err != nil {
+				return err
+			}
+
+			offset := 0
+			if len(args) == 1 {
+				var ok bool
+				if offset, ok = toInt(args[0]); !ok || offset < 0 {
+					return fmt.Errorf("%s: offset must be a non-negative integer", reader.name)
+				}
+			}
+
+			if offset+reader.size > len(bytes) {
+				return fmt.Errorf("%s: cannot read %d bytes at offset %d of %d bytes", reader.name, reader.size, offset, len(bytes))
+			}
+
+			return reader.read(bytes[offset : offset+reader.size])
+		}))
+	}
+
+	return options
+}
+
+func fromBase64Bytes(input interface{}, _ []interface{}) interface{} {
+	text, ok := input.(string)
+	if !ok {
+		return fmt.Errorf("frombase64bytes cannot be applied to: %s", jqType(input))
+	}
+
+	// Padding is optional, and URL-safe characters are accepted in place of the standard ones.
+	text = strings.TrimRight(strings.NewReplacer("-", "+", "_", "/").Replace(text), "=")
+	decoded, err := base64.RawStdEncoding.DecodeString(text)
+	if err != nil {
+		return fmt.Errorf("frombase64bytes: %s", err)
+	}
+
+	return fromBytes(decoded)
+}
+
+func fromHex(input interface{}, _ []interface{}) interface{} {
+	text, ok := input.(string)
+	if !ok {
+		return fmt.Errorf("fromhex cannot be applied to: %s", jqType(input))
+	}
+
+	decoded, err := hex.DecodeString(strings.TrimPrefix(text, "0x"))
+	if err != nil {
+		return fmt.Errorf("fromhex: %s", err)
+	}
+
+	return fromBytes(decoded)
+}
+
+func toHex(input interface{}, _ []interface{}) interface{} {
+	bytes, err := toBytes("tohex", input)
+	if err != nil {
+		return err
+	}
+
+	return hex.EncodeToString(bytes)
+}
+
+func readBits(input interface{}, args []interface{}) interface{} {
+	bytes, err := toBytes("bits", input)
+	if err != nil {
+		return err
+	}
+
+	offset, ok := toInt(args[0])
+	if !ok || offset < 0 {
+		return errors.New("bits: offset must be a non-negative integer")
+	}
+
+	length, ok := toInt(args[1])
+	if !ok || length < 1 || length > maxBitsLength {
+		return fmt.Errorf("bits: length must be an integer between 1 and %d", maxBitsLength)
+	}
+
+	if offset+length > 8*len(bytes) {
+		return fmt.Errorf("bits: cannot read %d bits at offset %d of %d bits", length, offset, 8*len(bytes))
+	}
+
+	value := 0
+	for bit := offset; bit < offset+length; bit++ {
+		value = value<<1 | int(bytes[bit/8]>>(7-bit%8)&1)
+	}
+
+	return value
+}
+
+// toBytes converts an array of integers between 0 and 255 into bytes. Name is the function reading the bytes, for error messages.
+func toBytes(name string, input interface{}) ([]byte, error) {
+	values, ok := input.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s cannot be applied to: %s", name, jqType(input))
+	}
+
+	bytes := make([]byte, len(values))
+	for i, value := range values {
+		b, ok := toInt(value)
+		if !ok || b < 0 || b > 255 {
+			return nil, fmt.Errorf("%s: expected an array of bytes, but element %d is not an integer between 0 and 255", name, i)
+		}
+
+		bytes[i] = byte(b)
+	}
+
+	return bytes, nil
+}
+
+// fromBytes converts bytes into an array of integers.
+func fromBytes(bytes []byte) []interface{} {
+	values := make([]interface{}, len(bytes))
+	for i, b := range bytes {
+		values[i] = int(b)
+	}
+
+	return values
+}
+
+// toInt converts a jq number into an integer, if it's integral.
+func toInt(value interface{}) (int, bool) {
+	switch value := value.(type) {
+	case int:
+		return value, true
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) <= math.MaxInt32 {
+			return int(value), true
+		}
+	}
+
+	return 0, false
+}
+
+// readFloat32 returns a function reading a 32-bit float in the given byte order.
+func readFloat32(order binary.ByteOrder) func([]byte) interface{} {
+	return func(b []byte) interface{} { return jsonFloat(float64(math.Float32frombits(order.Uint32(b)))) }
+}
+
+// readFloat64 returns a function reading a 64-bit float in the given byte order.
+func readFloat64(order binary.ByteOrder) func([]byte) interface{} {
+	return func(b []byte) interface{} { return jsonFloat(math.Float64frombits(order.Uint64(b))) }
+}
+
+// jsonFloat returns a float, or nil for values that have no JSON representation (NaN and infinities).
+func jsonFloat(value float64) interface{} {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+
+	return value
+}
+
+// jqType returns the jq type name of a value, for error messages.
+func jqType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "number"
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func executeBinaryQuery(t *testing.T, query string, input interface{}) (interface{}, error) {
+	engine := NewTransformEngine()
+	require.NoError(t, engine.AddTransform("query", query))
+	return engine.Execute("query", input)
+}
+
+func TestBinaryFunctions(t *testing.T) {
+	for query, expected := range map[string]interface{}{
+		`"AQL/" | frombase64bytes`:                     []interface{}{1, 2, 255},
+		`"AQL_" | frombase64bytes`:                     []interface{}{1, 2, 255},
+		`"AQI=" | frombase64bytes`:                     []interface{}{1, 2},
+		`"01Ff" | fromhex`:                             []interface{}{1, 255},
+		`"0x01ff" | fromhex`:                           []interface{}{1, 255},
+		`[0, 171, 205, 239] | tohex`:                   "00abcdef",
+		`[255] | readint8`:                             -1,
+		`[255] | readuint8`:                            255,
+		`[0, 1, 2] | readint16le(1)`:                   513,
+		`[254, 255] | readint16le`:                     -2,
+		`[1, 2] | readuint16be`:                        258,
+		`[255, 255, 255, 255] | readint32be`:           -1,
+		`[255, 255, 255, 255] | readuint32le`:          4294967295,
+		`[65, 172, 0, 0] | readfloat32be`:              21.5,
+		`[0, 0, 172, 65] | readfloat32le`:              21.5,
+		`[127, 192, 0, 0] | readfloat32be`:             nil,
+		`[64, 53, 128, 0, 0, 0, 0, 0] | readfloat64be`: 21.5,
+		`[176, 1] | bits(0; 4)`:                        11,
+		`[176, 1] | bits(4; 12)`:                       1,
+		`[176, 1] | bits(2; 1)`:                        1,
+	} {
+		result, err := executeBinaryQuery(t, query, nil)
+		if assert.NoError(t, err, query) {
+			assert.Equal(t, expected, result, query)
+		}
+	}
+}
+
+// Decodes a packed sensor frame with a status byte, a little-endian temperature in hundredths of a degree, and a humidity byte.
+func TestBinaryFunctionsDecodeFrame(t *testing.T) {
+	result, err := executeBinaryQuery(t, `.payload | frombase64bytes | {
+		data: {
+			temperature: (readint16le(1) / 100),
+			humidity: readuint8(3),
+			batteryLow: (bits(0; 1) == 1),
+			mode: bits(5; 3)
+		}
+	}`, map[string]interface{}{"payload": "g+X3PA=="})
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"data": map[string]interface{}{
+		"temperature": -20.75,
+		"humidity":    60,
+		"batteryLow":  true,
+		"mode":        3,
+	}}, result)
+}
+
+func TestBinaryFunctionsErrors(t *testing.T) {
+	for query, expected := range map[string]string{
+		`1 | frombase64bytes`:           "frombase64bytes cannot be applied to: number",
+		`"a" | fromhex`:                 "fromhex: encoding/hex: odd length hex string",
+		`"!" | frombase64bytes`:         "frombase64bytes: illegal base64 data at input byte 0",
+		`"text" | readint16le`:          "readint16le cannot be applied to: string",
+		`[1, 256] | readint16le`:        "readint16le: expected an array of bytes, but element 1 is not an integer between 0 and 255",
+		`[1, 2] | readint16le(1)`:       "readint16le: cannot read 2 bytes at offset 1 of 2 bytes",
+		`[1, 2] | readint16le(-1)`:      "readint16le: offset must be a non-negative integer",
+		`[1] | bits(4; 8)`:              "bits: cannot read 8 bits at offset 4 of 8 bits",
+		`[1, 2, 3, 4, 5] | bits(0; 33)`: "bits: length must be an integer between 1 and 32",
+	} {
+		_, err := executeBinaryQuery(t, query, nil)
+		assert.EqualError(t, err, "transform-adapter: transform id query failed: "+expected, query)
+	}
+}
+
+func TestBinaryFunctionsJsonInput(t *testing.T) {
+	// Numbers decoded from JSON bodies are floats.
+	result, err := executeBinaryQuery(t, `.bytes | readuint16be`, map[string]interface{}{"bytes": []interface{}{1.0, 2.0}})
+	assert.NoError(t, err)
+	assert.Equal(t, 258, result)
+}
@@ -0,0 +1,338 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/google/uuid"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	targetRequestTimeout = 30 * time.Second
+
+	// callbackSecretQueryParam is the query parameter of the callback URL that carries the callback secret of a route.
+	callbackSecretQueryParam = "secret"
+)
+
+// C2DEventKind identifies the type of cloud-to-device event handled by a route.
+type C2DEventKind string
+
+const (
+	C2DEventMethod            C2DEventKind = "method"
+	C2DEventMessage           C2DEventKind = "C2D message"
+	C2DEventDesiredProperties C2DEventKind = "desired properties"
+)
+
+// urlTemplateParam matches the {field} placeholders of a target URL template.
+var urlTemplateParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// AugmentedC2DRoute represents a cloud-to-device route definition augmented to include the Id of the cached transform queries.
+type AugmentedC2DRoute struct {
+	C2DRoute
+	Kind                C2DEventKind
+	CallbackPath        string
+	SubscriptionUrl     string // Callback URL given to the Bridge, including the callback secret
+	TransformId         string
+	DeviceIdBodyQueryId string
+	ResponseTransformId string
+}
+
+// augmentC2DRoutes augments all cloud-to-device route definitions of a configuration.
+func (adapter *Adapter) augmentC2DRoutes(config *Config) ([]AugmentedC2DRoute, error) {
+	var augmentedRoutes []AugmentedC2DRoute
+
+	for _, kindRoutes := range []struct {
+		kind   C2DEventKind
+		routes []C2DRoute
+	}{
+		{C2DEventMethod, config.Methods},
+		{C2DEventMessage, config.C2DMessages},
+		{C2DEventDesiredProperties, config.DesiredProperties},
+	} {
+		for _, route := range kindRoutes.routes {
+			augmentedRoute, err := adapter.augmentC2DRoute(kindRoutes.kind, route)
+			if err != nil {
+				return nil, err
+			}
+
+			augmentedRoutes = append(augmentedRoutes, augmentedRoute)
+		}
+	}
+
+	return augmentedRoutes, nil
+}
+
+// augmentC2DRoute compiles the queries of a cloud-to-device route definition, adding them to the transform engine.
+func (adapter *Adapter) augmentC2DRoute(kind C2DEventKind, route C2DRoute) (AugmentedC2DRoute, error) {
+	log.Infof("Initializing %s route %s", kind, route.Path)
+	augmentedRoute := AugmentedC2DRoute{C2DRoute: route, Kind: kind}
+
+	callbackUrl, err := url.Parse(route.CallbackUrl)
+	if err != nil {
+		return augmentedRoute, fmt.Errorf("transform-adapter: invalid callback URL for route %s: %s", route.Path, err)
+	}
+
+	if route.CallbackSecret == "" {
+		return augmentedRoute, fmt.Errorf("transform-adapter: missing callback secret for route %s", route.Path)
+	}
+
+	// The Bridge can't send custom headers to the callback, so the secret is carried by the callback URL.
+	augmentedRoute.CallbackPath = callbackUrl.Path
+	query := callbackUrl.Query()
+	query.Set(callbackSecretQueryParam, route.CallbackSecret)
+	callbackUrl.RawQuery = query.Encode()
+	augmentedRoute.SubscriptionUrl = callbackUrl.String()
+
+	// Initialize cache for event transform.
+	if route.Transform != "" {
+		augmentedRoute.TransformId = uuid.New().String()
+		if err := adapter.Engine.AddTransformWithLanguage(augmentedRoute.TransformId, route.TransformLanguage, route.Transform); err != nil {
+			return augmentedRoute, fmt.Errorf("transform-adapter: failed to add event transform for route %s: %s", route.Path, err)
+		}
+	} else {
+		log.Warnf("Empty transform. Events for route %s will be forwarded as is", route.Path)
+	}
+
+	// Initialize cache for device Id transform.
+	if route.DeviceIdBodyQuery != "" {
+		augmentedRoute.DeviceIdBodyQueryId = uuid.New().String()
+		if err := adapter.Engine.AddTransform(augmentedRoute.DeviceIdBodyQueryId, route.DeviceIdBodyQuery); err != nil {
+			return augmentedRoute, fmt.Errorf("transform-adapter: failed to add device Id query transform for route %s: %s", route.Path, err)
+		}
+	}
+
+	// Initialize cache for method response transform.
+	if route.ResponseTransform != "" {
+		augmentedRoute.ResponseTransformId = uuid.New().String()
+		if err := adapter.Engine.AddTransformWithLanguage(augmentedRoute.ResponseTransformId, route.TransformLanguage, route.ResponseTransform); err != nil {
+			return augmentedRoute, fmt.Errorf("transform-adapter: failed to add response transform for route %s: %s", route.Path, err)
+		}
+	}
+
+	return augmentedRoute, nil
+}
+
+// buildC2DSubscriptionHandler builds the HTTP handler that creates (POST) or deletes (DELETE) the Bridge event subscription of a device.
+func (adapter *Adapter) buildC2DSubscriptionHandler(route AugmentedC2DRoute) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		// The body is only needed if the device Id comes from it.
+		var jsonBody map[string]interface{}
+		if route.DeviceIdBodyQueryId != "" {
+			if err := decodeJsonBody(w, r, &jsonBody); err != nil {
+				respondError(logger, w, http.StatusBadRequest, fmt.Errorf("failed to decode JSON body: %w", err))
+				return
+			}
+		}
+
+		apiKey, err := resolveApiKey(r, route.AuthHeader, route.AuthQueryParam)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
+			return
+		}
+
+		deviceId, err := adapter.resolveDeviceId(r, route.DeviceIdPathParam, route.DeviceIdBodyQueryId, jsonBody)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
+			return
+		}
+
+		if apiKey, err = adapter.authorizeDevice(r, deviceId, apiKey); err != nil {
+			respondError(logger, w, requestErrorStatus(err), err)
+			return
+		}
+
+		bridgeClient := adapter.newBridgeClient(r, apiKey)
+
+		if r.Method == http.MethodDelete {
+			if bridgeResponse, err := route.Kind.deleteSubscription(r.Context(), bridgeClient, deviceId); err != nil {
+				respondBridgeError(logger, w, bridgeResponse, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		subscription, err := route.Kind.createSubscription(r.Context(), bridgeClient, deviceId, &bridge.SubscriptionCreateOrUpdateBody{CallbackURL: &route.SubscriptionUrl})
+		if err != nil {
+			respondBridgeError(logger, w, subscription.Response, err)
+			return
+		}
+
+		// Device keys don't grant access to the callback, so the secret isn't echoed back.
+		if subscription.CallbackURL != nil {
+			subscription.CallbackURL = &route.CallbackUrl
+		}
+
+		respondJson(logger, w, http.StatusOK, subscription)
+	}
+}
+
+// buildC2DCallbackHandler builds the HTTP handler that receives events from the Bridge, transforms them, and forwards them to the target URL.
+// The response of the target is mapped back into the semantics expected by the Bridge for the event type.
+func (adapter *Adapter) buildC2DCallbackHandler(route AugmentedC2DRoute) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		// Events are relayed with the target headers of the route, so they are only accepted from the Bridge.
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get(callbackSecretQueryParam)), []byte(route.CallbackSecret)) != 1 {
+			respondError(logger, w, http.StatusUnauthorized, errors.New("invalid callback secret"))
+			return
+		}
+
+		var event map[string]interface{}
+		if err := decodeJsonBody(w, r, &event); err != nil {
+			respondError(logger, w, http.StatusBadRequest, fmt.Errorf("failed to decode JSON body: %w", err))
+			return
+		}
+
+		// Execute event transformation if one was provided. If not, the event is forwarded as is.
+		var transformedPayload interface{} = event
+		if route.TransformId != "" {
+			var err error
+			_, done := adapter.startTransform(r, route.TransformLanguage)
+			transformedPayload, err = adapter.Engine.ExecuteWithVariables(route.TransformId, event, requestVariables(r))
+			done(err)
+			if err != nil {
+				respondError(logger, w, http.StatusBadRequest, fmt.Errorf("event transformation failed: %w", err))
+				return
+			}
+		}
+
+		targetUrl, err := expandUrlTemplate(route.TargetUrl, event)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
+			return
+		}
+
+		statusCode, targetBody, err := adapter.forwardC2DEvent(r.Context(), targetUrl, route.TargetHeaders, transformedPayload)
+		if err != nil {
+			respondError(logger, w, http.StatusBadGateway, fmt.Errorf("call to target failed: %w", err))
+			return
+		}
+
+		if route.Kind == C2DEventMethod {
+			adapter.respondMethod(logger, w, route, statusCode, targetBody)
+			return
+		}
+
+		// The Bridge completes messages on 2xx responses, rejects them on 4xx responses, and abandons them on any other status.
+		switch {
+		case statusCode >= 200 && statusCode < 300:
+			w.WriteHeader(http.StatusOK)
+		case statusCode >= 400 && statusCode < 500:
+			respondError(logger, w, statusCode, fmt.Errorf("target rejected event with status %d", statusCode))
+		default:
+			respondError(logger, w, http.StatusBadGateway, fmt.Errorf("target failed with status %d", statusCode))
+		}
+	}
+}
+
+// respondMethod responds to a method invocation event with the method response (status and payload) expected by the Bridge.
+// By default, the status and body of the target response are used as the method status and payload.
+func (adapter *Adapter) respondMethod(logger *log.Entry, w http.ResponseWriter, route AugmentedC2DRoute, statusCode int, targetBody interface{}) {
+	var methodResponse interface{} = map[string]interface{}{"status": statusCode, "payload": targetBody}
+
+	if route.ResponseTransformId != "" {
+		var err error
+		methodResponse, err = adapter.Engine.Execute(route.ResponseTransformId, map[string]interface{}{"status": statusCode, "body": targetBody})
+		if err != nil {
+			respondError(logger, w, http.StatusInternalServerError, fmt.Errorf("response transformation failed: %w", err))
+			return
+		}
+	}
+
+	respondJson(logger, w, http.StatusOK, methodResponse)
+}
+
+// forwardC2DEvent posts a transformed event to the target URL. Returns the target status code and its response body.
+// The body is decoded as JSON if possible, falling back to a string otherwise.
+func (adapter *Adapter) forwardC2DEvent(ctx context.Context, targetUrl string, headers map[string]string, payload interface{}) (int, interface{}, error) {
+	requestBody, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, targetUrl, bytes.NewReader(requestBody))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := adapter.HttpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(bytes.TrimSpace(responseBody)) == 0 {
+		return resp.StatusCode, nil, nil
+	}
+
+	var jsonBody interface{}
+	if err := json.Unmarshal(responseBody, &jsonBody); err != nil {
+		return resp.StatusCode, string(responseBody), nil
+	}
+
+	return resp.StatusCode, jsonBody, nil
+}
+
+// expandUrlTemplate replaces the {field} placeholders of a URL template with the escaped value of the corresponding event field.
+func expandUrlTemplate(template string, event map[string]interface{}) (string, error) {
+	var err error
+	expanded := urlTemplateParam.ReplaceAllStringFunc(template, func(match string) string {
+		field := match[1 : len(match)-1]
+		value, ok := event[field].(string)
+		if !ok {
+			err = fmt.Errorf("expected event field \"%s\" referenced by target URL to be a string", field)
+			return match
+		}
+
+		return url.PathEscape(value)
+	})
+
+	return expanded, err
+}
+
+func (kind C2DEventKind) createSubscription(ctx context.Context, client BridgeClient, deviceId string, body *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error) {
+	switch kind {
+	case C2DEventMethod:
+		return client.CreateOrUpdateMethodsSubscription(ctx, deviceId, body)
+	case C2DEventMessage:
+		return client.CreateOrUpdateC2DMessageSubscription(ctx, deviceId, body)
+	default:
+		return client.CreateOrUpdateDesiredPropertiesSubscription(ctx, deviceId, body)
+	}
+}
+
+func (kind C2DEventKind) deleteSubscription(ctx context.Context, client BridgeClient, deviceId string) (autorest.Response, error) {
+	switch kind {
+	case C2DEventMethod:
+		return client.DeleteMethodsSubscription(ctx, deviceId)
+	case C2DEventMessage:
+		return client.DeleteC2DMessageSubscription(ctx, deviceId)
+	default:
+		return client.DeleteDesiredPropertiesSubscription(ctx, deviceId)
+	}
+}
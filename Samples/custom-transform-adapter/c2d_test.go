@@ -0,0 +1,291 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TargetMock is a downstream device endpoint that records the last request and replies with a fixed status and body.
+type TargetMock struct {
+	*httptest.Server
+	LastPath   string
+	LastHeader http.Header
+	LastBody   map[string]interface{}
+	Status     int
+	Body       string
+}
+
+func newTargetMock(status int, body string) *TargetMock {
+	target := &TargetMock{Status: status, Body: body}
+	target.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target.LastPath = r.URL.Path
+		target.LastHeader = r.Header
+		requestBody, _ := ioutil.ReadAll(r.Body)
+		target.LastBody = nil
+		json.Unmarshal(requestBody, &target.LastBody)
+		w.WriteHeader(target.Status)
+		w.Write([]byte(target.Body))
+	}))
+
+	return target
+}
+
+func sendTestEvent(adapter *Adapter, path string, event string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path+"?secret=callback-secret", bytes.NewBufferString(event))
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+const testMethodEvent = `{
+	"eventType": "DirectMethodInvocation",
+	"deviceId": "my-device",
+	"deviceReceivedAt": "2020-12-04T01:06:14.251Z",
+	"methodName": "increaseTemperature",
+	"requestData": { "celsius": 2 }
+}`
+
+const testC2DMessageEvent = `{
+	"eventType": "C2DMessage",
+	"deviceId": "my-device",
+	"deviceReceivedAt": "2020-12-04T01:06:14.251Z",
+	"messageBody": { "setpoint": 20.2 },
+	"properties": { "prop1": "val1" },
+	"messageId": "abc",
+	"expirtyTimeUtC": "2020-12-04T01:06:14.251Z"
+}`
+
+func TestC2DSubscriptionCreate(t *testing.T) {
+	adapter, err := NewAdapter(&Config{Methods: []C2DRoute{
+		{
+			Path:              "/{id}/commands",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			CallbackUrl:       "http://localhost:3000/callbacks/commands",
+			CallbackSecret:    "callback-secret",
+			TargetUrl:         "http://vendor/{deviceId}",
+		},
+	}}, "localhost:1000")
+
+	assert.NoError(t, err)
+	adapter.GetBridgeClient = mockGetBridgeClient
+	req, _ := http.NewRequest("POST", "/sub_device/commands", nil)
+	req.Header.Add("key", "test_key")
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "Methods", mockBridgeClient.LastSubscriptionType)
+	assert.Equal(t, "sub_device", mockBridgeClient.LastSubscriptionDeviceId)
+	assert.Equal(t, "http://localhost:3000/callbacks/commands?secret=callback-secret", *mockBridgeClient.LastSubscriptionBody.CallbackURL)
+	assert.JSONEq(t, `{"deviceId": "sub_device", "subscriptionType": "Methods", "callbackUrl": "http://localhost:3000/callbacks/commands", "status": "Starting"}`, recorder.Body.String())
+}
+
+func TestC2DSubscriptionDelete(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{DesiredProperties: []C2DRoute{
+		{
+			Path:              "/subscriptions/properties",
+			DeviceIdBodyQuery: ".device",
+			AuthQueryParam:    "key",
+			CallbackUrl:       "http://localhost:3000/callbacks/properties",
+			CallbackSecret:    "callback-secret",
+			TargetUrl:         "http://vendor/{deviceId}",
+		},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	req, _ := http.NewRequest("DELETE", "/subscriptions/properties?key=my_key", bytes.NewBufferString(`{"device": "body_device"}`))
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 204, recorder.Code)
+	assert.Equal(t, "DesiredProperties", mockBridgeClient.LastSubscriptionType)
+	assert.Equal(t, "body_device", mockBridgeClient.LastSubscriptionDeviceId)
+	assert.Nil(t, mockBridgeClient.LastSubscriptionBody)
+}
+
+func TestC2DSubscriptionNoAuth(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{C2DMessages: []C2DRoute{
+		{
+			Path:              "/{id}/messages",
+			DeviceIdPathParam: "id",
+			AuthQueryParam:    "key",
+			CallbackUrl:       "http://localhost:3000/callbacks/messages",
+			CallbackSecret:    "callback-secret",
+			TargetUrl:         "http://vendor/{deviceId}",
+		},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	req, _ := http.NewRequest("POST", "/sub_device/messages", nil)
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 400, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "expected auth query parameter")
+}
+
+func TestC2DMethodCallback(t *testing.T) {
+	target := newTargetMock(201, `{"newTemperature": 24}`)
+	defer target.Close()
+
+	adapter, _ := NewAdapter(&Config{Methods: []C2DRoute{
+		{
+			Path:              "/{id}/commands",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			CallbackUrl:       "http://localhost:3000/callbacks/commands",
+			CallbackSecret:    "callback-secret",
+			Transform:         "{ command: .methodName, args: .requestData }",
+			TargetUrl:         target.URL + "/devices/{deviceId}/{methodName}",
+			TargetHeaders:     map[string]string{"Vendor-Token": "token"},
+		},
+	}}, "localhost:1000")
+
+	recorder := sendTestEvent(adapter, "/callbacks/commands", testMethodEvent)
+	assert.Equal(t, 200, recorder.Code)
+	assert.JSONEq(t, `{"status": 201, "payload": {"newTemperature": 24}}`, recorder.Body.String())
+	assert.Equal(t, "/devices/my-device/increaseTemperature", target.LastPath)
+	assert.Equal(t, "token", target.LastHeader.Get("Vendor-Token"))
+	assert.Equal(t, map[string]interface{}{"command": "increaseTemperature", "args": map[string]interface{}{"celsius": float64(2)}}, target.LastBody)
+}
+
+func TestC2DMethodCallbackResponseTransform(t *testing.T) {
+	target := newTargetMock(200, `{"result": "ok", "code": 202}`)
+	defer target.Close()
+
+	adapter, _ := NewAdapter(&Config{Methods: []C2DRoute{
+		{
+			Path:              "/{id}/commands",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			CallbackUrl:       "http://localhost:3000/callbacks/commands",
+			CallbackSecret:    "callback-secret",
+			TargetUrl:         target.URL + "/{deviceId}",
+			ResponseTransform: "{ status: .body.code, payload: { result: .body.result } }",
+		},
+	}}, "localhost:1000")
+
+	recorder := sendTestEvent(adapter, "/callbacks/commands", testMethodEvent)
+	assert.Equal(t, 200, recorder.Code)
+	assert.JSONEq(t, `{"status": 202, "payload": {"result": "ok"}}`, recorder.Body.String())
+	assert.Equal(t, "DirectMethodInvocation", target.LastBody["eventType"])
+}
+
+func TestC2DMessageCallbackStatus(t *testing.T) {
+	target := newTargetMock(200, "")
+	defer target.Close()
+
+	adapter, _ := NewAdapter(&Config{C2DMessages: []C2DRoute{
+		{
+			Path:              "/{id}/messages",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			CallbackUrl:       "http://localhost:3000/callbacks/messages",
+			CallbackSecret:    "callback-secret",
+			Transform:         ".messageBody",
+			TargetUrl:         target.URL + "/{deviceId}/messages/{messageId}",
+		},
+	}}, "localhost:1000")
+
+	// Complete
+	recorder := sendTestEvent(adapter, "/callbacks/messages", testC2DMessageEvent)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "/my-device/messages/abc", target.LastPath)
+	assert.Equal(t, map[string]interface{}{"setpoint": 20.2}, target.LastBody)
+
+	// Reject
+	target.Status = 404
+	recorder = sendTestEvent(adapter, "/callbacks/messages", testC2DMessageEvent)
+	assert.Equal(t, 404, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "target rejected event with status 404")
+
+	// Abandon
+	target.Status = 503
+	recorder = sendTestEvent(adapter, "/callbacks/messages", testC2DMessageEvent)
+	assert.Equal(t, 502, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "target failed with status 503")
+}
+
+func TestC2DCallbackTargetUnreachable(t *testing.T) {
+	target := newTargetMock(200, "")
+	target.Close()
+
+	adapter, _ := NewAdapter(&Config{DesiredProperties: []C2DRoute{
+		{
+			Path:              "/{id}/properties",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			CallbackUrl:       "http://localhost:3000/callbacks/properties",
+			CallbackSecret:    "callback-secret",
+			TargetUrl:         target.URL + "/{deviceId}",
+		},
+	}}, "localhost:1000")
+
+	recorder := sendTestEvent(adapter, "/callbacks/properties", `{"eventType": "DesiredPropertyUpdate", "deviceId": "my-device", "desiredProperties": {}}`)
+	assert.Equal(t, 502, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "call to target failed")
+}
+
+func TestC2DCallbackBadTargetTemplate(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{C2DMessages: []C2DRoute{
+		{
+			Path:              "/{id}/messages",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			CallbackUrl:       "http://localhost:3000/callbacks/messages",
+			CallbackSecret:    "callback-secret",
+			TargetUrl:         "http://vendor/{deviceId}/{methodName}",
+		},
+	}}, "localhost:1000")
+
+	recorder := sendTestEvent(adapter, "/callbacks/messages", testC2DMessageEvent)
+	assert.Equal(t, 400, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "expected event field \\\"methodName\\\" referenced by target URL to be a string")
+}
+
+func TestC2DCallbackInvalidSecret(t *testing.T) {
+	target := newTargetMock(200, "")
+	defer target.Close()
+
+	adapter, _ := NewAdapter(&Config{Methods: []C2DRoute{
+		{
+			Path:              "/{id}/commands",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			CallbackUrl:       "http://localhost:3000/callbacks/commands",
+			CallbackSecret:    "callback-secret",
+			TargetUrl:         target.URL + "/{deviceId}",
+			TargetHeaders:     map[string]string{"Vendor-Token": "token"},
+		},
+	}}, "localhost:1000")
+
+	for _, path := range []string{"/callbacks/commands", "/callbacks/commands?secret=", "/callbacks/commands?secret=other-secret"} {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(testMethodEvent))
+		recorder := httptest.NewRecorder()
+		adapter.Router.ServeHTTP(recorder, req)
+		assert.Equal(t, 401, recorder.Code, path)
+		assert.Contains(t, recorder.Body.String(), "invalid callback secret", path)
+	}
+
+	assert.Nil(t, target.LastHeader, "forged events must not reach the target")
+}
+
+func TestC2DRouteWithoutCallbackSecret(t *testing.T) {
+	_, err := NewAdapter(&Config{Methods: []C2DRoute{
+		{Path: "/{id}/commands", DeviceIdPathParam: "id", AuthHeader: "key", CallbackUrl: "http://localhost:3000/callbacks/commands", TargetUrl: "http://vendor"},
+	}}, "localhost:1000")
+
+	assert.EqualError(t, err, "transform-adapter: missing callback secret for route /{id}/commands")
+}
+
+func TestExpandUrlTemplateEscapesValues(t *testing.T) {
+	expanded, err := expandUrlTemplate("http://vendor/{deviceId}/commands", map[string]interface{}{"deviceId": "a/b c"})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://vendor/a%2Fb%20c/commands", expanded)
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// celInputVariable is the CEL variable holding the input of a transform.
+const celInputVariable = "input"
+
+var celResultType = reflect.TypeOf(&structpb.Value{})
+
+// celLanguage compiles CEL expressions. The input is available as the input variable, and the engine variables by their names
+// without the leading $ (e.g., headers). The result of an expression must be representable as JSON.
+type celLanguage struct{}
+
+func (celLanguage) Compile(query string, variables []string) (CompiledTransform, error) {
+	options := []cel.EnvOption{cel.Variable(celInputVariable, cel.DynType), ext.Strings(), ext.Encoders(), ext.Math()}
+	for _, name := range variables {
+		options = append(options, cel.Variable(strings.TrimPrefix(name, "$"), cel.DynType))
+	}
+
+	env, err := cel.NewEnv(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(query)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	return &celTransform{program, variables}, nil
+}
+
+type celTransform struct {
+	program   cel.Program
+	variables []string
+}
+
+func (transform *celTransform) Run(input interface{}, variables map[string]interface{}) TransformIter {
+	activation := map[string]interface{}{celInputVariable: input}
+	for _, name := range transform.variables {
+		activation[strings.TrimPrefix(name, "$")] = variables[name]
+	}
+
+	value, _, err := transform.program.Eval(activation)
+	if err != nil {
+		return &singleResult{value: err}
+	}
+
+	result, err := value.ConvertToNative(celResultType)
+	if err != nil {
+		return &singleResult{value: fmt.Errorf("expected result to be representable as JSON: %w", err)}
+	}
+
+	return &singleResult{value: result.(*structpb.Value).AsInterface()}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCelTransform(t *testing.T) {
+	engine := NewTransformEngine(requestVariableNames...)
+	require.NoError(t, engine.AddTransformWithLanguage("cel", TransformLanguageCel, `{
+		"data": {"temperature": input.temp * 2.0, "unit": input.unit.upperAscii()},
+		"properties": {"host": headers["host"]}
+	}`))
+
+	result, err := engine.ExecuteWithVariables("cel", map[string]interface{}{"temp": 10.5, "unit": "c"}, map[string]interface{}{
+		"$headers": map[string]interface{}{"host": "example.com"},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"data":       map[string]interface{}{"temperature": 21.0, "unit": "C"},
+		"properties": map[string]interface{}{"host": "example.com"},
+	}, result)
+}
+
+func TestCelTransformErrors(t *testing.T) {
+	engine := NewTransformEngine(requestVariableNames...)
+	assert.Error(t, engine.AddTransformWithLanguage("invalid", TransformLanguageCel, `{"data": input.`))
+	assert.Error(t, engine.AddTransformWithLanguage("undeclared", TransformLanguageCel, `{"data": body}`))
+
+	require.NoError(t, engine.AddTransformWithLanguage("missing-field", TransformLanguageCel, `{"data": input.missing}`))
+	_, err := engine.Execute("missing-field", map[string]interface{}{})
+	assert.EqualError(t, err, "transform-adapter: transform id missing-field failed: no such key: missing")
+}
+
+func TestCelRoute(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter, err := NewAdapter(&Config{D2CMessages: []D2CMessage{{
+		Path:              "/{id}/message",
+		DeviceIdPathParam: "id",
+		AuthHeader:        "key",
+		Transform:         `{"data": {"t": input.t}}`,
+		TransformLanguage: TransformLanguageCel,
+	}}}, "localhost:1000")
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/device/message", `{"t": 21.5}`).Code)
+	require.Len(t, recorder.Messages["device"], 1)
+	assert.Equal(t, map[string]interface{}{"t": 21.5}, recorder.Messages["device"][0].Data)
+}
@@ -0,0 +1,162 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	coapmux "github.com/plgd-dev/go-coap/v3/mux"
+	coapnet "github.com/plgd-dev/go-coap/v3/net"
+	"github.com/plgd-dev/go-coap/v3/options"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	udpserver "github.com/plgd-dev/go-coap/v3/udp/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// CoapIngress is a CoAP (RFC 7252) server over UDP that exposes the device-to-cloud path routes as CoAP resources, so
+// constrained devices can POST telemetry without the overhead of HTTP and TLS. Requests go through the same pipeline as
+// HTTP requests and the response status is mapped onto a CoAP response code.
+type CoapIngress struct {
+	handler  *ReloadableHandler
+	listener *coapnet.UDPConn
+	server   *udpserver.Server
+}
+
+// NewCoapIngress creates a CoAP server listening on the given UDP address, serving requests with the active adapter.
+func NewCoapIngress(address string, handler *ReloadableHandler) (*CoapIngress, error) {
+	listener, err := coapnet.NewListenUDP("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	ingress := &CoapIngress{handler: handler, listener: listener}
+	router := coapmux.NewRouter()
+	router.DefaultHandleFunc(ingress.serveCoap)
+	ingress.server = udp.NewServer(options.WithMux(router), options.WithErrors(func(err error) {
+		log.WithField("error", err).Warnf("CoAP error: %s", err)
+	}))
+
+	return ingress, nil
+}
+
+// Serve starts serving CoAP requests in the background.
+func (ingress *CoapIngress) Serve() {
+	go func() {
+		if err := ingress.server.Serve(ingress.listener); err != nil {
+			log.WithField("error", err).Errorf("CoAP server stopped: %s", err)
+		}
+	}()
+}
+
+// Close stops the server and releases the UDP port.
+func (ingress *CoapIngress) Close() error {
+	ingress.server.Stop()
+	return ingress.listener.Close()
+}
+
+// serveCoap converts a CoAP request into an HTTP request for the D2C routes of the active adapter. The URI path and query
+// options become the request path and query parameters, and the content format becomes the Content-Type header. Error
+// responses carry the JSON error of the route handler as diagnostic payload.
+func (ingress *CoapIngress) serveCoap(w coapmux.ResponseWriter, r *coapmux.Message) {
+	adapter, release := ingress.handler.Acquire()
+	defer release()
+	if adapter == nil {
+		setCoapResponse(w, codes.ServiceUnavailable, nil)
+		return
+	}
+
+	if r.Code() != codes.POST {
+		setCoapResponse(w, codes.MethodNotAllowed, nil)
+		return
+	}
+
+	path, err := r.Path()
+	if err != nil {
+		path = "/"
+	}
+
+	var body bytes.Buffer
+	if r.Body() != nil {
+		if _, err := body.ReadFrom(r.Body()); err != nil {
+			setCoapResponse(w, codes.BadRequest, nil)
+			return
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "/", &body)
+	if err != nil {
+		setCoapResponse(w, codes.InternalServerError, nil)
+		return
+	}
+
+	req.URL.Path = path
+	if queries, err := r.Queries(); err == nil {
+		req.URL.RawQuery = strings.Join(queries, "&")
+	}
+
+	if contentFormat, err := r.ContentFormat(); err == nil {
+		if _, err := message.ToMediaType(contentFormat.String()); err == nil {
+			req.Header.Set("Content-Type", contentFormat.String())
+		}
+	}
+
+	req.RemoteAddr = w.Conn().RemoteAddr().String()
+	response := newBufferedResponseWriter()
+	adapter.CoapRouter.ServeHTTP(response, req)
+
+	code := coapResponseCode(response.status)
+	if code >= codes.BadRequest {
+		setCoapResponse(w, code, response.body.Bytes())
+		return
+	}
+
+	setCoapResponse(w, code, nil)
+}
+
+func setCoapResponse(w coapmux.ResponseWriter, code codes.Code, payload []byte) {
+	var body io.ReadSeeker
+	if len(payload) > 0 {
+		body = bytes.NewReader(payload)
+	}
+
+	if err := w.SetResponse(code, message.AppJSON, body); err != nil {
+		log.WithField("error", err).Errorf("Failed to set CoAP response: %s", err)
+	}
+}
+
+// coapResponseCode maps the response status of a route handler onto a CoAP response code.
+func coapResponseCode(status int) codes.Code {
+	switch {
+	case status == 0 || (status >= 200 && status < 300):
+		return codes.Changed
+	case status == http.StatusUnauthorized:
+		return codes.Unauthorized
+	case status == http.StatusForbidden:
+		return codes.Forbidden
+	case status == http.StatusNotFound:
+		return codes.NotFound
+	case status == http.StatusMethodNotAllowed:
+		return codes.MethodNotAllowed
+	case status == http.StatusRequestEntityTooLarge:
+		return codes.RequestEntityTooLarge
+	case status == http.StatusUnsupportedMediaType:
+		return codes.UnsupportedMediaType
+	case status == http.StatusTooManyRequests:
+		return codes.TooManyRequests
+	case status >= 400 && status < 500:
+		return codes.BadRequest
+	case status == http.StatusBadGateway:
+		return codes.BadGateway
+	case status == http.StatusServiceUnavailable:
+		return codes.ServiceUnavailable
+	case status == http.StatusGatewayTimeout:
+		return codes.GatewayTimeout
+	default:
+		return codes.InternalServerError
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	"github.com/plgd-dev/go-coap/v3/udp/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestCoapIngress starts a CoAP server on a free local port, serving the given adapter, and returns a client connected to it.
+func startTestCoapIngress(t *testing.T, adapter *Adapter) *client.Conn {
+	handler := &ReloadableHandler{}
+	handler.Swap(adapter)
+	ingress, err := NewCoapIngress("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	ingress.Serve()
+	t.Cleanup(func() { ingress.Close() })
+
+	conn, err := udp.Dial(ingress.listener.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func postTestCoapMessage(t *testing.T, conn *client.Conn, path string, contentFormat message.MediaType, payload []byte) (codes.Code, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	response, err := conn.Post(ctx, path, contentFormat, bytes.NewReader(payload), message.Option{ID: message.URIQuery, Value: []byte("key=my_key")})
+	require.NoError(t, err)
+
+	var body bytes.Buffer
+	if response.Body() != nil {
+		body.ReadFrom(response.Body())
+	}
+
+	return response.Code(), body.String()
+}
+
+func TestCoapIngress(t *testing.T) {
+	// The CoAP server responds from its own goroutines, so the recorder is read under its lock.
+	client := &BridgeClientRecorder{}
+	adapter, err := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/{id}/telemetry",
+			DeviceIdPathParam: "id",
+			AuthQueryParam:    "key",
+			Transform:         "{ data: { temperature: .temp } }",
+			Input:             InputOptions{Format: InputFormatAuto},
+		},
+	}}, "localhost:1000")
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+	conn := startTestCoapIngress(t, adapter)
+
+	code, _ := postTestCoapMessage(t, conn, "/my-device/telemetry", message.AppJSON, []byte(`{"temp": 21}`))
+	assert.Equal(t, codes.Changed, code)
+	if sent := client.Sent("my-device"); assert.Len(t, sent, 1) {
+		assert.Equal(t, float64(21), sent[0].Data["temperature"])
+	}
+
+	assert.Equal(t, autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"x-api-key": "my_key"}), client.Authorizer())
+
+	payload, _ := cbor.Marshal(map[string]interface{}{"temp": 22.5})
+	code, _ = postTestCoapMessage(t, conn, "/other-device/telemetry", message.AppCBOR, payload)
+	assert.Equal(t, codes.Changed, code)
+	if sent := client.Sent("other-device"); assert.Len(t, sent, 1) {
+		assert.Equal(t, 22.5, sent[0].Data["temperature"])
+	}
+
+	code, diagnostic := postTestCoapMessage(t, conn, "/my-device/telemetry", message.AppJSON, []byte(`{"temp"`))
+	assert.Equal(t, codes.BadRequest, code)
+	assert.True(t, json.Valid([]byte(diagnostic)))
+
+	code, _ = postTestCoapMessage(t, conn, "/unknown", message.AppJSON, []byte(`{}`))
+	assert.Equal(t, codes.NotFound, code)
+}
+
+func TestCoapIngressBridgeFailure(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/telemetry", DeviceIdPathParam: "id", AuthQueryParam: "key"},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = func() BridgeClient {
+		return &BridgeWithBrokenSend{err: errors.New("throttled"), respose: autorest.Response{Response: &http.Response{StatusCode: 429}}}
+	}
+
+	code, _ := postTestCoapMessage(t, startTestCoapIngress(t, adapter), "/my-device/telemetry", message.AppJSON, []byte(`{"temp": 21}`))
+	assert.Equal(t, codes.TooManyRequests, code)
+}
+
+func TestCoapIngressRequiresQueryAuthentication(t *testing.T) {
+	adapter, err := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/telemetry", DeviceIdPathParam: "id", AuthHeader: "key"},
+		{Path: "/{id}/signed", DeviceIdPathParam: "id", AuthQueryParam: "key", Signature: &SignatureOptions{Header: "X-Signature", Algorithm: "sha256", Encoding: "hex", Secret: "secret", SignedContent: "{body}"}},
+	}}, "localhost:1000")
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = mockGetBridgeClient
+	conn := startTestCoapIngress(t, adapter)
+
+	code, _ := postTestCoapMessage(t, conn, "/my-device/telemetry", message.AppJSON, []byte(`{"temp": 21}`))
+	assert.Equal(t, codes.NotFound, code)
+	code, _ = postTestCoapMessage(t, conn, "/my-device/signed", message.AppJSON, []byte(`{"temp": 21}`))
+	assert.Equal(t, codes.NotFound, code)
+
+	// The routes are still available through HTTP.
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/my-device/telemetry", `{"data": {}}`).Code)
+}
+
+func TestCoapResponseCode(t *testing.T) {
+	assert.Equal(t, codes.Changed, coapResponseCode(202))
+	assert.Equal(t, codes.Unauthorized, coapResponseCode(401))
+	assert.Equal(t, codes.BadRequest, coapResponseCode(422))
+	assert.Equal(t, codes.ServiceUnavailable, coapResponseCode(503))
+	assert.Equal(t, codes.InternalServerError, coapResponseCode(500))
+}
@@ -7,36 +7,162 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net/url"
 	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // Config represents an adapter configuration (with routes, transforms, etc.)
 type Config struct {
-	D2CMessages []D2CMessage
+	D2CMessages        []D2CMessage
+	ReportedProperties []D2CMessage
+	Methods            []C2DRoute
+	C2DMessages        []C2DRoute
+	DesiredProperties  []C2DRoute
+	DeviceKeys         *DeviceKeyTable // Keys of devices authenticating with the adapter, if it manages the Bridge API key
 }
 
+// D2CMessage represents a route definition for device-to-cloud data (telemetry messages or reported properties).
 type D2CMessage struct {
 	Path              string // Path filter for requests that will be routed to this transform
-	Transform         string // jq query to tranform the request body
+	Topic             string // MQTT topic filter for messages that will be routed to this transform, instead of a path
+	Transform         string // Query to tranform the request body
+	TransformLanguage string // Language of the transform: jq (default), cel, or gotemplate
 	DeviceIdPathParam string // Path parameter containing device Id
 	DeviceIdBodyQuery string // jq query to pick the device Id from the request body
 	AuthHeader        string // Header containing auth key
 	AuthQueryParam    string // Query parameter containing auth key
+	FanOut            bool   // Whether each result of the transform is sent as a separate message
+	FanOutConcurrency int    // Maximum number of messages of a fan-out request sent to the Bridge concurrently
+	StoreAndForward   bool   // Whether messages are stored in the durable queue and forwarded to the Bridge asynchronously
+	Mode              string // Whether requests wait for the Bridge ("sync", default) or are accepted once queued in memory ("async")
+	Batch             bool   // Whether request bodies are streamed as NDJSON or a JSON array, each record being sent as a separate message
+	Input             InputOptions
+	Signature         *SignatureOptions    // HMAC signature verified before the request body is decoded. Nil if not required
+	Jwt               *JwtOptions          // Bearer token validated before the request is handled. Nil if not required
+	RouteRateLimit    *RateLimit           // Rate limit of the route as a whole. Nil if unlimited
+	DeviceRateLimit   *RateLimit           // Rate limit of each device of the route. Nil if unlimited
+	DedupKeyQuery     string               // Query computing the idempotency key of messages. Empty if messages aren't deduplicated
+	DedupWindow       time.Duration        // Time during which messages with an already forwarded idempotency key are dropped
+	AutoRegister      *AutoRegisterOptions // Registration of devices before their first message is forwarded. Nil if devices must be pre-registered
+	Wasm              *WasmOptions         // WebAssembly module transforming the raw request body, instead of a transform. Nil if not used
+}
+
+// C2DRoute represents a route definition for cloud-to-device events (method invocations, C2D messages, or desired property updates).
+// Requests to the route path create the Bridge subscription for a device. Events received by the callback are transformed and forwarded to the target URL.
+type C2DRoute struct {
+	Path              string            // Path filter for requests that will create or delete the event subscription of a device
+	DeviceIdPathParam string            // Path parameter containing device Id
+	DeviceIdBodyQuery string            // jq query to pick the device Id from the request body
+	AuthHeader        string            // Header containing auth key
+	AuthQueryParam    string            // Query parameter containing auth key
+	CallbackUrl       string            // URL through which the Bridge reaches the adapter to deliver events
+	CallbackSecret    string            // Secret added to the callback URL, which the Bridge must present to deliver events
+	Transform         string            // Query to transform the event body
+	TransformLanguage string            // Language of the transform and response transform: jq (default), cel, or gotemplate
+	TargetUrl         string            // URL template to which transformed events will be forwarded
+	TargetHeaders     map[string]string // Additional headers sent to the target URL
+	ResponseTransform string            // Query to transform the target response into a method response
 }
 
 // ConfigRaw represents the input config file, before processing.
 type ConfigRaw struct {
-	D2CMessages []D2CMessageRaw `json:"d2cMessages"`
+	D2CMessages        []D2CMessageRaw `json:"d2cMessages"`
+	ReportedProperties []D2CMessageRaw `json:"reportedProperties"`
+	Methods            []C2DRouteRaw   `json:"methods"`
+	C2DMessages        []C2DRouteRaw   `json:"c2dMessages"`
+	DesiredProperties  []C2DRouteRaw   `json:"desiredProperties"`
+	DeviceKeysFile     string          `json:"deviceKeysFile"`
 }
 
 type D2CMessageRaw struct {
 	Path              string `json:"path"`
+	Topic             string `json:"topic"`
+	Preset            string `json:"preset"`
 	Transform         string `json:"transform"`
 	TransformFile     string `json:"transformFile"`
+	TransformLanguage string `json:"transformLanguage"`
 	DeviceIdPathParam string `json:"deviceIdPathParam"`
 	DeviceIdBodyQuery string `json:"deviceIdBodyQuery"`
 	AuthHeader        string `json:"authHeader"`
 	AuthQueryParam    string `json:"authQueryParam"`
+	FanOut            bool   `json:"fanOut"`
+	FanOutConcurrency int    `json:"fanOutConcurrency"`
+	StoreAndForward   bool   `json:"storeAndForward"`
+	Mode              string `json:"mode"`
+	Batch             bool   `json:"batch"`
+
+	Signature *SignatureOptionsRaw `json:"signature"`
+	Jwt       *JwtOptionsRaw       `json:"jwt"`
+
+	RouteRateLimit  *RateLimitRaw `json:"routeRateLimit"`
+	DeviceRateLimit *RateLimitRaw `json:"deviceRateLimit"`
+
+	DedupKeyQuery string `json:"dedupKeyQuery"`
+	DedupWindow   string `json:"dedupWindow"`
+
+	AutoRegister *AutoRegisterRaw `json:"autoRegister"`
+
+	TransformWasm   string `json:"transformWasm"`
+	WasmMaxMemoryMb int    `json:"wasmMaxMemoryMb"`
+	WasmTimeout     string `json:"wasmTimeout"`
+
+	InputFormat         string `json:"inputFormat"`
+	CsvDelimiter        string `json:"csvDelimiter"`
+	CsvHeaderRow        *bool  `json:"csvHeaderRow"`
+	XmlAttributePrefix  string `json:"xmlAttributePrefix"`
+	XmlIgnoreAttributes bool   `json:"xmlIgnoreAttributes"`
+}
+
+type SignatureOptionsRaw struct {
+	Header          string `json:"header"`
+	Algorithm       string `json:"algorithm"`
+	Encoding        string `json:"encoding"`
+	Prefix          string `json:"prefix"`
+	Secret          string `json:"secret"`
+	SecretFile      string `json:"secretFile"`
+	TimestampHeader string `json:"timestampHeader"`
+	ReplayWindow    string `json:"replayWindow"`
+	SignedContent   string `json:"signedContent"`
+}
+
+type AutoRegisterRaw struct {
+	ModelId      string `json:"modelId"`
+	ModelIdQuery string `json:"modelIdQuery"`
+}
+
+type RateLimitRaw struct {
+	Rate       float64 `json:"rate"`
+	Burst      int     `json:"burst"`
+	MaxDevices int     `json:"maxDevices"`
+}
+
+type JwtOptionsRaw struct {
+	JwksFile      string `json:"jwksFile"`
+	JwksUrl       string `json:"jwksUrl"`
+	Issuer        string `json:"issuer"`
+	Audience      string `json:"audience"`
+	Leeway        string `json:"leeway"`
+	DeviceIdClaim string `json:"deviceIdClaim"`
+}
+
+type C2DRouteRaw struct {
+	Path              string            `json:"path"`
+	DeviceIdPathParam string            `json:"deviceIdPathParam"`
+	DeviceIdBodyQuery string            `json:"deviceIdBodyQuery"`
+	AuthHeader        string            `json:"authHeader"`
+	AuthQueryParam    string            `json:"authQueryParam"`
+	CallbackUrl       string            `json:"callbackUrl"`
+	CallbackSecret    string            `json:"callbackSecret"`
+	Transform         string            `json:"transform"`
+	TransformFile     string            `json:"transformFile"`
+	TransformLanguage string            `json:"transformLanguage"`
+	TargetUrl         string            `json:"targetUrl"`
+	TargetHeaders     map[string]string `json:"targetHeaders"`
+	ResponseTransform string            `json:"responseTransform"`
 }
 
 // LoadConfig loads, parses, and validates an adapter config from a file.
@@ -49,26 +175,69 @@ func LoadConfig(configPath string, configFileName string) (*Config, error) {
 		return nil, errors.New("transform-adapter: missing config file")
 	}
 
-	configFile, err := ioutil.ReadFile(filepath.Join(configPath, configFileName))
+	configRaw, err := readConfigRaw(configPath, configFileName)
 
 	if err != nil {
 		return nil, err
 	}
 
-	var configRaw ConfigRaw
+	configRaw.applyPresets()
+	if err := validate(configRaw); err != nil {
+		return nil, err
+	}
 
-	if err = json.Unmarshal(configFile, &configRaw); err != nil {
+	d2cMessages, err := processD2CMessages(configPath, configRaw.D2CMessages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reportedProperties, err := processD2CMessages(configPath, configRaw.ReportedProperties)
+
+	if err != nil {
+		return nil, err
+	}
+
+	methods, err := processC2DRoutes(configPath, configRaw.Methods)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c2dMessages, err := processC2DRoutes(configPath, configRaw.C2DMessages)
+
+	if err != nil {
 		return nil, err
 	}
 
-	if err := validate(&configRaw); err != nil {
+	desiredProperties, err := processC2DRoutes(configPath, configRaw.DesiredProperties)
+
+	if err != nil {
 		return nil, err
 	}
 
-	config := Config{D2CMessages: make([]D2CMessage, len(configRaw.D2CMessages))}
+	var deviceKeys *DeviceKeyTable
+	if configRaw.DeviceKeysFile != "" {
+		if deviceKeys, err = LoadDeviceKeyTable(filepath.Join(configPath, configRaw.DeviceKeysFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Config{
+		D2CMessages:        d2cMessages,
+		ReportedProperties: reportedProperties,
+		Methods:            methods,
+		C2DMessages:        c2dMessages,
+		DesiredProperties:  desiredProperties,
+		DeviceKeys:         deviceKeys,
+	}, nil
+}
+
+// processD2CMessages generates the processed route definitions from raw ones, resolving transform files.
+func processD2CMessages(configPath string, messagesRaw []D2CMessageRaw) ([]D2CMessage, error) {
+	messages := make([]D2CMessage, len(messagesRaw))
 
-	// Generate processed config
-	for i, message := range configRaw.D2CMessages {
+	for i, message := range messagesRaw {
 		// Resolve transform files
 		if message.TransformFile != "" {
 			transformFileContent, err := ioutil.ReadFile(filepath.Join(configPath, message.TransformFile))
@@ -80,36 +249,623 @@ func LoadConfig(configPath string, configFileName string) (*Config, error) {
 			message.Transform = string(transformFileContent)
 		}
 
-		config.D2CMessages[i] = D2CMessage{
+		signature, err := processSignatureOptions(configPath, message.Signature)
+		if err != nil {
+			return nil, err
+		}
+
+		jwtOptions, err := processJwtOptions(configPath, message.Jwt)
+		if err != nil {
+			return nil, err
+		}
+
+		wasm, err := processWasmOptions(configPath, &message)
+		if err != nil {
+			return nil, err
+		}
+
+		var dedupWindow time.Duration
+		if message.DedupWindow != "" {
+			dedupWindow, _ = time.ParseDuration(message.DedupWindow)
+		} else if message.DedupKeyQuery != "" {
+			dedupWindow = defaultDedupWindow
+		}
+
+		messages[i] = D2CMessage{
 			Path:              message.Path,
+			Topic:             message.Topic,
 			Transform:         message.Transform,
+			TransformLanguage: message.TransformLanguage,
 			DeviceIdPathParam: message.DeviceIdPathParam,
 			DeviceIdBodyQuery: message.DeviceIdBodyQuery,
 			AuthHeader:        message.AuthHeader,
 			AuthQueryParam:    message.AuthQueryParam,
+			FanOut:            message.FanOut,
+			FanOutConcurrency: message.FanOutConcurrency,
+			StoreAndForward:   message.StoreAndForward,
+			Mode:              message.Mode,
+			Batch:             message.Batch,
+			Input: InputOptions{
+				Format:              message.InputFormat,
+				CsvDelimiter:        message.CsvDelimiter,
+				CsvNoHeaderRow:      message.CsvHeaderRow != nil && !*message.CsvHeaderRow,
+				XmlAttributePrefix:  message.XmlAttributePrefix,
+				XmlIgnoreAttributes: message.XmlIgnoreAttributes,
+			},
+			Signature: signature,
+			Jwt:       jwtOptions,
+
+			RouteRateLimit:  processRateLimit(message.RouteRateLimit),
+			DeviceRateLimit: processRateLimit(message.DeviceRateLimit),
+
+			DedupKeyQuery: message.DedupKeyQuery,
+			DedupWindow:   dedupWindow,
+
+			AutoRegister: processAutoRegister(message.AutoRegister),
+			Wasm:         wasm,
 		}
 	}
 
-	return &config, nil
+	return messages, nil
+}
+
+// processWasmOptions generates the processed WebAssembly transform options of a route from raw ones, reading its module file.
+func processWasmOptions(configPath string, message *D2CMessageRaw) (*WasmOptions, error) {
+	if message.TransformWasm == "" {
+		return nil, nil
+	}
+
+	module, err := ioutil.ReadFile(filepath.Join(configPath, message.TransformWasm))
+	if err != nil {
+		return nil, err
+	}
+
+	var timeout time.Duration
+	if message.WasmTimeout != "" {
+		timeout, _ = time.ParseDuration(message.WasmTimeout)
+	}
+
+	return &WasmOptions{Module: module, MaxMemoryMb: message.WasmMaxMemoryMb, Timeout: timeout}, nil
+}
+
+// processAutoRegister generates the processed auto-registration options of a route from raw ones.
+func processAutoRegister(optionsRaw *AutoRegisterRaw) *AutoRegisterOptions {
+	if optionsRaw == nil {
+		return nil
+	}
+
+	return &AutoRegisterOptions{ModelId: optionsRaw.ModelId, ModelIdQuery: optionsRaw.ModelIdQuery}
+}
+
+// processSignatureOptions generates the processed signature options of a route from raw ones, resolving the secret file and applying defaults.
+func processSignatureOptions(configPath string, optionsRaw *SignatureOptionsRaw) (*SignatureOptions, error) {
+	if optionsRaw == nil {
+		return nil, nil
+	}
+
+	options := SignatureOptions{
+		Header:          optionsRaw.Header,
+		Algorithm:       optionsRaw.Algorithm,
+		Encoding:        optionsRaw.Encoding,
+		Prefix:          optionsRaw.Prefix,
+		Secret:          optionsRaw.Secret,
+		TimestampHeader: optionsRaw.TimestampHeader,
+		ReplayWindow:    defaultSignatureReplayWindow,
+		SignedContent:   optionsRaw.SignedContent,
+	}
+
+	if optionsRaw.SecretFile != "" {
+		secret, err := ioutil.ReadFile(filepath.Join(configPath, optionsRaw.SecretFile))
+		if err != nil {
+			return nil, err
+		}
+
+		options.Secret = strings.TrimSpace(string(secret))
+	}
+
+	if optionsRaw.ReplayWindow != "" {
+		options.ReplayWindow, _ = time.ParseDuration(optionsRaw.ReplayWindow)
+	}
+
+	if options.Algorithm == "" {
+		options.Algorithm = defaultSignatureAlgorithm
+	}
+
+	if options.Encoding == "" {
+		options.Encoding = defaultSignatureEncoding
+	}
+
+	if options.SignedContent == "" {
+		options.SignedContent = defaultSignedContent
+	}
+
+	return &options, nil
+}
+
+// processRateLimit generates a processed rate limit from a raw one, applying defaults. The burst defaults to one second worth of requests.
+func processRateLimit(limitRaw *RateLimitRaw) *RateLimit {
+	if limitRaw == nil {
+		return nil
+	}
+
+	limit := RateLimit{Rate: limitRaw.Rate, Burst: limitRaw.Burst, MaxDevices: limitRaw.MaxDevices}
+	if limit.Burst == 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+
+	if limit.MaxDevices == 0 {
+		limit.MaxDevices = defaultRateLimitMaxDevices
+	}
+
+	return &limit
+}
+
+// processJwtOptions generates the processed bearer token options of a route from raw ones, loading the JWKS file.
+func processJwtOptions(configPath string, optionsRaw *JwtOptionsRaw) (*JwtOptions, error) {
+	if optionsRaw == nil {
+		return nil, nil
+	}
+
+	options := JwtOptions{Issuer: optionsRaw.Issuer, Audience: optionsRaw.Audience, DeviceIdClaim: optionsRaw.DeviceIdClaim}
+	if optionsRaw.Leeway != "" {
+		options.Leeway, _ = time.ParseDuration(optionsRaw.Leeway)
+	}
+
+	if optionsRaw.JwksUrl != "" {
+		options.Keys = NewJwksUrlKeySet(optionsRaw.JwksUrl)
+		return &options, nil
+	}
+
+	keys, err := LoadJwksFile(filepath.Join(configPath, optionsRaw.JwksFile))
+	if err != nil {
+		return nil, err
+	}
+
+	options.Keys = keys
+	return &options, nil
+}
+
+// processC2DRoutes generates the processed cloud-to-device route definitions from raw ones, resolving transform files.
+func processC2DRoutes(configPath string, routesRaw []C2DRouteRaw) ([]C2DRoute, error) {
+	routes := make([]C2DRoute, len(routesRaw))
+
+	for i, route := range routesRaw {
+		// Resolve transform files
+		if route.TransformFile != "" {
+			transformFileContent, err := ioutil.ReadFile(filepath.Join(configPath, route.TransformFile))
+
+			if err != nil {
+				return nil, err
+			}
+
+			route.Transform = string(transformFileContent)
+		}
+
+		routes[i] = C2DRoute{
+			Path:              route.Path,
+			DeviceIdPathParam: route.DeviceIdPathParam,
+			DeviceIdBodyQuery: route.DeviceIdBodyQuery,
+			AuthHeader:        route.AuthHeader,
+			AuthQueryParam:    route.AuthQueryParam,
+			CallbackUrl:       route.CallbackUrl,
+			CallbackSecret:    route.CallbackSecret,
+			Transform:         route.Transform,
+			TransformLanguage: route.TransformLanguage,
+			TargetUrl:         route.TargetUrl,
+			TargetHeaders:     route.TargetHeaders,
+			ResponseTransform: route.ResponseTransform,
+		}
+	}
+
+	return routes, nil
+}
+
+// readConfigRaw reads and parses a config file, without validating or processing it.
+func readConfigRaw(configPath string, configFileName string) (*ConfigRaw, error) {
+	configFile, err := ioutil.ReadFile(filepath.Join(configPath, configFileName))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var configRaw ConfigRaw
+
+	if err = json.Unmarshal(configFile, &configRaw); err != nil {
+		return nil, err
+	}
+
+	return &configRaw, nil
+}
+
+// referencedFiles returns the names of all files referenced by the config (transform files, WebAssembly modules, signature secret files,
+// JWKS files, and the device keys file).
+func (config *ConfigRaw) referencedFiles() []string {
+	var files []string
+	if config.DeviceKeysFile != "" {
+		files = append(files, config.DeviceKeysFile)
+	}
+
+	for _, messages := range [][]D2CMessageRaw{config.D2CMessages, config.ReportedProperties} {
+		for _, message := range messages {
+			if message.TransformFile != "" {
+				files = append(files, message.TransformFile)
+			}
+
+			if message.TransformWasm != "" {
+				files = append(files, message.TransformWasm)
+			}
+
+			if message.Signature != nil && message.Signature.SecretFile != "" {
+				files = append(files, message.Signature.SecretFile)
+			}
+
+			if message.Jwt != nil && message.Jwt.JwksFile != "" {
+				files = append(files, message.Jwt.JwksFile)
+			}
+		}
+	}
+
+	for _, routes := range [][]C2DRouteRaw{config.Methods, config.C2DMessages, config.DesiredProperties} {
+		for _, route := range routes {
+			if route.TransformFile != "" {
+				files = append(files, route.TransformFile)
+			}
+		}
+	}
+
+	return files
 }
 
 func validate(config *ConfigRaw) error {
 	for _, message := range config.D2CMessages {
-		if message.Path == "" {
-			return errors.New("transform-adapter: path missing in D2C message definition")
+		if err := validateD2CMessage(&message, "D2C message"); err != nil {
+			return err
+		}
+
+		if message.FanOut && message.StoreAndForward {
+			return fmt.Errorf("transform-adapter: fanOut and storeAndForward may not be combined, in D2C message definition %s", message.route())
+		}
+
+		if message.Mode == DeliveryModeAsync && (message.FanOut || message.StoreAndForward) {
+			return fmt.Errorf("transform-adapter: async mode may not be combined with fanOut or storeAndForward, in D2C message definition %s", message.route())
+		}
+
+		if message.AutoRegister != nil && message.StoreAndForward {
+			return fmt.Errorf("transform-adapter: autoRegister and storeAndForward may not be combined, in D2C message definition %s", message.route())
+		}
+
+		if message.Batch {
+			if message.FanOut || message.StoreAndForward || message.Mode == DeliveryModeAsync {
+				return fmt.Errorf("transform-adapter: batch may not be combined with fanOut, storeAndForward, or async mode, in D2C message definition %s", message.route())
+			}
+
+			if message.Signature != nil {
+				return fmt.Errorf("transform-adapter: signature may not be defined in batch D2C message definition %s, since batch bodies are streamed", message.route())
+			}
+
+			if message.InputFormat != "" && message.InputFormat != InputFormatJson {
+				return fmt.Errorf("transform-adapter: inputFormat must be json in batch D2C message definition %s", message.route())
+			}
+		}
+	}
+
+	for _, message := range config.ReportedProperties {
+		// Checked first, since presets supply parameters that are otherwise reported as missing.
+		if message.Preset != "" {
+			return fmt.Errorf("transform-adapter: preset may only be defined in D2C message definitions, found in reported properties definition %s", message.route())
+		}
+
+		if err := validateD2CMessage(&message, "reported properties"); err != nil {
+			return err
+		}
+
+		if message.FanOut {
+			return fmt.Errorf("transform-adapter: fanOut may only be defined in D2C message definitions, found in reported properties definition %s", message.route())
+		}
+
+		if message.StoreAndForward {
+			return fmt.Errorf("transform-adapter: storeAndForward may only be defined in D2C message definitions, found in reported properties definition %s", message.route())
+		}
+
+		if message.DedupKeyQuery != "" {
+			return fmt.Errorf("transform-adapter: dedupKeyQuery may only be defined in D2C message definitions, found in reported properties definition %s", message.route())
+		}
+
+		if message.Mode == DeliveryModeAsync {
+			return fmt.Errorf("transform-adapter: async mode may only be used in D2C message definitions, found in reported properties definition %s", message.route())
+		}
+
+		if message.Batch {
+			return fmt.Errorf("transform-adapter: batch may only be defined in D2C message definitions, found in reported properties definition %s", message.route())
+		}
+
+		if message.AutoRegister != nil {
+			return fmt.Errorf("transform-adapter: autoRegister may only be defined in D2C message definitions, found in reported properties definition %s", message.route())
+		}
+	}
+
+	for _, route := range config.Methods {
+		if err := validateC2DRoute(&route, "method"); err != nil {
+			return err
+		}
+	}
+
+	for _, route := range config.C2DMessages {
+		if err := validateC2DRoute(&route, "C2D message"); err != nil {
+			return err
+		}
+
+		if route.ResponseTransform != "" {
+			return fmt.Errorf("transform-adapter: responseTransform may only be defined in method definitions, found in C2D message definition %s", route.Path)
+		}
+	}
+
+	for _, route := range config.DesiredProperties {
+		if err := validateC2DRoute(&route, "desired properties"); err != nil {
+			return err
+		}
+
+		if route.ResponseTransform != "" {
+			return fmt.Errorf("transform-adapter: responseTransform may only be defined in method definitions, found in desired properties definition %s", route.Path)
 		}
+	}
+
+	return nil
+}
+
+// validateD2CMessage validates a route definition. Kind describes the type of route in error messages.
+func validateD2CMessage(message *D2CMessageRaw, kind string) error {
+	if message.Path == "" && message.Topic == "" {
+		return fmt.Errorf("transform-adapter: path missing in %s definition", kind)
+	}
+
+	if message.Path != "" && message.Topic != "" {
+		return fmt.Errorf("transform-adapter: either path or topic may be defined, not both, in %s definition %s", kind, message.route())
+	}
+
+	if _, ok := presets[message.Preset]; message.Preset != "" && !ok {
+		return fmt.Errorf("transform-adapter: preset must be either %s or %s in %s definition %s", PresetTtnV3Uplink, PresetChirpStackV4Uplink, kind, message.route())
+	}
+
+	// The transforms of presets are written in jq.
+	if message.Preset != "" && !definesTransform(message) && message.TransformLanguage != "" && message.TransformLanguage != TransformLanguageJq {
+		return fmt.Errorf("transform-adapter: transformLanguage %s requires a transform or transformFile, since the transform of preset %s is written in jq, in %s definition %s", message.TransformLanguage, message.Preset, kind, message.route())
+	}
+
+	if message.Transform != "" && message.TransformFile != "" {
+		return fmt.Errorf("transform-adapter: either transform or transformFile may be defined, not both, in %s definition %s", kind, message.route())
+	}
+
+	if !validTransformLanguage(message.TransformLanguage) {
+		return fmt.Errorf("transform-adapter: transformLanguage must be one of jq, cel, or gotemplate in %s definition %s", kind, message.route())
+	}
+
+	if err := validateWasmOptions(message); err != nil {
+		return fmt.Errorf("transform-adapter: %s in %s definition %s", err, kind, message.route())
+	}
+
+	// Only jq transforms may generate multiple results.
+	if message.FanOut && message.TransformLanguage != "" && message.TransformLanguage != TransformLanguageJq {
+		return fmt.Errorf("transform-adapter: fanOut requires a jq transform in %s definition %s", kind, message.route())
+	}
 
-		if message.Transform != "" && message.TransformFile != "" {
-			return fmt.Errorf("transform-adapter: either transform or transformFile may be defined, not both, in D2C message definition %s", message.Path)
+	if message.Topic != "" {
+		if strings.HasPrefix(message.Topic, "/") || strings.ContainsAny(message.Topic, "+#") {
+			return fmt.Errorf("transform-adapter: topic must not start with a slash or contain wildcards (use {param} segments instead) in %s definition %s", kind, message.route())
 		}
 
-		if (message.AuthHeader == "" && message.AuthQueryParam == "") || (message.AuthHeader != "" && message.AuthQueryParam != "") {
-			return fmt.Errorf("transform-adapter: either authHeader or authQueryParam must be defined in D2C message definition %s", message.Path)
+		if message.AuthHeader != "" || message.AuthQueryParam != "" {
+			return fmt.Errorf("transform-adapter: authHeader and authQueryParam may not be defined in MQTT %s definition %s, the MQTT password is used as API key", kind, message.route())
 		}
 
-		if (message.DeviceIdPathParam == "" && message.DeviceIdBodyQuery == "") || (message.DeviceIdPathParam != "" && message.DeviceIdBodyQuery != "") {
-			return fmt.Errorf("transform-adapter: either deviceIdPathParam or deviceIdBodyQuery must be defined in D2C message definition %s", message.Path)
+		if message.Signature != nil || message.Jwt != nil {
+			return fmt.Errorf("transform-adapter: signature and jwt may not be defined in MQTT %s definition %s", kind, message.route())
 		}
+	} else if message.AuthHeader != "" && message.AuthQueryParam != "" {
+		return fmt.Errorf("transform-adapter: either authHeader or authQueryParam must be defined in %s definition %s", kind, message.route())
+	} else if message.AuthHeader == "" && message.AuthQueryParam == "" && message.Signature == nil && message.Jwt == nil {
+		return fmt.Errorf("transform-adapter: either authHeader or authQueryParam must be defined in %s definition %s", kind, message.route())
+	}
+
+	if message.Signature != nil {
+		if err := validateSignatureOptions(message.Signature); err != nil {
+			return fmt.Errorf("transform-adapter: %s in %s definition %s", err, kind, message.route())
+		}
+	}
+
+	if message.DedupWindow != "" {
+		if message.DedupKeyQuery == "" {
+			return fmt.Errorf("transform-adapter: dedupWindow requires dedupKeyQuery in %s definition %s", kind, message.route())
+		}
+
+		if window, err := time.ParseDuration(message.DedupWindow); err != nil || window <= 0 {
+			return fmt.Errorf("transform-adapter: dedupWindow must be a positive duration in %s definition %s", kind, message.route())
+		}
+	}
+
+	if message.Mode != "" && message.Mode != DeliveryModeSync && message.Mode != DeliveryModeAsync {
+		return fmt.Errorf("transform-adapter: mode must be either %s or %s in %s definition %s", DeliveryModeSync, DeliveryModeAsync, kind, message.route())
+	}
+
+	if !validRateLimit(message.RouteRateLimit) || !validRateLimit(message.DeviceRateLimit) {
+		return fmt.Errorf("transform-adapter: rate limits must have a positive rate and may not have a negative burst or maxDevices in %s definition %s", kind, message.route())
+	}
+
+	if message.AutoRegister != nil && (message.AutoRegister.ModelId == "") == (message.AutoRegister.ModelIdQuery == "") {
+		return fmt.Errorf("transform-adapter: either autoRegister modelId or modelIdQuery must be defined in %s definition %s", kind, message.route())
+	}
+
+	if message.Jwt != nil {
+		if err := validateJwtOptions(message.Jwt); err != nil {
+			return fmt.Errorf("transform-adapter: %s in %s definition %s", err, kind, message.route())
+		}
+	}
+
+	if (message.DeviceIdPathParam == "" && message.DeviceIdBodyQuery == "") || (message.DeviceIdPathParam != "" && message.DeviceIdBodyQuery != "") {
+		return fmt.Errorf("transform-adapter: either deviceIdPathParam or deviceIdBodyQuery must be defined in %s definition %s", kind, message.route())
+	}
+
+	if message.FanOutConcurrency < 0 {
+		return fmt.Errorf("transform-adapter: fanOutConcurrency must not be negative in %s definition %s", kind, message.route())
+	}
+
+	switch message.InputFormat {
+	case "", InputFormatJson, InputFormatAuto, InputFormatCsv, InputFormatXml, InputFormatForm, InputFormatCbor:
+	default:
+		return fmt.Errorf("transform-adapter: inputFormat must be one of json, auto, csv, xml, form, or cbor in %s definition %s", kind, message.route())
+	}
+
+	if delimiter, size := utf8.DecodeRuneInString(message.CsvDelimiter); message.CsvDelimiter != "" && (size != len(message.CsvDelimiter) || delimiter == '"' || delimiter == '\r' || delimiter == '\n' || delimiter == utf8.RuneError) {
+		return fmt.Errorf("transform-adapter: csvDelimiter must be a single character, other than quotes or line breaks, in %s definition %s", kind, message.route())
+	}
+
+	return nil
+}
+
+// validateWasmOptions validates the WebAssembly transform options of a route. The module replaces the transform and the decoding
+// of the request body, so it can't be combined with them.
+func validateWasmOptions(message *D2CMessageRaw) error {
+	if message.TransformWasm == "" {
+		if message.WasmMaxMemoryMb != 0 || message.WasmTimeout != "" {
+			return errors.New("wasmMaxMemoryMb and wasmTimeout require transformWasm")
+		}
+
+		return nil
+	}
+
+	if message.Transform != "" || message.TransformFile != "" || message.TransformLanguage != "" {
+		return errors.New("transformWasm may not be combined with transform, transformFile, or transformLanguage")
+	}
+
+	if message.InputFormat != "" || message.FanOut || message.Batch {
+		return errors.New("transformWasm may not be combined with inputFormat, fanOut, or batch")
+	}
+
+	if message.WasmMaxMemoryMb < 0 || message.WasmMaxMemoryMb > maxWasmMemoryMb {
+		return fmt.Errorf("wasmMaxMemoryMb must be between 0 and %d", maxWasmMemoryMb)
+	}
+
+	if message.WasmTimeout != "" {
+		if timeout, err := time.ParseDuration(message.WasmTimeout); err != nil || timeout <= 0 {
+			return errors.New("wasmTimeout must be a positive duration")
+		}
+	}
+
+	return nil
+}
+
+// validTransformLanguage returns whether a transform language is supported. An empty language defaults to jq.
+func validTransformLanguage(language string) bool {
+	_, ok := transformLanguages[language]
+	return language == "" || ok
+}
+
+// validateSignatureOptions validates the signature options of a route.
+func validateSignatureOptions(options *SignatureOptionsRaw) error {
+	if options.Header == "" {
+		return errors.New("signature header missing")
+	}
+
+	if _, ok := signatureAlgorithms[options.Algorithm]; options.Algorithm != "" && !ok {
+		return errors.New("signature algorithm must be one of sha1, sha256, or sha512")
+	}
+
+	if _, ok := signatureEncodings[options.Encoding]; options.Encoding != "" && !ok {
+		return errors.New("signature encoding must be one of hex, base64, or base64url")
+	}
+
+	if (options.Secret == "") == (options.SecretFile == "") {
+		return errors.New("either signature secret or secretFile must be defined")
+	}
+
+	if options.ReplayWindow != "" {
+		if replayWindow, err := time.ParseDuration(options.ReplayWindow); err != nil || replayWindow <= 0 {
+			return errors.New("signature replayWindow must be a positive duration")
+		}
+	}
+
+	if options.SignedContent != "" && strings.Count(options.SignedContent, "{body}") != 1 {
+		return errors.New("signature signedContent must contain the {body} placeholder exactly once")
+	}
+
+	if strings.Contains(options.SignedContent, "{timestamp}") && options.TimestampHeader == "" {
+		return errors.New("signature signedContent may only contain the {timestamp} placeholder if timestampHeader is defined")
+	}
+
+	return nil
+}
+
+// validRateLimit returns whether a rate limit of a route, if defined, is valid.
+func validRateLimit(limit *RateLimitRaw) bool {
+	return limit == nil || (limit.Rate > 0 && limit.Burst >= 0 && limit.MaxDevices >= 0)
+}
+
+// validateJwtOptions validates the bearer token options of a route.
+func validateJwtOptions(options *JwtOptionsRaw) error {
+	if (options.JwksFile == "") == (options.JwksUrl == "") {
+		return errors.New("either jwt jwksFile or jwksUrl must be defined")
+	}
+
+	if options.JwksUrl != "" {
+		if jwksUrl, err := url.Parse(options.JwksUrl); err != nil || (jwksUrl.Scheme != "http" && jwksUrl.Scheme != "https") || jwksUrl.Host == "" {
+			return errors.New("jwt jwksUrl must be an absolute HTTP(S) URL")
+		}
+	}
+
+	if options.Issuer == "" || options.Audience == "" {
+		return errors.New("jwt issuer and audience must be defined")
+	}
+
+	if options.Leeway != "" {
+		if leeway, err := time.ParseDuration(options.Leeway); err != nil || leeway < 0 {
+			return errors.New("jwt leeway must be a non-negative duration")
+		}
+	}
+
+	return nil
+}
+
+// route returns the path or MQTT topic of a route definition, to identify it in error messages.
+func (message *D2CMessageRaw) route() string {
+	if message.Topic != "" {
+		return message.Topic
+	}
+
+	return message.Path
+}
+
+// validateC2DRoute validates a cloud-to-device route definition. Kind describes the type of route in error messages.
+func validateC2DRoute(route *C2DRouteRaw, kind string) error {
+	if route.Path == "" {
+		return fmt.Errorf("transform-adapter: path missing in %s definition", kind)
+	}
+
+	if route.Transform != "" && route.TransformFile != "" {
+		return fmt.Errorf("transform-adapter: either transform or transformFile may be defined, not both, in %s definition %s", kind, route.Path)
+	}
+
+	if !validTransformLanguage(route.TransformLanguage) {
+		return fmt.Errorf("transform-adapter: transformLanguage must be one of jq, cel, or gotemplate in %s definition %s", kind, route.Path)
+	}
+
+	if (route.AuthHeader == "" && route.AuthQueryParam == "") || (route.AuthHeader != "" && route.AuthQueryParam != "") {
+		return fmt.Errorf("transform-adapter: either authHeader or authQueryParam must be defined in %s definition %s", kind, route.Path)
+	}
+
+	if (route.DeviceIdPathParam == "" && route.DeviceIdBodyQuery == "") || (route.DeviceIdPathParam != "" && route.DeviceIdBodyQuery != "") {
+		return fmt.Errorf("transform-adapter: either deviceIdPathParam or deviceIdBodyQuery must be defined in %s definition %s", kind, route.Path)
+	}
+
+	if callbackUrl, err := url.Parse(route.CallbackUrl); err != nil || !callbackUrl.IsAbs() || callbackUrl.Path == "" {
+		return fmt.Errorf("transform-adapter: callbackUrl must be an absolute URL, including a path, in %s definition %s", kind, route.Path)
+	}
+
+	if route.TargetUrl == "" {
+		return fmt.Errorf("transform-adapter: targetUrl missing in %s definition %s", kind, route.Path)
+	}
+
+	if route.CallbackSecret == "" {
+		return fmt.Errorf("transform-adapter: callbackSecret missing in %s definition %s", kind, route.Path)
 	}
 
 	return nil
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,11 +25,11 @@ func ExampleLoadConfigSuccess() {
 	currentPath, _ := os.Getwd()
 	result, _ := LoadConfig(currentPath, "config_mock.json")
 	fmt.Println(result)
-	// Output: &{[{/{id}/cde  id  key } {/message { data: .dd,  properties, componentName, creationTimeUtc }  .Device.Id  apk} {/telemetry/{deviceId} {
+	// Output: &{[{/{id}/cde    id  key  false 0 false  false {  false  false} <nil> <nil> <nil> <nil>  0s <nil> <nil>} {/message  { data: .dd,  properties, componentName, creationTimeUtc }   .Device.Id  apk false 0 false  false {  false  false} <nil> <nil> <nil> <nil>  0s <nil> <nil>} {/telemetry/{deviceId}  {
 	//     data: .obj
 	//         | map( { (.name | tostring): .value } )
 	//         | add
-	// } deviceId  api-key }]}
+	// }  deviceId  api-key  false 0 false  false {  false  false} <nil> <nil> <nil> <nil>  0s <nil> <nil>}] [{/{id}/properties  { patch: .state }  id  key  false 0 false  false {  false  false} <nil> <nil> <nil> <nil>  0s <nil> <nil>}] [] [] [] <nil>}
 }
 
 func TestValidatePathMissing(t *testing.T) {
@@ -50,3 +51,188 @@ func TestValidateAuthMissing(t *testing.T) {
 	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/"}}})
 	assert.EqualError(t, err, "transform-adapter: either authHeader or authQueryParam must be defined in D2C message definition /")
 }
+
+func TestValidateReportedPropertiesAuthMissing(t *testing.T) {
+	err := validate(&ConfigRaw{ReportedProperties: []D2CMessageRaw{{Path: "/properties", DeviceIdBodyQuery: ".id"}}})
+	assert.EqualError(t, err, "transform-adapter: either authHeader or authQueryParam must be defined in reported properties definition /properties")
+}
+
+func TestValidateC2DRouteCallbackUrl(t *testing.T) {
+	err := validate(&ConfigRaw{Methods: []C2DRouteRaw{{Path: "/{id}/commands", DeviceIdPathParam: "id", AuthHeader: "key", CallbackUrl: "/callback", TargetUrl: "http://vendor"}}})
+	assert.EqualError(t, err, "transform-adapter: callbackUrl must be an absolute URL, including a path, in method definition /{id}/commands")
+}
+
+func TestValidateC2DRouteTargetUrlMissing(t *testing.T) {
+	err := validate(&ConfigRaw{C2DMessages: []C2DRouteRaw{{Path: "/{id}/messages", DeviceIdPathParam: "id", AuthHeader: "key", CallbackUrl: "http://localhost:3000/callback"}}})
+	assert.EqualError(t, err, "transform-adapter: targetUrl missing in C2D message definition /{id}/messages")
+}
+
+func TestValidateC2DRouteCallbackSecretMissing(t *testing.T) {
+	err := validate(&ConfigRaw{Methods: []C2DRouteRaw{{Path: "/{id}/commands", DeviceIdPathParam: "id", AuthHeader: "key", CallbackUrl: "http://localhost:3000/callback", TargetUrl: "http://vendor"}}})
+	assert.EqualError(t, err, "transform-adapter: callbackSecret missing in method definition /{id}/commands")
+}
+
+func TestValidateC2DRouteResponseTransform(t *testing.T) {
+	err := validate(&ConfigRaw{DesiredProperties: []C2DRouteRaw{{Path: "/{id}/properties", DeviceIdPathParam: "id", AuthHeader: "key", CallbackUrl: "http://localhost:3000/callback", CallbackSecret: "secret", TargetUrl: "http://vendor", ResponseTransform: "."}}})
+	assert.EqualError(t, err, "transform-adapter: responseTransform may only be defined in method definitions, found in desired properties definition /{id}/properties")
+}
+
+func TestValidateFanOutReportedProperties(t *testing.T) {
+	err := validate(&ConfigRaw{ReportedProperties: []D2CMessageRaw{{Path: "/properties", DeviceIdBodyQuery: ".id", AuthHeader: "key", FanOut: true}}})
+	assert.EqualError(t, err, "transform-adapter: fanOut may only be defined in D2C message definitions, found in reported properties definition /properties")
+}
+
+func TestValidateStoreAndForwardFanOut(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/batch", DeviceIdBodyQuery: ".id", AuthHeader: "key", FanOut: true, StoreAndForward: true}}})
+	assert.EqualError(t, err, "transform-adapter: fanOut and storeAndForward may not be combined, in D2C message definition /batch")
+}
+
+func TestValidateTopic(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/telemetry", Topic: "telemetry", DeviceIdBodyQuery: ".id"}}})
+	assert.EqualError(t, err, "transform-adapter: either path or topic may be defined, not both, in D2C message definition telemetry")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Topic: "devices/+/telemetry", DeviceIdBodyQuery: ".id"}}})
+	assert.EqualError(t, err, "transform-adapter: topic must not start with a slash or contain wildcards (use {param} segments instead) in D2C message definition devices/+/telemetry")
+
+	err = validate(&ConfigRaw{ReportedProperties: []D2CMessageRaw{{Topic: "devices/{id}/properties", DeviceIdPathParam: "id", AuthHeader: "key"}}})
+	assert.EqualError(t, err, "transform-adapter: authHeader and authQueryParam may not be defined in MQTT reported properties definition devices/{id}/properties, the MQTT password is used as API key")
+
+	assert.NoError(t, validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Topic: "devices/{id}/telemetry", DeviceIdPathParam: "id"}}}))
+}
+
+func TestValidateSignature(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/webhook", DeviceIdBodyQuery: ".id", Signature: &SignatureOptionsRaw{Header: "X-Signature"}}}})
+	assert.EqualError(t, err, "transform-adapter: either signature secret or secretFile must be defined in D2C message definition /webhook")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/webhook", DeviceIdBodyQuery: ".id", Signature: &SignatureOptionsRaw{Header: "X-Signature", Secret: "s", Algorithm: "md5"}}}})
+	assert.EqualError(t, err, "transform-adapter: signature algorithm must be one of sha1, sha256, or sha512 in D2C message definition /webhook")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/webhook", DeviceIdBodyQuery: ".id", Signature: &SignatureOptionsRaw{Header: "X-Signature", Secret: "s", SignedContent: "{timestamp}.{body}"}}}})
+	assert.EqualError(t, err, "transform-adapter: signature signedContent may only contain the {timestamp} placeholder if timestampHeader is defined in D2C message definition /webhook")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Topic: "webhook", DeviceIdBodyQuery: ".id", Signature: &SignatureOptionsRaw{Header: "X-Signature", Secret: "s"}}}})
+	assert.EqualError(t, err, "transform-adapter: signature and jwt may not be defined in MQTT D2C message definition webhook")
+
+	assert.NoError(t, validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/webhook", DeviceIdBodyQuery: ".id", Signature: &SignatureOptionsRaw{Header: "X-Signature", Secret: "s", ReplayWindow: "1m"}}}}))
+}
+
+func TestValidateJwt(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/telemetry", DeviceIdBodyQuery: "$claims.sub", Jwt: &JwtOptionsRaw{Issuer: "https://idp", Audience: "adapter"}}}})
+	assert.EqualError(t, err, "transform-adapter: either jwt jwksFile or jwksUrl must be defined in D2C message definition /telemetry")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/telemetry", DeviceIdBodyQuery: "$claims.sub", Jwt: &JwtOptionsRaw{JwksUrl: "/keys", Issuer: "https://idp", Audience: "adapter"}}}})
+	assert.EqualError(t, err, "transform-adapter: jwt jwksUrl must be an absolute HTTP(S) URL in D2C message definition /telemetry")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/telemetry", DeviceIdBodyQuery: "$claims.sub", Jwt: &JwtOptionsRaw{JwksFile: "jwks.json", Issuer: "https://idp"}}}})
+	assert.EqualError(t, err, "transform-adapter: jwt issuer and audience must be defined in D2C message definition /telemetry")
+
+	assert.NoError(t, validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/telemetry", DeviceIdBodyQuery: "$claims.sub", Jwt: &JwtOptionsRaw{JwksUrl: "https://idp/keys", Issuer: "https://idp", Audience: "adapter", Leeway: "30s"}}}}))
+}
+
+func TestValidateRateLimit(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", DeviceRateLimit: &RateLimitRaw{Burst: 10}}}})
+	assert.EqualError(t, err, "transform-adapter: rate limits must have a positive rate and may not have a negative burst or maxDevices in D2C message definition /message")
+
+	messages, err := processD2CMessages("", []D2CMessageRaw{{Path: "/message", RouteRateLimit: &RateLimitRaw{Rate: 2.5}}})
+	assert.NoError(t, err)
+	assert.Equal(t, &RateLimit{Rate: 2.5, Burst: 3, MaxDevices: defaultRateLimitMaxDevices}, messages[0].RouteRateLimit)
+	assert.Nil(t, messages[0].DeviceRateLimit)
+}
+
+func TestValidateDedup(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", DedupWindow: "1h"}}})
+	assert.EqualError(t, err, "transform-adapter: dedupWindow requires dedupKeyQuery in D2C message definition /message")
+
+	err = validate(&ConfigRaw{ReportedProperties: []D2CMessageRaw{{Path: "/properties", DeviceIdBodyQuery: ".id", AuthHeader: "key", DedupKeyQuery: ".seq"}}})
+	assert.EqualError(t, err, "transform-adapter: dedupKeyQuery may only be defined in D2C message definitions, found in reported properties definition /properties")
+
+	messages, _ := processD2CMessages("", []D2CMessageRaw{{Path: "/a", DedupKeyQuery: ".seq"}, {Path: "/b", DedupKeyQuery: ".seq", DedupWindow: "1h"}})
+	assert.Equal(t, defaultDedupWindow, messages[0].DedupWindow)
+	assert.Equal(t, time.Hour, messages[1].DedupWindow)
+}
+
+func TestValidateMode(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", Mode: "later"}}})
+	assert.EqualError(t, err, "transform-adapter: mode must be either sync or async in D2C message definition /message")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", Mode: "async", StoreAndForward: true}}})
+	assert.EqualError(t, err, "transform-adapter: async mode may not be combined with fanOut or storeAndForward, in D2C message definition /message")
+
+	err = validate(&ConfigRaw{ReportedProperties: []D2CMessageRaw{{Path: "/properties", DeviceIdBodyQuery: ".id", AuthHeader: "key", Mode: "async"}}})
+	assert.EqualError(t, err, "transform-adapter: async mode may only be used in D2C message definitions, found in reported properties definition /properties")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", Mode: "sync"}}})
+	assert.NoError(t, err)
+}
+
+func TestValidateBatch(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/batch", DeviceIdBodyQuery: ".id", AuthHeader: "key", Batch: true, FanOut: true}}})
+	assert.EqualError(t, err, "transform-adapter: batch may not be combined with fanOut, storeAndForward, or async mode, in D2C message definition /batch")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/batch", DeviceIdBodyQuery: ".id", AuthHeader: "key", Batch: true, InputFormat: "csv"}}})
+	assert.EqualError(t, err, "transform-adapter: inputFormat must be json in batch D2C message definition /batch")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/batch", DeviceIdBodyQuery: ".id", Batch: true, Signature: &SignatureOptionsRaw{Header: "X-Signature", Secret: "secret"}}}})
+	assert.EqualError(t, err, "transform-adapter: signature may not be defined in batch D2C message definition /batch, since batch bodies are streamed")
+
+	err = validate(&ConfigRaw{ReportedProperties: []D2CMessageRaw{{Path: "/properties", DeviceIdBodyQuery: ".id", AuthHeader: "key", Batch: true}}})
+	assert.EqualError(t, err, "transform-adapter: batch may only be defined in D2C message definitions, found in reported properties definition /properties")
+}
+
+func TestValidateAutoRegister(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", AutoRegister: &AutoRegisterRaw{}}}})
+	assert.EqualError(t, err, "transform-adapter: either autoRegister modelId or modelIdQuery must be defined in D2C message definition /message")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", AutoRegister: &AutoRegisterRaw{ModelId: "dtmi:a;1", ModelIdQuery: ".model"}}}})
+	assert.EqualError(t, err, "transform-adapter: either autoRegister modelId or modelIdQuery must be defined in D2C message definition /message")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", AutoRegister: &AutoRegisterRaw{ModelId: "dtmi:a;1"}, StoreAndForward: true}}})
+	assert.EqualError(t, err, "transform-adapter: autoRegister and storeAndForward may not be combined, in D2C message definition /message")
+
+	err = validate(&ConfigRaw{ReportedProperties: []D2CMessageRaw{{Path: "/properties", DeviceIdBodyQuery: ".id", AuthHeader: "key", AutoRegister: &AutoRegisterRaw{ModelId: "dtmi:a;1"}}}})
+	assert.EqualError(t, err, "transform-adapter: autoRegister may only be defined in D2C message definitions, found in reported properties definition /properties")
+}
+
+func TestValidateTransformLanguage(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", TransformLanguage: "xslt"}}})
+	assert.EqualError(t, err, "transform-adapter: transformLanguage must be one of jq, cel, or gotemplate in D2C message definition /message")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", TransformLanguage: "cel", FanOut: true}}})
+	assert.EqualError(t, err, "transform-adapter: fanOut requires a jq transform in D2C message definition /message")
+
+	err = validate(&ConfigRaw{Methods: []C2DRouteRaw{{Path: "/{id}/methods", DeviceIdPathParam: "id", AuthHeader: "key", CallbackUrl: "http://adapter/callback", TargetUrl: "http://target", TransformLanguage: "jsonata"}}})
+	assert.EqualError(t, err, "transform-adapter: transformLanguage must be one of jq, cel, or gotemplate in method definition /{id}/methods")
+}
+
+func TestValidateWasm(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", TransformWasm: "decoder.wasm", Transform: "."}}})
+	assert.EqualError(t, err, "transform-adapter: transformWasm may not be combined with transform, transformFile, or transformLanguage in D2C message definition /message")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", TransformWasm: "decoder.wasm", InputFormat: "cbor"}}})
+	assert.EqualError(t, err, "transform-adapter: transformWasm may not be combined with inputFormat, fanOut, or batch in D2C message definition /message")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", TransformWasm: "decoder.wasm", WasmMaxMemoryMb: 8192}}})
+	assert.EqualError(t, err, "transform-adapter: wasmMaxMemoryMb must be between 0 and 4096 in D2C message definition /message")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", TransformWasm: "decoder.wasm", WasmTimeout: "-1s"}}})
+	assert.EqualError(t, err, "transform-adapter: wasmTimeout must be a positive duration in D2C message definition /message")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", DeviceIdBodyQuery: ".id", AuthHeader: "key", WasmTimeout: "1s"}}})
+	assert.EqualError(t, err, "transform-adapter: wasmMaxMemoryMb and wasmTimeout require transformWasm in D2C message definition /message")
+}
+
+func TestValidateInputFormat(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/upload", DeviceIdBodyQuery: ".id", AuthHeader: "key", InputFormat: "yaml"}}})
+	assert.EqualError(t, err, "transform-adapter: inputFormat must be one of json, auto, csv, xml, form, or cbor in D2C message definition /upload")
+
+	err = validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/upload", DeviceIdBodyQuery: ".id", AuthHeader: "key", InputFormat: "csv", CsvDelimiter: ";;"}}})
+	assert.EqualError(t, err, "transform-adapter: csvDelimiter must be a single character, other than quotes or line breaks, in D2C message definition /upload")
+}
+
+func TestProcessCsvHeaderRow(t *testing.T) {
+	noHeader := false
+	messages, err := processD2CMessages("", []D2CMessageRaw{{Path: "/a", InputFormat: "csv"}, {Path: "/b", InputFormat: "csv", CsvHeaderRow: &noHeader}})
+	assert.NoError(t, err)
+	assert.False(t, messages[0].Input.CsvNoHeaderRow)
+	assert.True(t, messages[1].Input.CsvNoHeaderRow)
+}
@@ -0,0 +1,344 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	dedupFileName          = "dedup.db"
+	defaultDedupMaxKeys    = 100000
+	defaultDedupWindow     = 10 * time.Minute
+	dedupKeysBucket        = "keys"
+	dedupExpirationsBucket = "expirations"
+)
+
+// DedupStore keeps the idempotency keys of the messages forwarded to the Bridge, each until the end of its deduplication window.
+// Stores are bounded in size: once full, the keys closest to expiring are evicted first. While a message is being forwarded, its
+// key is reserved in memory, so concurrent duplicates aren't forwarded as well.
+type DedupStore interface {
+	// Seen returns whether a key was recorded and hasn't expired yet.
+	Seen(key string, now time.Time) (bool, error)
+	// Reserve reserves a key that isn't reserved, nor recorded and unexpired, returning whether it was reserved.
+	Reserve(key string, now time.Time) (bool, error)
+	// Release drops the reservation of a key whose message wasn't forwarded.
+	Release(key string)
+	// Record stores a key until the given expiration time, replacing its reservation.
+	Record(key string, expiresAt time.Time) error
+}
+
+// MemoryDedupStore is an in-memory DedupStore. Keys are lost when the adapter restarts.
+type MemoryDedupStore struct {
+	maxKeys int
+
+	mutex       sync.Mutex
+	keys        map[string]*list.Element
+	expirations *list.List      // Keys, ordered by expiration time
+	reserved    map[string]bool // Keys of the messages being forwarded
+}
+
+type dedupEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// NewMemoryDedupStore creates an in-memory store holding up to maxKeys keys. A zero max uses the default value.
+func NewMemoryDedupStore(maxKeys int) *MemoryDedupStore {
+	if maxKeys == 0 {
+		maxKeys = defaultDedupMaxKeys
+	}
+
+	return &MemoryDedupStore{maxKeys: maxKeys, keys: make(map[string]*list.Element), expirations: list.New(), reserved: make(map[string]bool)}
+}
+
+func (store *MemoryDedupStore) Seen(key string, now time.Time) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.seen(key, now), nil
+}
+
+// seen returns whether a key was recorded and hasn't expired yet. Must be called with the mutex held.
+func (store *MemoryDedupStore) seen(key string, now time.Time) bool {
+	element, ok := store.keys[key]
+	return ok && now.Before(element.Value.(*dedupEntry).expiresAt)
+}
+
+func (store *MemoryDedupStore) Reserve(key string, now time.Time) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.reserved[key] || store.seen(key, now) {
+		return false, nil
+	}
+
+	store.reserved[key] = true
+	return true, nil
+}
+
+func (store *MemoryDedupStore) Release(key string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.reserved, key)
+}
+
+func (store *MemoryDedupStore) Record(key string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.reserved, key)
+
+	if element, ok := store.keys[key]; ok {
+		store.expirations.Remove(element)
+		delete(store.keys, key)
+	}
+
+	// Routes may have different windows, so the new key isn't necessarily the last one to expire.
+	mark := store.expirations.Back()
+	for mark != nil && mark.Value.(*dedupEntry).expiresAt.After(expiresAt) {
+		mark = mark.Prev()
+	}
+
+	entry := &dedupEntry{key: key, expiresAt: expiresAt}
+	if mark == nil {
+		store.keys[key] = store.expirations.PushFront(entry)
+	} else {
+		store.keys[key] = store.expirations.InsertAfter(entry, mark)
+	}
+
+	for store.expirations.Len() > store.maxKeys {
+		delete(store.keys, store.expirations.Remove(store.expirations.Front()).(*dedupEntry).key)
+	}
+
+	return nil
+}
+
+// BoltDedupStore is a DedupStore persisted on disk, so deduplication keeps working across restarts. Besides the keys, it keeps an
+// index of keys by expiration time, used to purge expired keys and to evict the keys closest to expiring once the store is full.
+type BoltDedupStore struct {
+	db      *bolt.DB
+	maxKeys int
+
+	mutex    sync.Mutex
+	size     int
+	reserved map[string]bool // Keys of the messages being forwarded, which aren't persisted
+}
+
+// NewBoltDedupStore opens (or creates) the store in the given directory, holding up to maxKeys keys. A zero max uses the default value.
+func NewBoltDedupStore(dir string, maxKeys int) (*BoltDedupStore, error) {
+	if maxKeys == 0 {
+		maxKeys = defaultDedupMaxKeys
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, dedupFileName), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("transform-adapter: failed to open deduplication store: %w", err)
+	}
+
+	store := &BoltDedupStore{db: db, maxKeys: maxKeys, reserved: make(map[string]bool)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		keys, err := tx.CreateBucketIfNotExists([]byte(dedupKeysBucket))
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists([]byte(dedupExpirationsBucket)); err != nil {
+			return err
+		}
+
+		store.size = keys.Stats().KeyN
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("transform-adapter: failed to initialize deduplication store: %w", err)
+	}
+
+	log.Infof("Deduplication store opened with %d keys", store.size)
+	return store, nil
+}
+
+// Close closes the underlying storage.
+func (store *BoltDedupStore) Close() error {
+	return store.db.Close()
+}
+
+func (store *BoltDedupStore) Seen(key string, now time.Time) (bool, error) {
+	seen := false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket([]byte(dedupKeysBucket)).Get([]byte(key)); value != nil {
+			seen = now.Before(time.Unix(0, int64(binary.BigEndian.Uint64(value))))
+		}
+
+		return nil
+	})
+
+	return seen, err
+}
+
+// Reserve checks the persisted keys with the mutex held, so that a concurrent Record can't replace the reservation in between.
+func (store *BoltDedupStore) Reserve(key string, now time.Time) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.reserved[key] {
+		return false, nil
+	}
+
+	seen, err := store.Seen(key, now)
+	if err != nil || seen {
+		return false, err
+	}
+
+	store.reserved[key] = true
+	return true, nil
+}
+
+func (store *BoltDedupStore) Release(key string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.reserved, key)
+}
+
+func (store *BoltDedupStore) Record(key string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.reserved, key)
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket([]byte(dedupKeysBucket))
+		expirations := tx.Bucket([]byte(dedupExpirationsBucket))
+
+		if previous := keys.Get([]byte(key)); previous != nil {
+			if err := expirations.Delete(dedupExpirationKey(previous, key)); err != nil {
+				return err
+			}
+
+			store.size--
+		}
+
+		expiration := make([]byte, 8)
+		binary.BigEndian.PutUint64(expiration, uint64(expiresAt.UnixNano()))
+		if err := keys.Put([]byte(key), expiration); err != nil {
+			return err
+		}
+
+		if err := expirations.Put(dedupExpirationKey(expiration, key), []byte(key)); err != nil {
+			return err
+		}
+
+		store.size++
+
+		// Purge expired keys, then evict the keys closest to expiring while the store is full.
+		now := uint64(time.Now().UnixNano())
+		cursor := expirations.Cursor()
+		for indexKey, evictedKey := cursor.First(); indexKey != nil; indexKey, evictedKey = cursor.First() {
+			if store.size <= store.maxKeys && binary.BigEndian.Uint64(indexKey) > now {
+				break
+			}
+
+			if err := keys.Delete(evictedKey); err != nil {
+				return err
+			}
+
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+
+			store.size--
+		}
+
+		return nil
+	})
+}
+
+// dedupExpirationKey builds the key of the expiration index, which sorts by expiration time and then by key.
+func dedupExpirationKey(expiration []byte, key string) []byte {
+	return append(append([]byte{}, expiration...), key...)
+}
+
+// dedupKey returns the key under which a message is stored in the deduplication store: its idempotency key, scoped to the
+// route and device. Returns an empty key if the message has no idempotency key, in which case it's never deduplicated.
+func (adapter *Adapter) dedupKey(r *http.Request, message AugmentedD2CMessage, deviceId string, input interface{}) (string, error) {
+	if message.DedupKeyQueryId == "" {
+		return "", nil
+	}
+
+	result, err := adapter.Engine.ExecuteWithVariables(message.DedupKeyQueryId, input, requestVariables(r))
+	if err != nil {
+		return "", fmt.Errorf("dedup key query failed: %w", err)
+	}
+
+	var idempotencyKey string
+	switch value := result.(type) {
+	case nil:
+		return "", nil
+	case string:
+		idempotencyKey = value
+	default:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", errors.New("expected result from dedup key query to be JSON")
+		}
+
+		idempotencyKey = string(encoded)
+	}
+
+	if idempotencyKey == "" {
+		return "", nil
+	}
+
+	encoded, _ := json.Marshal([]string{message.Path, deviceId, idempotencyKey})
+	return string(encoded), nil
+}
+
+// reserveDedupKey returns whether a message with the given key was already forwarded within the deduplication window, or is
+// being forwarded by another request. Otherwise, the key is reserved until the message is recorded as forwarded or released.
+// Failures of the store are logged and the message is treated as new, since forwarding a duplicate is better than dropping a message.
+func (adapter *Adapter) reserveDedupKey(logger *log.Entry, key string) (duplicate bool) {
+	if key == "" {
+		return false
+	}
+
+	reserved, err := adapter.Services.Dedup.Reserve(key, time.Now())
+	if err != nil {
+		logger.WithField("error", err).Warnf("Failed to check deduplication store: %s", err)
+		return false
+	}
+
+	return !reserved
+}
+
+// releaseDedupKey releases the key of a message that wasn't forwarded, so that it can be retried.
+func (adapter *Adapter) releaseDedupKey(key string) {
+	if key != "" {
+		adapter.Services.Dedup.Release(key)
+	}
+}
+
+// recordForwarded records the key of a message that was forwarded, so duplicates within the window of its route are dropped.
+func (adapter *Adapter) recordForwarded(logger *log.Entry, message AugmentedD2CMessage, key string) {
+	if key == "" {
+		return
+	}
+
+	if err := adapter.Services.Dedup.Record(key, time.Now().Add(message.DedupWindow)); err != nil {
+		logger.WithField("error", err).Warnf("Failed to record message in deduplication store: %s", err)
+	}
+}
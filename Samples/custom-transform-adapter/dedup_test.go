@@ -0,0 +1,204 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDedupStore runs the behavior shared by all deduplication stores over a store holding up to 2 keys.
+func testDedupStore(t *testing.T, store DedupStore) {
+	now := time.Now()
+
+	seen, err := store.Seen("a", now)
+	require.NoError(t, err)
+	assert.False(t, seen)
+
+	require.NoError(t, store.Record("a", now.Add(time.Minute)))
+	seen, _ = store.Seen("a", now)
+	assert.True(t, seen)
+	seen, _ = store.Seen("a", now.Add(2*time.Minute))
+	assert.False(t, seen)
+
+	// Once full, the key closest to expiring is evicted.
+	require.NoError(t, store.Record("b", now.Add(time.Hour)))
+	require.NoError(t, store.Record("c", now.Add(2*time.Hour)))
+	seen, _ = store.Seen("a", now)
+	assert.False(t, seen)
+	seen, _ = store.Seen("b", now)
+	assert.True(t, seen)
+
+	// Recording a key again extends its expiration.
+	require.NoError(t, store.Record("b", now.Add(3*time.Hour)))
+	require.NoError(t, store.Record("d", now.Add(4*time.Hour)))
+	seen, _ = store.Seen("b", now)
+	assert.True(t, seen)
+	seen, _ = store.Seen("c", now)
+	assert.False(t, seen)
+
+	// Keys can only be reserved once, until they are released or recorded.
+	reserved, err := store.Reserve("e", now)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+	reserved, _ = store.Reserve("e", now)
+	assert.False(t, reserved)
+	store.Release("e")
+	reserved, _ = store.Reserve("e", now)
+	assert.True(t, reserved)
+	require.NoError(t, store.Record("e", now.Add(5*time.Hour)))
+	reserved, _ = store.Reserve("e", now)
+	assert.False(t, reserved)
+	reserved, _ = store.Reserve("d", now)
+	assert.False(t, reserved)
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+	testDedupStore(t, NewMemoryDedupStore(2))
+}
+
+func TestBoltDedupStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewBoltDedupStore(dir, 2)
+	require.NoError(t, err)
+	testDedupStore(t, store)
+	require.NoError(t, store.Close())
+
+	// Keys survive restarts.
+	store, err = NewBoltDedupStore(dir, 2)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, 2, store.size)
+	seen, _ := store.Seen("e", time.Now())
+	assert.True(t, seen)
+}
+
+func sendDedupTestMessage(adapter *Adapter, body string, messageId string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/message", bytes.NewBufferString(body))
+	req.Header.Add("key", "test_key")
+	req.Header.Add("X-Message-Id", messageId)
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestDedup(t *testing.T) {
+	metrics := NewMetrics()
+	recorder := &BridgeClientRecorder{FailingDevices: map[string]int{"failing-device": 503}}
+	adapter, err := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{{
+		Path:              "/message",
+		DeviceIdBodyQuery: ".device",
+		AuthHeader:        "key",
+		Transform:         "{ data: { t } }",
+		DedupKeyQuery:     `$headers["x-message-id"]`,
+		DedupWindow:       time.Minute,
+	}}}, "localhost:1000", &Services{Dedup: NewMemoryDedupStore(0), Metrics: metrics})
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+
+	assert.Equal(t, 200, sendDedupTestMessage(adapter, `{"device": "device-1", "t": 1}`, "m1").Code)
+	assert.Equal(t, 200, sendDedupTestMessage(adapter, `{"device": "device-1", "t": 1}`, "m1").Code)
+	assert.Len(t, recorder.Messages["device-1"], 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.duplicates.WithLabelValues("/message")))
+
+	// Keys are scoped to the device, and messages without a key are never deduplicated.
+	assert.Equal(t, 200, sendDedupTestMessage(adapter, `{"device": "device-2", "t": 1}`, "m1").Code)
+	assert.Equal(t, 200, sendDedupTestMessage(adapter, `{"device": "device-1", "t": 2}`, "m2").Code)
+	assert.Equal(t, 200, sendDedupTestMessage(adapter, `{"device": "device-1", "t": 3}`, "").Code)
+	assert.Equal(t, 200, sendDedupTestMessage(adapter, `{"device": "device-1", "t": 3}`, "").Code)
+	assert.Len(t, recorder.Messages["device-1"], 4)
+	assert.Len(t, recorder.Messages["device-2"], 1)
+
+	// Only messages forwarded successfully are recorded, so retries of failed messages go through.
+	assert.Equal(t, 503, sendDedupTestMessage(adapter, `{"device": "failing-device", "t": 1}`, "m3").Code)
+	assert.Equal(t, 503, sendDedupTestMessage(adapter, `{"device": "failing-device", "t": 1}`, "m3").Code)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.duplicates.WithLabelValues("/message")))
+}
+
+// blockingBridgeClient records the messages sent to the Bridge once released, so concurrent requests can be interleaved.
+type blockingBridgeClient struct {
+	*BridgeClientRecorder
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (client *blockingBridgeClient) SendMessage(ctx context.Context, deviceID string, body *bridge.MessageBody) (autorest.Response, error) {
+	client.sending <- struct{}{}
+	<-client.release
+	return client.BridgeClientRecorder.SendMessage(ctx, deviceID, body)
+}
+
+func TestDedupConcurrentDuplicates(t *testing.T) {
+	metrics := NewMetrics()
+	client := &blockingBridgeClient{BridgeClientRecorder: &BridgeClientRecorder{}, sending: make(chan struct{}, 2), release: make(chan struct{})}
+	adapter, err := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{{
+		Path:              "/message",
+		DeviceIdBodyQuery: ".device",
+		AuthHeader:        "key",
+		Transform:         "{ data: { t } }",
+		DedupKeyQuery:     `$headers["x-message-id"]`,
+		DedupWindow:       time.Minute,
+	}}}, "localhost:1000", &Services{Dedup: NewMemoryDedupStore(0), Metrics: metrics})
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+
+	first := make(chan int)
+	go func() {
+		first <- sendDedupTestMessage(adapter, `{"device": "device-1", "t": 1}`, "m1").Code
+	}()
+
+	// The duplicate arrives while the first message is being sent.
+	<-client.sending
+	assert.Equal(t, 200, sendDedupTestMessage(adapter, `{"device": "device-1", "t": 1}`, "m1").Code)
+	close(client.release)
+	assert.Equal(t, 200, <-first)
+
+	assert.Len(t, client.Sent("device-1"), 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.duplicates.WithLabelValues("/message")))
+}
+
+func TestDedupStoreRequired(t *testing.T) {
+	_, err := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/message", DeviceIdBodyQuery: ".device", AuthHeader: "key", DedupKeyQuery: ".id", DedupWindow: time.Minute},
+	}}, "localhost:1000")
+
+	assert.EqualError(t, err, "transform-adapter: route /message uses deduplication, but no deduplication store is configured")
+}
+
+func TestDedupFanOut(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter, _ := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{{
+		Path:              "/batch",
+		DeviceIdBodyQuery: ".device",
+		AuthHeader:        "key",
+		Transform:         ".readings[] | { device, seq, data: { t } }",
+		FanOut:            true,
+		DedupKeyQuery:     ".seq",
+		DedupWindow:       time.Minute,
+	}}}, "localhost:1000", &Services{Dedup: NewMemoryDedupStore(0)})
+
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+	sendTestMessage(adapter.Router, "/batch", `{"readings": [{"device": "d1", "seq": 1, "t": 1}]}`)
+	response := sendTestMessage(adapter.Router, "/batch", `{"readings": [{"device": "d1", "seq": 1, "t": 1}, {"device": "d1", "seq": 2, "t": 2}]}`)
+	assert.Equal(t, 200, response.Code)
+
+	var body FanOutResponseBody
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equal(t, 2, body.Succeeded)
+	assert.True(t, body.Results[0].Duplicate)
+	assert.False(t, body.Results[1].Duplicate)
+	assert.Len(t, recorder.Messages["d1"], 2)
+}
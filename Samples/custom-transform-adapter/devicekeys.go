@@ -0,0 +1,156 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const deviceKeyHashPrefix = "sha256:"
+
+// ErrInvalidDeviceCredentials is returned when a device fails to authenticate with the adapter. It doesn't tell apart unknown
+// devices from wrong, expired, or revoked keys.
+var ErrInvalidDeviceCredentials = errors.New("invalid device credentials")
+
+// ErrDeviceNotAllowed is returned when a bearer token restricted to a device is used to send data for another device.
+var ErrDeviceNotAllowed = errors.New("bearer token is not valid for this device")
+
+// DeviceKey is a credential of a device. Only the hash of the key is stored.
+type DeviceKey struct {
+	KeyHash   string     `json:"keyHash"`   // "sha256:" followed by the hex-encoded SHA-256 hash of the key
+	ExpiresAt *time.Time `json:"expiresAt"` // Optional expiration time, to phase out the previous key of a device during rotation
+	Revoked   bool       `json:"revoked"`   // Whether the key was revoked
+}
+
+// DeviceKeyTable holds the keys that devices use to authenticate with the adapter when it manages the Bridge API key.
+// A device may have multiple valid keys at the same time, so its key can be rotated without downtime.
+type DeviceKeyTable struct {
+	Devices map[string][]DeviceKey `json:"devices"`
+}
+
+// HashDeviceKey returns the hash of a device key, as stored in the device key table. Device keys are expected to be random
+// high-entropy secrets, so a fast unsalted hash is enough and keeps per-message verification cheap.
+func HashDeviceKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return deviceKeyHashPrefix + hex.EncodeToString(hash[:])
+}
+
+// LoadDeviceKeyTable loads and validates a device key table from a file.
+func LoadDeviceKeyTable(path string) (*DeviceKeyTable, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("transform-adapter: failed to read device keys file: %w", err)
+	}
+
+	var table DeviceKeyTable
+	if err := json.Unmarshal(content, &table); err != nil {
+		return nil, fmt.Errorf("transform-adapter: failed to parse device keys file: %w", err)
+	}
+
+	for deviceId, keys := range table.Devices {
+		for i, key := range keys {
+			if _, err := decodeDeviceKeyHash(key.KeyHash); err != nil {
+				return nil, fmt.Errorf("transform-adapter: invalid hash of key %d of device %s: %w", i, deviceId, err)
+			}
+		}
+	}
+
+	return &table, nil
+}
+
+// Verify checks whether a key is a valid credential of a device at the given time, that is, whether it matches any of
+// the keys of the device that are neither revoked nor expired.
+func (table *DeviceKeyTable) Verify(deviceId string, key string, now time.Time) bool {
+	if key == "" {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	valid := false
+	for _, deviceKey := range table.Devices[deviceId] {
+		if deviceKey.Revoked || (deviceKey.ExpiresAt != nil && !now.Before(*deviceKey.ExpiresAt)) {
+			continue
+		}
+
+		expected, err := decodeDeviceKeyHash(deviceKey.KeyHash)
+		if err == nil && subtle.ConstantTimeCompare(expected, hash[:]) == 1 {
+			valid = true
+		}
+	}
+
+	return valid
+}
+
+func decodeDeviceKeyHash(keyHash string) ([]byte, error) {
+	if !strings.HasPrefix(keyHash, deviceKeyHashPrefix) {
+		return nil, fmt.Errorf("expected hash to start with %q", deviceKeyHashPrefix)
+	}
+
+	hash, err := hex.DecodeString(strings.TrimPrefix(keyHash, deviceKeyHashPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("expected a %d-byte hash", sha256.Size)
+	}
+
+	return hash, nil
+}
+
+// authorizeDevice returns the API key used to call the Bridge on behalf of a device, given the key provided in the request.
+// By default, the provided key is passed through to the Bridge. If the adapter manages the Bridge API key, the provided key
+// must instead be a valid credential of the device in the device key table, and the adapter key is used. Requests without
+// a key that were authenticated by their signature or bearer token are trusted as a whole, and also use the adapter key.
+// Bearer tokens are only valid for the device in their device Id claim (see JwtOptions).
+func (adapter *Adapter) authorizeDevice(r *http.Request, deviceId string, providedKey string) (string, error) {
+	if tokenDeviceId := jwtDeviceId(r); tokenDeviceId != "" && tokenDeviceId != deviceId {
+		return "", ErrDeviceNotAllowed
+	}
+
+	if adapter.Services.BridgeApiKey == "" {
+		return providedKey, nil
+	}
+
+	if providedKey == "" && authenticatedByRoute(r) {
+		return adapter.Services.BridgeApiKey, nil
+	}
+
+	if !adapter.DeviceKeys.Verify(deviceId, providedKey, time.Now()) {
+		return "", ErrInvalidDeviceCredentials
+	}
+
+	return adapter.Services.BridgeApiKey, nil
+}
+
+// authenticatedByRoute returns whether a request was authenticated by the signature or bearer token checks of its route.
+func authenticatedByRoute(r *http.Request) bool {
+	return signatureVerified(r) || jwtClaims(r) != nil
+}
+
+// requestErrorStatus returns the response status for a failure to resolve the device Id, credentials, or rate limit of a request.
+func requestErrorStatus(err error) int {
+	if errors.Is(err, ErrInvalidDeviceCredentials) {
+		return http.StatusUnauthorized
+	}
+
+	if errors.Is(err, ErrDeviceNotAllowed) {
+		return http.StatusForbidden
+	}
+
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return http.StatusTooManyRequests
+	}
+
+	return http.StatusBadRequest
+}
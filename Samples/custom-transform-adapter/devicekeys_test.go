@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildTestDeviceKeyTable() *DeviceKeyTable {
+	expired := time.Now().Add(-time.Hour)
+	return &DeviceKeyTable{Devices: map[string][]DeviceKey{
+		"device-1": {{KeyHash: HashDeviceKey("old_key"), ExpiresAt: &expired}, {KeyHash: HashDeviceKey("new_key")}},
+		"device-2": {{KeyHash: HashDeviceKey("revoked_key"), Revoked: true}, {KeyHash: HashDeviceKey("device_2_key")}},
+	}}
+}
+
+// sendDeviceTestMessage sends a message authenticated with the given device key.
+func sendDeviceTestMessage(adapter *Adapter, path string, body string, key string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	req.Header.Add("key", key)
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestDeviceKeyTableVerify(t *testing.T) {
+	table := buildTestDeviceKeyTable()
+	now := time.Now()
+
+	assert.True(t, table.Verify("device-1", "new_key", now))
+	assert.False(t, table.Verify("device-1", "old_key", now))
+	assert.True(t, table.Verify("device-1", "old_key", now.Add(-2*time.Hour)))
+	assert.False(t, table.Verify("device-2", "revoked_key", now))
+	assert.False(t, table.Verify("device-2", "new_key", now))
+	assert.False(t, table.Verify("device-3", "new_key", now))
+	assert.False(t, table.Verify("device-1", "", now))
+}
+
+func TestLoadDeviceKeyTable(t *testing.T) {
+	dir := t.TempDir()
+	content, _ := json.Marshal(buildTestDeviceKeyTable())
+	writeTestFile(t, dir, "keys.json", string(content))
+	table, err := LoadDeviceKeyTable(filepath.Join(dir, "keys.json"))
+	require.NoError(t, err)
+	assert.True(t, table.Verify("device-2", "device_2_key", time.Now()))
+
+	writeTestFile(t, dir, "keys.json", `{"devices": {"device-1": [{"keyHash": "new_key"}]}}`)
+	_, err = LoadDeviceKeyTable(filepath.Join(dir, "keys.json"))
+	assert.EqualError(t, err, `transform-adapter: invalid hash of key 0 of device device-1: expected hash to start with "sha256:"`)
+}
+
+func TestManagedApiKeyConfigMismatch(t *testing.T) {
+	routes := []D2CMessage{{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key"}}
+	_, err := NewAdapterWithServices(&Config{D2CMessages: routes}, "localhost:1000", &Services{BridgeApiKey: "bridge_key"})
+	assert.EqualError(t, err, "transform-adapter: the adapter manages the Bridge API key, but no deviceKeysFile is configured")
+
+	_, err = NewAdapter(&Config{D2CMessages: routes, DeviceKeys: buildTestDeviceKeyTable()}, "localhost:1000")
+	assert.EqualError(t, err, "transform-adapter: deviceKeysFile requires the adapter to manage the Bridge API key")
+}
+
+func TestManagedApiKey(t *testing.T) {
+	client := &BridgeClientMock{}
+	adapter, err := NewAdapterWithServices(&Config{
+		D2CMessages: []D2CMessage{{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key"}},
+		DeviceKeys:  buildTestDeviceKeyTable(),
+	}, "localhost:1000", &Services{BridgeApiKey: "bridge_key"})
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+
+	assert.Equal(t, 200, sendDeviceTestMessage(adapter, "/device-1/message", `{"data": {"temperature": 21}}`, "new_key").Code)
+	assert.Equal(t, "device-1", client.LastSendMessageDeviceId)
+	assert.Equal(t, autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"x-api-key": "bridge_key"}), client.LastAuthorizer)
+
+	// Keys are only valid for their own device.
+	client.LastSendMessageDeviceId = ""
+	response := sendDeviceTestMessage(adapter, "/device-2/message", `{"data": {"temperature": 21}}`, "new_key")
+	assert.Equal(t, 401, response.Code)
+	assert.JSONEq(t, `{"error": "invalid device credentials"}`, response.Body.String())
+	assert.Empty(t, client.LastSendMessageDeviceId)
+
+	// The Bridge key itself isn't accepted from devices.
+	assert.Equal(t, 401, sendDeviceTestMessage(adapter, "/device-1/message", `{"data": {}}`, "bridge_key").Code)
+}
+
+func TestManagedApiKeyFanOut(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter, _ := NewAdapterWithServices(&Config{
+		D2CMessages: []D2CMessage{{Path: "/batch", DeviceIdBodyQuery: ".device", AuthHeader: "key", Transform: ".readings[] | { device, data: { t } }", FanOut: true}},
+		DeviceKeys:  buildTestDeviceKeyTable(),
+	}, "localhost:1000", &Services{BridgeApiKey: "bridge_key"})
+
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+	response := sendDeviceTestMessage(adapter, "/batch", `{"readings": [{"device": "device-1", "t": 1}, {"device": "device-2", "t": 2}]}`, "new_key")
+	assert.Equal(t, 207, response.Code)
+
+	var body FanOutResponseBody
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equal(t, 1, body.Succeeded)
+	assert.Equal(t, 401, body.Results[1].Status)
+	assert.Len(t, recorder.Messages["device-1"], 1)
+	assert.Empty(t, recorder.Messages["device-2"])
+}
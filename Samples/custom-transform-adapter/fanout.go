@@ -0,0 +1,179 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFanOutConcurrency = 10
+	maxFanOutMessages        = 1000 // Maximum number of messages a single fan-out request may generate
+)
+
+// FanOutResult is the outcome of sending one of the messages generated by a fan-out request.
+type FanOutResult struct {
+	Index     int    `json:"index"`
+	DeviceId  string `json:"deviceId,omitempty"`
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"` // Whether the message was dropped as a duplicate of an already forwarded one
+}
+
+// FanOutResponseBody is the aggregated response of a fan-out request.
+type FanOutResponseBody struct {
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Results   []FanOutResult `json:"results"`
+}
+
+// buildFanOutHandler builds the HTTP handler for a D2C route definition in fan-out mode, where each result of the
+// transform is sent to the Bridge as a separate message. If a device Id body query is defined, it is executed over each result.
+//
+// Responds with 200 if all messages were sent successfully or 207 (with the status of each message) otherwise.
+func (adapter *Adapter) buildFanOutHandler(message AugmentedD2CMessage) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	concurrency := message.FanOutConcurrency
+	if concurrency == 0 {
+		concurrency = defaultFanOutConcurrency
+	}
+
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		jsonBody, err := decodeRequestBody(w, r, message.Input)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
+			return
+		}
+
+		// Execute body transformation if one was provided. If not, the body is sent as a single message.
+		items := []interface{}{jsonBody}
+		if message.TransformId != "" {
+			_, done := adapter.startTransform(r, message.TransformLanguage)
+			items, err = adapter.Engine.ExecuteAll(message.TransformId, jsonBody, requestVariables(r), maxFanOutMessages)
+			done(err)
+			if err != nil {
+				respondError(logger, w, http.StatusBadRequest, fmt.Errorf("payload transformation failed: %w", err))
+				return
+			}
+		}
+
+		apiKey, err := resolveApiKey(r, message.AuthHeader, message.AuthQueryParam)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
+			return
+		}
+
+		results := make([]FanOutResult, len(items))
+		indexes := make(chan int)
+		var wg sync.WaitGroup
+
+		for worker := 0; worker < concurrency && worker < len(items); worker++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indexes {
+					results[i] = adapter.sendFanOutItem(logger, r, message, apiKey, i, items[i])
+				}
+			}()
+		}
+
+		for i := range items {
+			indexes <- i
+		}
+
+		close(indexes)
+		wg.Wait()
+
+		response := FanOutResponseBody{Results: results}
+		for _, result := range results {
+			if result.Error == "" {
+				response.Succeeded++
+			} else {
+				response.Failed++
+				logger.Errorf("Fan-out message %d for device %s failed with status %d: %s", result.Index, result.DeviceId, result.Status, result.Error)
+			}
+		}
+
+		statusCode := http.StatusOK
+		if response.Failed > 0 {
+			statusCode = http.StatusMultiStatus
+		}
+
+		respondJson(logger, w, statusCode, response)
+	}
+}
+
+// sendFanOutItem resolves the device Id of a single transform result and sends it to the Bridge on behalf of the device.
+func (adapter *Adapter) sendFanOutItem(logger *log.Entry, r *http.Request, message AugmentedD2CMessage, apiKey string, index int, item interface{}) FanOutResult {
+	itemMap, ok := item.(map[string]interface{})
+	if !ok {
+		return FanOutResult{Index: index, Status: http.StatusBadRequest, Error: "expected transform result to be an object"}
+	}
+
+	result := adapter.sendItem(logger, r, message, apiKey, itemMap, itemMap)
+	result.Index = index
+	return result
+}
+
+// sendItem sends one of the messages of a request to the Bridge on behalf of its device. The device Id and dedup key queries
+// are executed over the input of the message, and the payload is the transform result sent as message body.
+func (adapter *Adapter) sendItem(logger *log.Entry, r *http.Request, message AugmentedD2CMessage, apiKey string, input interface{}, payload interface{}) FanOutResult {
+	result := FanOutResult{}
+
+	deviceId, err := adapter.resolveDeviceId(r, message.DeviceIdPathParam, message.DeviceIdBodyQueryId, input)
+	if err != nil {
+		result.Status, result.Error = http.StatusBadRequest, err.Error()
+		return result
+	}
+
+	result.DeviceId = deviceId
+
+	apiKey, err = adapter.authorizeDevice(r, deviceId, apiKey)
+	if err != nil {
+		result.Status, result.Error = requestErrorStatus(err), err.Error()
+		return result
+	}
+
+	if err := adapter.limitDevice(r, message, deviceId); err != nil {
+		result.Status, result.Error = requestErrorStatus(err), err.Error()
+		return result
+	}
+
+	bridgePayload, err := toMessageBody(payload)
+	if err != nil {
+		result.Status, result.Error = http.StatusBadRequest, err.Error()
+		return result
+	}
+
+	dedupKey, err := adapter.dedupKey(r, message, deviceId, input)
+	if err != nil {
+		result.Status, result.Error = http.StatusBadRequest, err.Error()
+		return result
+	}
+
+	if adapter.reserveDedupKey(logger, dedupKey) {
+		adapter.Services.Metrics.duplicate(r)
+		result.Status, result.Duplicate = http.StatusOK, true
+		return result
+	}
+
+	bridgeClient := adapter.newBridgeClient(r, apiKey)
+	if err := adapter.registerDevice(logger, r, message, bridgeClient, deviceId, input); err != nil {
+		adapter.releaseDedupKey(dedupKey)
+		result.Status, result.Error = registrationErrorStatus(err), err.Error()
+		return result
+	}
+
+	if bridgeResponse, err := bridgeClient.SendMessage(r.Context(), deviceId, bridgePayload); err != nil {
+		adapter.releaseDedupKey(dedupKey)
+		result.Status, result.Error = bridgeStatusCode(bridgeResponse), fmt.Errorf("call to Device Bridge failed: %w", err).Error()
+		return result
+	}
+
+	adapter.recordForwarded(logger, message, dedupKey)
+	result.Status = http.StatusOK
+	return result
+}
@@ -0,0 +1,213 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	"github.com/stretchr/testify/assert"
+)
+
+// BridgeClientRecorder is a Bridge client mock safe for concurrent use, which records all messages sent to each device.
+// Messages sent to devices in FailingDevices fail with the associated status code.
+type BridgeClientRecorder struct {
+	BridgeClientMock
+	mutex          sync.Mutex
+	Messages       map[string][]*bridge.MessageBody
+	FailingDevices map[string]int
+}
+
+func (client *BridgeClientRecorder) SendMessage(ctx context.Context, deviceID string, body *bridge.MessageBody) (autorest.Response, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if status, ok := client.FailingDevices[deviceID]; ok {
+		return autorest.Response{Response: &http.Response{StatusCode: status}}, errors.New("send failed")
+	}
+
+	if client.Messages == nil {
+		client.Messages = make(map[string][]*bridge.MessageBody)
+	}
+
+	client.Messages[deviceID] = append(client.Messages[deviceID], body)
+	return autorest.Response{}, nil
+}
+
+// The remaining calls of concurrent requests are recorded by the embedded mock under the same lock.
+func (client *BridgeClientRecorder) SetAuthorizer(authorizer autorest.Authorizer) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.BridgeClientMock.SetAuthorizer(authorizer)
+}
+
+func (client *BridgeClientRecorder) UpdateReportedProperties(ctx context.Context, deviceID string, body *bridge.ReportedPropertiesPatch) (autorest.Response, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.BridgeClientMock.UpdateReportedProperties(ctx, deviceID, body)
+}
+
+func (client *BridgeClientRecorder) Register(ctx context.Context, deviceID string, body *bridge.RegistrationBody) (autorest.Response, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.BridgeClientMock.Register(ctx, deviceID, body)
+}
+
+// Sent returns the messages sent to a device so far. Unlike Messages, it can be read while requests are being served, e.g., by
+// servers whose responses don't synchronize with the test.
+func (client *BridgeClientRecorder) Sent(deviceID string) []*bridge.MessageBody {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return append([]*bridge.MessageBody(nil), client.Messages[deviceID]...)
+}
+
+// Authorizer returns the authorizer of the last Bridge call.
+func (client *BridgeClientRecorder) Authorizer() autorest.Authorizer {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.LastAuthorizer
+}
+
+func sendFanOutRequest(t *testing.T, adapter *Adapter, path string, body string) (int, FanOutResponseBody) {
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	req.Header.Add("key", "test_key")
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+
+	var response FanOutResponseBody
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response
+}
+
+const testFanOutBody = `{
+	"readings": [
+		{ "sensor": "s1", "temperature": 21 },
+		{ "sensor": "s2", "temperature": 22 },
+		{ "sensor": "s1", "temperature": 23 }
+	]
+}`
+
+func TestFanOutDeviceIdFromEachResult(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/batch",
+			DeviceIdBodyQuery: ".device",
+			AuthHeader:        "key",
+			Transform:         ".readings[] | { device: .sensor, data: { temperature } }",
+			FanOut:            true,
+			FanOutConcurrency: 2,
+		},
+	}}, "localhost:1000")
+
+	recorder := &BridgeClientRecorder{}
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+
+	status, response := sendFanOutRequest(t, adapter, "/batch", testFanOutBody)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 3, response.Succeeded)
+	assert.Equal(t, 0, response.Failed)
+	assert.Equal(t, FanOutResult{Index: 1, DeviceId: "s2", Status: 200}, response.Results[1])
+	assert.Len(t, recorder.Messages["s1"], 2)
+	assert.Len(t, recorder.Messages["s2"], 1)
+	assert.Equal(t, float64(22), recorder.Messages["s2"][0].Data["temperature"])
+}
+
+func TestFanOutDeviceIdPathParam(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/{id}/batch",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			Transform:         ".readings[] | { data: { temperature } }",
+			FanOut:            true,
+		},
+	}}, "localhost:1000")
+
+	recorder := &BridgeClientRecorder{}
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+
+	status, response := sendFanOutRequest(t, adapter, "/path_device/batch", testFanOutBody)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 3, response.Succeeded)
+	assert.Len(t, recorder.Messages["path_device"], 3)
+}
+
+func TestFanOutPartialFailure(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/batch",
+			DeviceIdBodyQuery: ".device",
+			AuthHeader:        "key",
+			Transform:         ".readings[] | { device: .sensor, data: { temperature }, creationTimeUtc: .time }",
+			FanOut:            true,
+		},
+	}}, "localhost:1000")
+
+	recorder := &BridgeClientRecorder{FailingDevices: map[string]int{"s2": 429}}
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+
+	status, response := sendFanOutRequest(t, adapter, "/batch", `{
+		"readings": [
+			{ "sensor": "s1", "temperature": 21 },
+			{ "sensor": "s2", "temperature": 22 },
+			{ "sensor": "s3", "temperature": 23, "time": "abc" },
+			{ "temperature": 24 }
+		]
+	}`)
+	assert.Equal(t, 207, status)
+	assert.Equal(t, 1, response.Succeeded)
+	assert.Equal(t, 3, response.Failed)
+	assert.Equal(t, FanOutResult{Index: 0, DeviceId: "s1", Status: 200}, response.Results[0])
+	assert.Equal(t, FanOutResult{Index: 1, DeviceId: "s2", Status: 429, Error: "call to Device Bridge failed: send failed"}, response.Results[1])
+	assert.Equal(t, 400, response.Results[2].Status)
+	assert.Contains(t, response.Results[2].Error, "failed to parse \"creationTimeUtc\"")
+	assert.Equal(t, FanOutResult{Index: 3, Status: 400, Error: "expected result from device Id body query to be string"}, response.Results[3])
+}
+
+func TestFanOutEmptyResult(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/batch",
+			DeviceIdBodyQuery: ".device",
+			AuthHeader:        "key",
+			Transform:         ".readings[]",
+			FanOut:            true,
+		},
+	}}, "localhost:1000")
+
+	recorder := &BridgeClientRecorder{}
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+
+	status, response := sendFanOutRequest(t, adapter, "/batch", `{ "readings": [] }`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 0, response.Succeeded)
+	assert.Empty(t, response.Results)
+}
+
+func TestFanOutBadTransform(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/batch",
+			DeviceIdBodyQuery: ".device",
+			AuthHeader:        "key",
+			Transform:         ".readings[] | {(.temperature): 1}",
+			FanOut:            true,
+		},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	req, _ := http.NewRequest("POST", "/batch", bytes.NewBufferString(testFanOutBody))
+	req.Header.Add("key", "test_key")
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 400, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "payload transformation failed")
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// goTemplateLanguage compiles Go templates rendering JSON. The input is the template data (.), and the engine variables are
+// functions named after the variables without the leading $ (e.g., {{ (headers).host }}). The toJson function renders any
+// value as JSON, so strings are quoted and escaped.
+type goTemplateLanguage struct{}
+
+func (goTemplateLanguage) Compile(query string, variables []string) (CompiledTransform, error) {
+	// Variable functions are declared for parsing, and bound to their values on each execution.
+	funcs := template.FuncMap{"toJson": templateToJson}
+	for _, name := range variables {
+		funcs[strings.TrimPrefix(name, "$")] = func() interface{} { return nil }
+	}
+
+	compiled, err := template.New("transform").Funcs(funcs).Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &goTemplateTransform{compiled, variables}, nil
+}
+
+type goTemplateTransform struct {
+	template  *template.Template
+	variables []string
+}
+
+func (transform *goTemplateTransform) Run(input interface{}, variables map[string]interface{}) TransformIter {
+	compiled, err := transform.template.Clone()
+	if err != nil {
+		return &singleResult{value: err}
+	}
+
+	funcs := template.FuncMap{}
+	for _, name := range transform.variables {
+		value := variables[name]
+		funcs[strings.TrimPrefix(name, "$")] = func() interface{} { return value }
+	}
+
+	var output bytes.Buffer
+	if err := compiled.Funcs(funcs).Execute(&output, input); err != nil {
+		return &singleResult{value: err}
+	}
+
+	var result interface{}
+	if err := json.Unmarshal(output.Bytes(), &result); err != nil {
+		return &singleResult{value: fmt.Errorf("template output is not valid JSON: %w", err)}
+	}
+
+	return &singleResult{value: result}
+}
+
+// templateToJson renders a value as JSON within a template.
+func templateToJson(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoTemplateTransform(t *testing.T) {
+	engine := NewTransformEngine(requestVariableNames...)
+	require.NoError(t, engine.AddTransformWithLanguage("template", TransformLanguageGoTemplate, `{
+		"data": {
+			{{- range $i, $reading := .readings }}{{ if $i }},{{ end }}
+			{{ toJson $reading.name }}: {{ $reading.value }}
+			{{- end }}
+		},
+		"properties": {"device": {{ toJson (path).id }}}
+	}`))
+
+	result, err := engine.ExecuteWithVariables("template", map[string]interface{}{"readings": []interface{}{
+		map[string]interface{}{"name": "temperature", "value": 21.5},
+		map[string]interface{}{"name": "humidity \"%\"", "value": 40},
+	}}, map[string]interface{}{"$path": map[string]interface{}{"id": "device-1"}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"data":       map[string]interface{}{"temperature": 21.5, "humidity \"%\"": float64(40)},
+		"properties": map[string]interface{}{"device": "device-1"},
+	}, result)
+}
+
+func TestGoTemplateTransformErrors(t *testing.T) {
+	engine := NewTransformEngine(requestVariableNames...)
+	assert.Error(t, engine.AddTransformWithLanguage("invalid", TransformLanguageGoTemplate, `{"data": {{ .t }`))
+	assert.Error(t, engine.AddTransformWithLanguage("undefined-function", TransformLanguageGoTemplate, `{"data": {{ body }}}`))
+
+	require.NoError(t, engine.AddTransformWithLanguage("not-json", TransformLanguageGoTemplate, `{"data": {{ .t }}}`))
+	_, err := engine.Execute("not-json", map[string]interface{}{"t": "text"})
+	assert.EqualError(t, err, "transform-adapter: transform id not-json failed: template output is not valid JSON: invalid character 'e' in literal true (expecting 'r')")
+}
+
+func TestGoTemplateRoute(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter, err := NewAdapter(&Config{D2CMessages: []D2CMessage{{
+		Path:              "/message",
+		DeviceIdBodyQuery: ".device",
+		AuthHeader:        "key",
+		Transform:         `{"data": {"t": {{ toJson .t }}}}`,
+		TransformLanguage: TransformLanguageGoTemplate,
+	}}}, "localhost:1000")
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/message", `{"device": "device", "t": "warm"}`).Code)
+	require.Len(t, recorder.Messages["device"], 1)
+	assert.Equal(t, map[string]interface{}{"t": "warm"}, recorder.Messages["device"][0].Data)
+}
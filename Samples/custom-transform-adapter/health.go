@@ -0,0 +1,137 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const bridgeHealthTimeout = 5 * time.Second
+
+// HealthCheckResult is the outcome of a single readiness check.
+type HealthCheckResult struct {
+	Status string `json:"status"` // "ok" or "failed"
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthResponseBody is the response of the health and readiness endpoints, with the breakdown of each check.
+type HealthResponseBody struct {
+	Status string                       `json:"status"` // "ok" or "failed"
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+// HealthChecker serves the liveness and readiness probes of the adapter.
+type HealthChecker struct {
+	handler    *ReloadableHandler
+	bridgeUrl  string
+	services   *Services
+	httpClient *http.Client
+}
+
+func NewHealthChecker(handler *ReloadableHandler, bridgeUrl string, services *Services) *HealthChecker {
+	return &HealthChecker{
+		handler:    handler,
+		bridgeUrl:  strings.TrimSuffix(bridgeUrl, "/"),
+		services:   services,
+		httpClient: &http.Client{Timeout: bridgeHealthTimeout},
+	}
+}
+
+// ServeHealthz responds with 200 as long as the process is able to serve requests.
+func (checker *HealthChecker) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	respondJson(log.NewEntry(log.StandardLogger()), w, http.StatusOK, HealthResponseBody{Status: "ok"})
+}
+
+// ServeReadyz runs all readiness checks, responding with 200 if all of them pass or 503 otherwise.
+// The readiness checks are:
+//   - config: a configuration was loaded and all of its transforms were compiled.
+//   - bridge: the Bridge health endpoint responds successfully within a timeout.
+//   - queue: the store-and-forward queue, if enabled, isn't full.
+func (checker *HealthChecker) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) (string, error){
+		"config": checker.checkConfig,
+		"bridge": checker.checkBridge,
+	}
+
+	if checker.services.Queue != nil {
+		checks["queue"] = checker.checkQueue
+	}
+
+	response := HealthResponseBody{Status: "ok", Checks: make(map[string]HealthCheckResult, len(checks))}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) (string, error)) {
+			defer wg.Done()
+			result := HealthCheckResult{Status: "ok"}
+			detail, err := check(r.Context())
+			if err != nil {
+				result.Status, detail = "failed", err.Error()
+			}
+
+			result.Detail = detail
+			mutex.Lock()
+			defer mutex.Unlock()
+			response.Checks[name] = result
+			if err != nil {
+				response.Status = "failed"
+			}
+		}(name, check)
+	}
+
+	wg.Wait()
+
+	statusCode := http.StatusOK
+	if response.Status != "ok" {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	respondJson(log.NewEntry(log.StandardLogger()), w, statusCode, response)
+}
+
+func (checker *HealthChecker) checkConfig(ctx context.Context) (string, error) {
+	adapter := checker.handler.Current()
+	if adapter == nil {
+		return "", errors.New("configuration not loaded")
+	}
+
+	return fmt.Sprintf("%d transforms compiled", adapter.Engine.Len()), nil
+}
+
+func (checker *HealthChecker) checkBridge(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checker.bridgeUrl+"/health", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := checker.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach Device Bridge: %w", err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("health check of Device Bridge failed with status %d", resp.StatusCode)
+	}
+
+	return "", nil
+}
+
+func (checker *HealthChecker) checkQueue(ctx context.Context) (string, error) {
+	stats := checker.services.Queue.Stats()
+	if checker.services.Queue.Full() {
+		return "", fmt.Errorf("store-and-forward queue is full (%d messages)", stats.Depth)
+	}
+
+	return fmt.Sprintf("%d messages queued", stats.Depth), nil
+}
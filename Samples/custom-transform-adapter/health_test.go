@@ -0,0 +1,75 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func checkReadiness(checker *HealthChecker) (int, HealthResponseBody) {
+	req, _ := http.NewRequest("GET", "/adapter/readyz", nil)
+	recorder := httptest.NewRecorder()
+	checker.ServeReadyz(recorder, req)
+	var body HealthResponseBody
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return recorder.Code, body
+}
+
+func TestHealthz(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/adapter/healthz", nil)
+	recorder := httptest.NewRecorder()
+	NewHealthChecker(&ReloadableHandler{}, "http://localhost:1000", &Services{}).ServeHealthz(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, recorder.Body.String())
+}
+
+func TestReadyz(t *testing.T) {
+	bridge := newTargetMock(200, "Healthy")
+	defer bridge.Close()
+
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", Transform: "{ data: . }"},
+	}}, "localhost:1000")
+
+	handler := &ReloadableHandler{}
+	handler.Swap(adapter)
+
+	code, body := checkReadiness(NewHealthChecker(handler, bridge.URL+"/", &Services{}))
+	assert.Equal(t, 200, code)
+	assert.Equal(t, HealthResponseBody{Status: "ok", Checks: map[string]HealthCheckResult{
+		"config": {Status: "ok", Detail: "1 transforms compiled"},
+		"bridge": {Status: "ok"},
+	}}, body)
+	assert.Equal(t, "/health", bridge.LastPath)
+}
+
+func TestReadyzFailures(t *testing.T) {
+	bridge := newTargetMock(503, "Unhealthy")
+	defer bridge.Close()
+
+	queue, _ := newTestQueue(t, t.TempDir(), 1, 0)
+	defer queue.Close()
+	enqueueTestMessage(t, queue, "a", "1")
+
+	code, body := checkReadiness(NewHealthChecker(&ReloadableHandler{}, bridge.URL, &Services{Queue: queue}))
+	assert.Equal(t, 503, code)
+	assert.Equal(t, HealthResponseBody{Status: "failed", Checks: map[string]HealthCheckResult{
+		"config": {Status: "failed", Detail: "configuration not loaded"},
+		"bridge": {Status: "failed", Detail: "health check of Device Bridge failed with status 503"},
+		"queue":  {Status: "failed", Detail: "store-and-forward queue is full (1 messages)"},
+	}}, body)
+}
+
+func TestReadyzBridgeUnreachable(t *testing.T) {
+	bridge := newTargetMock(200, "")
+	bridge.Close()
+
+	code, body := checkReadiness(NewHealthChecker(&ReloadableHandler{}, bridge.URL, &Services{}))
+	assert.Equal(t, 503, code)
+	assert.Contains(t, body.Checks["bridge"].Detail, "failed to reach Device Bridge")
+}
@@ -0,0 +1,349 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fxamacker/cbor/v2"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Input formats of request bodies. Non-JSON bodies are converted into a JSON value before being transformed.
+const (
+	InputFormatJson = "json"
+	InputFormatAuto = "auto" // Picks the format from the Content-Type header, defaulting to JSON
+	InputFormatCsv  = "csv"
+	InputFormatXml  = "xml"
+	InputFormatForm = "form"
+	InputFormatCbor = "cbor"
+)
+
+const (
+	defaultXmlAttributePrefix = "@"
+	xmlTextKey                = "#text"
+)
+
+// InputOptions describes how the request bodies of a route are decoded.
+type InputOptions struct {
+	Format              string // Input format of request bodies. Defaults to JSON
+	CsvDelimiter        string // Field delimiter of CSV bodies. Defaults to ","
+	CsvNoHeaderRow      bool   // Whether CSV bodies lack a header row, in which case each row is converted into an array of fields
+	XmlAttributePrefix  string // Prefix added to the name of XML attributes. Defaults to "@"
+	XmlIgnoreAttributes bool   // Whether XML attributes are discarded
+}
+
+// decodeRequestBody decodes the request body according to the input options of a route.
+//   - JSON bodies must be objects.
+//   - CSV bodies are converted into an array with one entry per row. If the body has a header row, each entry is an
+//     object whose keys are the header fields. Otherwise, each entry is an array of fields. Fields are always strings.
+//   - XML documents are converted into an object whose only key is the name of the root element (see xmlToValue).
+//   - Form-urlencoded bodies are converted into an object whose keys are the field names. Fields with multiple values are
+//     converted into an array of strings.
+//   - CBOR bodies are converted into the equivalent JSON value (see cborToValue).
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, options InputOptions) (_ interface{}, err error) {
+	format := options.Format
+	if format == InputFormatAuto {
+		format = formatFromContentType(r.Header.Get("Content-Type"))
+	}
+
+	if format == "" || format == InputFormatJson {
+		var jsonBody map[string]interface{}
+		if err := decodeJsonBody(w, r, &jsonBody); err != nil {
+			return nil, fmt.Errorf("failed to decode JSON body: %w", err)
+		}
+
+		return jsonBody, nil
+	}
+
+	_, span := startSpan(r.Context(), "decode "+format+" body")
+	span.SetAttributes(attribute.String("input.format", format))
+	defer func() { endSpan(span, err) }()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	switch format {
+	case InputFormatCsv:
+		body, err := decodeCsv(r.Body, options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode CSV body: %w", err)
+		}
+
+		return body, nil
+	case InputFormatXml:
+		body, err := decodeXml(r.Body, options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode XML body: %w", err)
+		}
+
+		return body, nil
+	case InputFormatCbor:
+		body, err := decodeCbor(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode CBOR body: %w", err)
+		}
+
+		return body, nil
+	default:
+		body, err := decodeForm(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode form body: %w", err)
+		}
+
+		return body, nil
+	}
+}
+
+// formatFromContentType returns the input format matching a Content-Type header.
+func formatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case mediaType == "text/csv":
+		return InputFormatCsv
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return InputFormatXml
+	case mediaType == "application/x-www-form-urlencoded":
+		return InputFormatForm
+	case mediaType == "application/cbor":
+		return InputFormatCbor
+	default:
+		return InputFormatJson
+	}
+}
+
+func decodeCsv(body io.Reader, options InputOptions) (interface{}, error) {
+	reader := csv.NewReader(body)
+	if options.CsvDelimiter != "" {
+		reader.Comma, _ = utf8.DecodeRuneInString(options.CsvDelimiter)
+	}
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []interface{}{}
+	if options.CsvNoHeaderRow {
+		for _, record := range records {
+			fields := make([]interface{}, len(record))
+			for i, field := range record {
+				fields[i] = field
+			}
+
+			rows = append(rows, fields)
+		}
+
+		return rows, nil
+	}
+
+	if len(records) == 0 {
+		return nil, errors.New("missing header row")
+	}
+
+	header := records[0]
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, field := range record {
+			row[header[i]] = field
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func decodeForm(body io.Reader) (interface{}, error) {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := url.ParseQuery(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	form := make(map[string]interface{}, len(values))
+	for name, fieldValues := range values {
+		if len(fieldValues) == 1 {
+			form[name] = fieldValues[0]
+			continue
+		}
+
+		array := make([]interface{}, len(fieldValues))
+		for i, value := range fieldValues {
+			array[i] = value
+		}
+
+		form[name] = array
+	}
+
+	return form, nil
+}
+
+// xmlElement is an XML element being decoded.
+type xmlElement struct {
+	name     string
+	value    map[string]interface{}
+	text     strings.Builder
+	children bool
+}
+
+func decodeXml(body io.Reader, options InputOptions) (interface{}, error) {
+	attributePrefix := options.XmlAttributePrefix
+	if attributePrefix == "" {
+		attributePrefix = defaultXmlAttributePrefix
+	}
+
+	decoder := xml.NewDecoder(body)
+	var stack []*xmlElement
+	var root map[string]interface{}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			if root != nil {
+				return nil, errors.New("multiple root elements")
+			}
+
+			element := &xmlElement{name: token.Name.Local, value: make(map[string]interface{})}
+			if !options.XmlIgnoreAttributes {
+				for _, attr := range token.Attr {
+					element.value[attributePrefix+attr.Name.Local] = attr.Value
+				}
+			}
+
+			if len(stack) > 0 {
+				stack[len(stack)-1].children = true
+			}
+
+			stack = append(stack, element)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(token)
+			}
+		case xml.EndElement:
+			element := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			value := xmlToValue(element)
+
+			if len(stack) == 0 {
+				root = map[string]interface{}{element.name: value}
+				continue
+			}
+
+			// Repeated child elements are grouped into an array.
+			parent := stack[len(stack)-1].value
+			switch existing := parent[element.name].(type) {
+			case nil:
+				parent[element.name] = value
+			case []interface{}:
+				parent[element.name] = append(existing, value)
+			default:
+				parent[element.name] = []interface{}{existing, value}
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("missing root element")
+	}
+
+	return root, nil
+}
+
+// xmlToValue converts a decoded XML element into a JSON value. Elements with only text content are converted into a string.
+// Otherwise, they are converted into an object with their attributes, child elements, and text content (under "#text", if not empty).
+func xmlToValue(element *xmlElement) interface{} {
+	text := strings.TrimSpace(element.text.String())
+	if len(element.value) == 0 && !element.children {
+		return text
+	}
+
+	if text != "" {
+		element.value[xmlTextKey] = text
+	}
+
+	return element.value
+}
+
+func decodeCbor(body io.Reader) (interface{}, error) {
+	var value interface{}
+	if err := cbor.NewDecoder(body).Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return cborToValue(value)
+}
+
+// cborToValue converts a decoded CBOR value into a JSON value. Integers are converted into numbers, byte strings into
+// base64-encoded strings, and timestamps into RFC 3339 strings. Other tags are replaced by their content.
+// Map keys must be strings or numbers, which are converted into strings.
+func cborToValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case uint64:
+		return float64(value), nil
+	case int64:
+		return float64(value), nil
+	case cbor.ByteString:
+		return base64.StdEncoding.EncodeToString([]byte(value)), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(value), nil
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano), nil
+	case cbor.Tag:
+		return cborToValue(value.Content)
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, item := range value {
+			converted, err := cborToValue(item)
+			if err != nil {
+				return nil, err
+			}
+
+			array[i] = converted
+		}
+
+		return array, nil
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			switch key.(type) {
+			case string, uint64, int64:
+			default:
+				return nil, fmt.Errorf("unsupported map key type %T", key)
+			}
+
+			converted, err := cborToValue(item)
+			if err != nil {
+				return nil, err
+			}
+
+			object[fmt.Sprint(key)] = converted
+		}
+
+		return object, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeTestBody(options InputOptions, contentType string, body string) (interface{}, error) {
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	return decodeRequestBody(httptest.NewRecorder(), req, options)
+}
+
+func TestDecodeCsv(t *testing.T) {
+	body, err := decodeTestBody(InputOptions{Format: InputFormatCsv}, "", "device,temperature\ns1,21.5\ns2,22\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"device": "s1", "temperature": "21.5"},
+		map[string]interface{}{"device": "s2", "temperature": "22"},
+	}, body)
+}
+
+func TestDecodeCsvNoHeaderRow(t *testing.T) {
+	body, err := decodeTestBody(InputOptions{Format: InputFormatCsv, CsvDelimiter: ";", CsvNoHeaderRow: true}, "", "s1;21,5\ns2;22\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{[]interface{}{"s1", "21,5"}, []interface{}{"s2", "22"}}, body)
+}
+
+func TestDecodeCsvMalformed(t *testing.T) {
+	_, err := decodeTestBody(InputOptions{Format: InputFormatCsv}, "", "device,temperature\ns1\n")
+	assert.Contains(t, err.Error(), "failed to decode CSV body")
+}
+
+func TestDecodeXml(t *testing.T) {
+	body, err := decodeTestBody(InputOptions{Format: InputFormatXml}, "", `<?xml version="1.0"?>
+		<logger id="l1">
+			<reading channel="1" unit="C">21.5</reading>
+			<reading channel="2">22</reading>
+			<battery>3.3</battery>
+			<status />
+		</logger>`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"logger": map[string]interface{}{
+		"@id": "l1",
+		"reading": []interface{}{
+			map[string]interface{}{"@channel": "1", "@unit": "C", "#text": "21.5"},
+			map[string]interface{}{"@channel": "2", "#text": "22"},
+		},
+		"battery": "3.3",
+		"status":  "",
+	}}, body)
+}
+
+func TestDecodeXmlAttributeOptions(t *testing.T) {
+	body, err := decodeTestBody(InputOptions{Format: InputFormatXml, XmlAttributePrefix: "_"}, "", `<reading channel="1">21.5</reading>`)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"reading": map[string]interface{}{"_channel": "1", "#text": "21.5"}}, body)
+
+	body, err = decodeTestBody(InputOptions{Format: InputFormatXml, XmlIgnoreAttributes: true}, "", `<reading channel="1">21.5</reading>`)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"reading": "21.5"}, body)
+}
+
+func TestDecodeXmlMalformed(t *testing.T) {
+	_, err := decodeTestBody(InputOptions{Format: InputFormatXml}, "", `<a><b></a>`)
+	assert.Contains(t, err.Error(), "failed to decode XML body")
+
+	_, err = decodeTestBody(InputOptions{Format: InputFormatXml}, "", `<a></a><b></b>`)
+	assert.EqualError(t, err, "failed to decode XML body: multiple root elements")
+}
+
+func TestDecodeForm(t *testing.T) {
+	body, err := decodeTestBody(InputOptions{Format: InputFormatForm}, "", "device=s1&temperature=21.5&tag=a&tag=b")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"device": "s1", "temperature": "21.5", "tag": []interface{}{"a", "b"}}, body)
+}
+
+func TestDecodeCbor(t *testing.T) {
+	payload, _ := cbor.Marshal(map[interface{}]interface{}{
+		"device": "s1",
+		1:        uint64(21),
+		"raw":    []byte{0x01, 0x02},
+		"values": []interface{}{int64(-1), 2.5},
+	})
+
+	body, err := decodeTestBody(InputOptions{Format: InputFormatCbor}, "", string(payload))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"device": "s1",
+		"1":      float64(21),
+		"raw":    "AQI=",
+		"values": []interface{}{float64(-1), 2.5},
+	}, body)
+
+	_, err = decodeTestBody(InputOptions{Format: InputFormatCbor}, "", "\xa1")
+	assert.Contains(t, err.Error(), "failed to decode CBOR body")
+}
+
+func TestDecodeAutoFormat(t *testing.T) {
+	options := InputOptions{Format: InputFormatAuto}
+
+	body, _ := decodeTestBody(options, "text/csv; charset=utf-8", "a\n1\n")
+	assert.Equal(t, []interface{}{map[string]interface{}{"a": "1"}}, body)
+
+	body, _ = decodeTestBody(options, "application/soap+xml", "<a>1</a>")
+	assert.Equal(t, map[string]interface{}{"a": "1"}, body)
+
+	body, _ = decodeTestBody(options, "application/x-www-form-urlencoded", "a=1")
+	assert.Equal(t, map[string]interface{}{"a": "1"}, body)
+
+	payload, _ := cbor.Marshal(map[string]interface{}{"a": 1})
+	body, _ = decodeTestBody(options, "application/cbor", string(payload))
+	assert.Equal(t, map[string]interface{}{"a": float64(1)}, body)
+
+	body, _ = decodeTestBody(options, "", `{"a": 1}`)
+	assert.Equal(t, map[string]interface{}{"a": float64(1)}, body)
+}
+
+func TestCsvFanOutRoute(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/upload",
+			Transform:         ".[] | { device, data: { temperature: (.temperature | tonumber) } }",
+			DeviceIdBodyQuery: ".device",
+			AuthHeader:        "key",
+			FanOut:            true,
+			Input:             InputOptions{Format: InputFormatAuto},
+		},
+	}}, "localhost:1000")
+
+	recorder := &BridgeClientRecorder{}
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewBufferString("device,temperature\ns1,21.5\ns2,22\n"))
+	req.Header.Add("key", "test_key")
+	req.Header.Add("Content-Type", "text/csv")
+	response := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(response, req)
+	assert.Equal(t, 200, response.Code)
+	assert.Len(t, recorder.Messages, 2)
+}
+
+func TestXmlRoute(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/xml",
+			Transform:         `{ data: { temperature: (.logger.reading | tonumber) } }`,
+			DeviceIdBodyQuery: `.logger["@id"]`,
+			AuthHeader:        "key",
+			Input:             InputOptions{Format: InputFormatXml},
+		},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	recorder := sendTestMessage(adapter.Router, "/xml", `<logger id="l1"><reading>21.5</reading></logger>`)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "l1", mockBridgeClient.LastSendMessageDeviceId)
+	assert.Equal(t, 21.5, mockBridgeClient.LastSendMessageBody.Data["temperature"])
+}
@@ -0,0 +1,347 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	jwksFetchTimeout = 10 * time.Second
+	// jwksRefreshInterval is how often keys fetched from a URL are refreshed, to pick up rotated keys.
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits how often unknown key Ids trigger a refresh, so forged tokens can't flood the identity provider.
+	jwksMinRefreshInterval = time.Minute
+	// defaultJwtDeviceIdClaim is the claim that holds the device of a token, unless the route defines deviceIdClaim.
+	defaultJwtDeviceIdClaim = "sub"
+)
+
+// jwtSigningMethods are the accepted token signing algorithms. Symmetric algorithms are excluded, since keys are public.
+var jwtSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// JwtOptions describes how the bearer tokens of the requests of a route are validated.
+type JwtOptions struct {
+	Keys          *JwksKeySet   // Keys used to verify token signatures
+	Issuer        string        // Expected "iss" claim
+	Audience      string        // Expected "aud" claim
+	Leeway        time.Duration // Tolerated clock skew when checking the expiration and not-before times
+	DeviceIdClaim string        // Claim that must match the device Id of every message sent with the token. Defaults to "sub"
+}
+
+// JwksKeySet is a JSON Web Key Set (RFC 7517), either loaded from a file or fetched from a URL and refreshed periodically.
+type JwksKeySet struct {
+	url        string
+	httpClient *http.Client
+	fetches    singleflight.Group // Concurrent requests share a single fetch
+
+	mutex     sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtAuthenticationKey is the context key of the authentication of requests with a bearer token.
+type jwtAuthenticationKey struct{}
+
+type jwtAuthentication struct {
+	claims   jwt.MapClaims
+	deviceId string // Only device the token is valid for
+}
+
+// LoadJwksFile loads a key set from a file.
+func LoadJwksFile(path string) (*JwksKeySet, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("transform-adapter: failed to read JWKS file: %w", err)
+	}
+
+	keys, err := parseJwks(content)
+	if err != nil {
+		return nil, fmt.Errorf("transform-adapter: failed to parse JWKS file: %w", err)
+	}
+
+	return &JwksKeySet{keys: keys}, nil
+}
+
+// NewJwksUrlKeySet creates a key set fetched from a URL. Keys are fetched on first use, so the adapter can start while the
+// identity provider is unreachable.
+func NewJwksUrlKeySet(url string) *JwksKeySet {
+	return &JwksKeySet{url: url, httpClient: &http.Client{Timeout: jwksFetchTimeout}}
+}
+
+// key returns the public key with the given key Id. Tokens without a key Id are accepted if the set has a single key.
+func (keySet *JwksKeySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	keySet.mutex.Lock()
+	fetch := keySet.url != "" && keySet.needsFetch(kid)
+	keySet.mutex.Unlock()
+
+	if fetch {
+		// The fetch outlives the request that triggered it, since other requests may be waiting for it.
+		_, err, _ := keySet.fetches.Do(keySet.url, func() (interface{}, error) {
+			return nil, keySet.fetch(context.WithoutCancel(ctx), kid)
+		})
+
+		if err != nil {
+			log.WithField("error", err).Warnf("Failed to fetch JWKS from %s: %s", keySet.url, err)
+		}
+	}
+
+	keySet.mutex.Lock()
+	defer keySet.mutex.Unlock()
+
+	if kid == "" && len(keySet.keys) == 1 {
+		for _, key := range keySet.keys {
+			return key, nil
+		}
+	}
+
+	key, ok := keySet.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	return key, nil
+}
+
+// needsFetch returns whether the keys must be fetched before looking up a key Id. Must be called with the mutex held.
+func (keySet *JwksKeySet) needsFetch(kid string) bool {
+	sinceFetch := time.Since(keySet.fetchedAt)
+	_, known := keySet.keys[kid]
+	return sinceFetch > jwksRefreshInterval || (!known && sinceFetch > jwksMinRefreshInterval)
+}
+
+// fetch replaces the keys of the set with the ones served by its URL, unless a fetch that completed meanwhile made it unneeded.
+// The mutex is only held to check and swap the keys, so requests with known keys aren't blocked by the identity provider.
+func (keySet *JwksKeySet) fetch(ctx context.Context, kid string) error {
+	keySet.mutex.Lock()
+	needed := keySet.needsFetch(kid)
+	keySet.mutex.Unlock()
+	if !needed {
+		return nil
+	}
+
+	keys, err := keySet.download(ctx)
+
+	keySet.mutex.Lock()
+	defer keySet.mutex.Unlock()
+
+	// The fetch time is updated on failure as well, so an unreachable identity provider isn't retried on every request.
+	keySet.fetchedAt = time.Now()
+	if err != nil {
+		return err
+	}
+
+	keySet.keys = keys
+	return nil
+}
+
+// download fetches and parses the keys served by the URL of the set.
+func (keySet *JwksKeySet) download(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keySet.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := keySet.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJwks(content)
+}
+
+// parseJwks parses the signing keys of a key set. RSA, EC (P-256, P-384, and P-521), and Ed25519 keys are supported.
+func parseJwks(content []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for i, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d: %w", i, err)
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeJwkInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeJwkInt(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+
+		x, err := decodeJwkInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeJwkInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func decodeJwkInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(bytes) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// withJwtAuthentication wraps the handler of a route, validating the bearer token in the Authorization header of requests.
+// Requests with a missing or invalid token are rejected with 401. The claims of valid tokens are exposed to the queries of
+// the route through the $claims variable.
+func withJwtAuthentication(options *JwtOptions, handler func(*log.Entry, http.ResponseWriter, *http.Request)) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		claims, err := options.validate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			respondError(logger, w, http.StatusUnauthorized, err)
+			return
+		}
+
+		authentication := jwtAuthentication{claims: claims, deviceId: claims[options.deviceIdClaim()].(string)}
+		handler(logger, w, r.WithContext(context.WithValue(r.Context(), jwtAuthenticationKey{}, authentication)))
+	}
+}
+
+// validate extracts and validates the bearer token of a request, returning its claims.
+func (options *JwtOptions) validate(r *http.Request) (jwt.MapClaims, error) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+
+	parserOptions := []jwt.ParserOption{jwt.WithValidMethods(jwtSigningMethods), jwt.WithExpirationRequired(), jwt.WithLeeway(options.Leeway)}
+	if options.Issuer != "" {
+		parserOptions = append(parserOptions, jwt.WithIssuer(options.Issuer))
+	}
+
+	if options.Audience != "" {
+		parserOptions = append(parserOptions, jwt.WithAudience(options.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return options.Keys.key(r.Context(), kid)
+	}, parserOptions...)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid bearer token: %w", err)
+	}
+
+	if deviceId, ok := claims[options.deviceIdClaim()].(string); !ok || deviceId == "" {
+		return nil, fmt.Errorf("invalid bearer token: missing %s claim", options.deviceIdClaim())
+	}
+
+	return claims, nil
+}
+
+// deviceIdClaim returns the name of the claim that holds the only device a token is valid for.
+func (options *JwtOptions) deviceIdClaim() string {
+	if options.DeviceIdClaim == "" {
+		return defaultJwtDeviceIdClaim
+	}
+
+	return options.DeviceIdClaim
+}
+
+// jwtClaims returns the claims of the bearer token of a request, or nil if it wasn't authenticated with one.
+func jwtClaims(r *http.Request) jwt.MapClaims {
+	authentication, _ := r.Context().Value(jwtAuthenticationKey{}).(jwtAuthentication)
+	return authentication.claims
+}
+
+// jwtDeviceId returns the only device that the bearer token of a request is valid for, or an empty string if it wasn't
+// authenticated with one.
+func jwtDeviceId(r *http.Request) string {
+	authentication, _ := r.Context().Value(jwtAuthenticationKey{}).(jwtAuthentication)
+	return authentication.deviceId
+}
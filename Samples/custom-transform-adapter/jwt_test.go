@@ -0,0 +1,290 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildTestJwks returns the JWKS document with the public key of the given RSA key.
+func buildTestJwks(key *rsa.PrivateKey, kid string) string {
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+
+	return string(jwks)
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func buildTestTokenClaims(sub string) jwt.MapClaims {
+	return jwt.MapClaims{"iss": "https://idp.example.com", "aud": "transform-adapter", "sub": sub, "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func sendTokenTestMessage(adapter *Adapter, path string, body string, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestJwtAuthentication(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	dir := t.TempDir()
+	writeTestFile(t, dir, "jwks.json", buildTestJwks(key, "k1"))
+	keys, err := LoadJwksFile(filepath.Join(dir, "jwks.json"))
+	require.NoError(t, err)
+
+	client := &BridgeClientMock{}
+	adapter, err := NewAdapterWithServices(&Config{
+		D2CMessages: []D2CMessage{{
+			Path:              "/telemetry",
+			DeviceIdBodyQuery: "$claims.sub",
+			Transform:         "{ data: ., properties: { tenant: $claims.tenant } }",
+			Jwt:               &JwtOptions{Keys: keys, Issuer: "https://idp.example.com", Audience: "transform-adapter"},
+		}},
+		DeviceKeys: buildTestDeviceKeyTable(),
+	}, "localhost:1000", &Services{BridgeApiKey: "bridge_key"})
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+
+	claims := buildTestTokenClaims("my-device")
+	claims["tenant"] = "contoso"
+	assert.Equal(t, 200, sendTokenTestMessage(adapter, "/telemetry", `{"temperature": 21}`, signTestToken(t, key, "k1", claims)).Code)
+	assert.Equal(t, "my-device", client.LastSendMessageDeviceId)
+	assert.Equal(t, float64(21), client.LastSendMessageBody.Data["temperature"])
+	assert.Equal(t, "contoso", *client.LastSendMessageBody.Properties["tenant"])
+	assert.Equal(t, autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"x-api-key": "bridge_key"}), client.LastAuthorizer)
+
+	response := sendTokenTestMessage(adapter, "/telemetry", `{}`, "")
+	assert.Equal(t, 401, response.Code)
+	assert.Equal(t, `Bearer error="invalid_token"`, response.Header().Get("WWW-Authenticate"))
+	assert.JSONEq(t, `{"error": "missing bearer token"}`, response.Body.String())
+
+	expired := buildTestTokenClaims("my-device")
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	wrongAudience := buildTestTokenClaims("my-device")
+	wrongAudience["aud"] = "other-service"
+	wrongIssuer := buildTestTokenClaims("my-device")
+	wrongIssuer["iss"] = "https://other.example.com"
+	noExpiration := buildTestTokenClaims("my-device")
+	delete(noExpiration, "exp")
+	symmetric, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, buildTestTokenClaims("my-device")).SignedString([]byte("k1"))
+
+	for name, token := range map[string]string{
+		"expired":        signTestToken(t, key, "k1", expired),
+		"wrong audience": signTestToken(t, key, "k1", wrongAudience),
+		"wrong issuer":   signTestToken(t, key, "k1", wrongIssuer),
+		"no expiration":  signTestToken(t, key, "k1", noExpiration),
+		"wrong key":      signTestToken(t, otherKey, "k1", buildTestTokenClaims("my-device")),
+		"unknown key":    signTestToken(t, key, "k2", buildTestTokenClaims("my-device")),
+		"symmetric":      symmetric,
+	} {
+		assert.Equal(t, 401, sendTokenTestMessage(adapter, "/telemetry", `{}`, token).Code, name)
+	}
+}
+
+func TestJwtDeviceIdClaim(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keySet, _ := parseJwks([]byte(buildTestJwks(key, "k1")))
+
+	client := &BridgeClientMock{}
+	adapter, err := NewAdapter(&Config{
+		D2CMessages: []D2CMessage{{
+			Path:              "/{id}/telemetry",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			Jwt:               &JwtOptions{Keys: &JwksKeySet{keys: keySet}, Issuer: "https://idp.example.com", Audience: "transform-adapter", DeviceIdClaim: "sub"},
+		}},
+	}, "localhost:1000")
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+	token := signTestToken(t, key, "k1", buildTestTokenClaims("device-1"))
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(`{"data": {}}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("key", "my_key")
+		recorder := httptest.NewRecorder()
+		adapter.Router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, 200, send("/device-1/telemetry").Code)
+	assert.Equal(t, "device-1", client.LastSendMessageDeviceId)
+	assert.Equal(t, autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"x-api-key": "my_key"}), client.LastAuthorizer)
+
+	client.LastSendMessageDeviceId = ""
+	response := send("/device-2/telemetry")
+	assert.Equal(t, 403, response.Code)
+	assert.JSONEq(t, `{"error": "bearer token is not valid for this device"}`, response.Body.String())
+	assert.Empty(t, client.LastSendMessageDeviceId)
+}
+
+func TestJwtDefaultDeviceIdClaim(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keySet, _ := parseJwks([]byte(buildTestJwks(key, "k1")))
+
+	client := &BridgeClientMock{}
+	adapter, err := NewAdapterWithServices(&Config{
+		D2CMessages: []D2CMessage{{
+			Path:              "/{id}/telemetry",
+			DeviceIdPathParam: "id",
+			Jwt:               &JwtOptions{Keys: &JwksKeySet{keys: keySet}, Issuer: "https://idp.example.com", Audience: "transform-adapter"},
+		}},
+		DeviceKeys: buildTestDeviceKeyTable(),
+	}, "localhost:1000", &Services{BridgeApiKey: "bridge_key"})
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+	token := signTestToken(t, key, "k1", buildTestTokenClaims("device-1"))
+
+	assert.Equal(t, 200, sendTokenTestMessage(adapter, "/device-1/telemetry", `{"data": {}}`, token).Code)
+	assert.Equal(t, "device-1", client.LastSendMessageDeviceId)
+
+	client.LastSendMessageDeviceId = ""
+	assert.Equal(t, 403, sendTokenTestMessage(adapter, "/device-2/telemetry", `{"data": {}}`, token).Code)
+	assert.Empty(t, client.LastSendMessageDeviceId)
+
+	noSubject := buildTestTokenClaims("device-1")
+	delete(noSubject, "sub")
+	response := sendTokenTestMessage(adapter, "/device-1/telemetry", `{"data": {}}`, signTestToken(t, key, "k1", noSubject))
+	assert.Equal(t, 401, response.Code)
+	assert.JSONEq(t, `{"error": "invalid bearer token: missing sub claim"}`, response.Body.String())
+}
+
+func TestJwksUrlKeySet(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte(buildTestJwks(key, "k1")))
+	}))
+	defer server.Close()
+
+	keySet := NewJwksUrlKeySet(server.URL)
+	found, err := keySet.key(context.Background(), "k1")
+	require.NoError(t, err)
+	assert.Equal(t, &key.PublicKey, found)
+
+	_, err = keySet.key(context.Background(), "k1")
+	assert.NoError(t, err)
+
+	// Unknown keys don't trigger a refresh right after a fetch.
+	_, err = keySet.key(context.Background(), "k2")
+	assert.EqualError(t, err, `unknown key "k2"`)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	keySet.fetchedAt = time.Now().Add(-2 * jwksMinRefreshInterval)
+	keySet.key(context.Background(), "k2")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestJwksUrlKeySetConcurrentFetch(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var fetches int32
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			w.Write([]byte(buildTestJwks(key, "k1")))
+			return
+		}
+
+		close(started)
+		<-release
+		w.Write([]byte(buildTestJwks(key, "k2")))
+	}))
+	defer server.Close()
+
+	keySet := NewJwksUrlKeySet(server.URL)
+	_, err := keySet.key(context.Background(), "k1")
+	require.NoError(t, err)
+
+	// Requests for an unknown key share a single fetch, and the first one is cancelled without failing the others.
+	keySet.fetchedAt = time.Now().Add(-2 * jwksMinRefreshInterval)
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan error, 2)
+	go func() {
+		_, err := keySet.key(ctx, "k2")
+		results <- err
+	}()
+
+	<-started
+	go func() {
+		_, err := keySet.key(context.Background(), "k2")
+		results <- err
+	}()
+
+	cancel()
+
+	// Known keys are served while the identity provider is slow.
+	done := make(chan error)
+	go func() {
+		_, err := keySet.key(context.Background(), "k1")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("known key lookup blocked by a fetch")
+	}
+
+	close(release)
+	assert.NoError(t, <-results)
+	assert.NoError(t, <-results)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestParseJwks(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()), "y": base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "enc", "use": "enc"},
+	}})
+
+	keys, err := parseJwks(jwks)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.True(t, ecKey.PublicKey.Equal(keys["ec"]))
+
+	_, err = parseJwks([]byte(`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`))
+	assert.EqualError(t, err, `invalid key 0: unsupported key type "oct"`)
+}
@@ -3,11 +3,20 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
 	log "github.com/sirupsen/logrus"
 )
 
+const defaultConfigReloadInterval = 30 * time.Second
+
 func init() {
 	log.SetFormatter(&log.JSONFormatter{})
 }
@@ -17,17 +26,192 @@ func main() {
 	configPath := os.Getenv("CONFIG_PATH")
 	configFileName := os.Getenv("CONFIG_FILE")
 
-	config, err := LoadConfig(configPath, configFileName)
+	reloadInterval := defaultConfigReloadInterval
+	if reloadIntervalRaw := os.Getenv("CONFIG_RELOAD_INTERVAL"); reloadIntervalRaw != "" {
+		var err error
+		if reloadInterval, err = time.ParseDuration(reloadIntervalRaw); err != nil {
+			log.WithField("error", err).Panicf("invalid config reload interval: %s", err)
+		}
+	}
 
+	shutdownTracing, err := InitTracing(context.Background())
 	if err != nil {
-		log.WithField("error", err).Panicf("unable to load config: %s", err)
+		log.WithField("error", err).Panicf("unable to initialize tracing: %s", err)
 	}
 
-	adapter, err := NewAdapter(config, bridgeUrl)
+	defer shutdownTracing(context.Background())
 
-	if err != nil {
-		log.WithField("error", err).Panicf("unable to build adapter server: %s", err)
+	services := &Services{BridgeApiKey: parseBridgeApiKey(), Retry: parseRetryPolicy(), Breaker: parseCircuitBreaker(), RateLimiters: NewRateLimiters()}
+	router := mux.NewRouter()
+
+	// Metrics and queue stats are only enabled if an admin port is provided, so they aren't exposed through the public port.
+	adminPort := os.Getenv("METRICS_PORT")
+	adminRouter := mux.NewRouter()
+	if adminPort != "" {
+		services.Metrics = NewMetrics()
+		adminRouter.Handle("/metrics", services.Metrics.Handler()).Methods("GET")
+	}
+
+	if services.Breaker != nil {
+		services.Metrics.RegisterCircuitBreaker(services.Breaker)
+	}
+
+	// The store-and-forward queue is only enabled if a queue path is provided.
+	if queuePath := os.Getenv("QUEUE_PATH"); queuePath != "" {
+		sender := NewBridgeQueueSender(func() BridgeClient {
+			return &BridgeClientAutorest{bridge.NewWithBaseURI(bridgeUrl)}
+		}, services.BridgeApiKey, services.Metrics)
+
+		queue, err := NewMessageQueue(queuePath, parseCount("QUEUE_MAX_MESSAGES"), parseDuration("QUEUE_TTL"), sender)
+
+		if err != nil {
+			log.WithField("error", err).Panicf("unable to open store-and-forward queue: %s", err)
+		}
+
+		defer queue.Close()
+		services.Queue = queue
+		services.Metrics.RegisterQueue(queue)
+		adminRouter.HandleFunc("/adapter/queue", queue.ServeStats).Methods("GET")
+		go queue.Drain(context.Background())
+	}
+
+	// Messages of async routes are sent to the Bridge by a bounded pool of workers.
+	services.Async = NewAsyncPool(parseCount("ASYNC_WORKERS"), parseCount("ASYNC_QUEUE_SIZE"), services.Metrics)
+	services.Metrics.RegisterAsyncPool(services.Async)
+
+	// Devices registered by auto-registering routes are remembered, so each device is registered once.
+	services.Registrations = NewRegistrationCache(parseCount("AUTO_REGISTER_MAX_DEVICES"))
+
+	// Deduplication keys are kept in memory, unless a path is provided to persist them across restarts.
+	if dedupPath := os.Getenv("DEDUP_PATH"); dedupPath != "" {
+		store, err := NewBoltDedupStore(dedupPath, parseCount("DEDUP_MAX_KEYS"))
+		if err != nil {
+			log.WithField("error", err).Panicf("unable to open deduplication store: %s", err)
+		}
+
+		defer store.Close()
+		services.Dedup = store
+	} else {
+		services.Dedup = NewMemoryDedupStore(parseCount("DEDUP_MAX_KEYS"))
+	}
+
+	handler := &ReloadableHandler{}
+	watcher := NewConfigWatcher(configPath, configFileName, handler, func(config *Config) (*Adapter, error) {
+		return NewAdapterWithServices(config, bridgeUrl, services)
+	})
+
+	if err := watcher.Reload(); err != nil {
+		log.WithField("error", err).Panicf("unable to load adapter: %s", err)
+	}
+
+	// A zero interval disables configuration reloads.
+	if reloadInterval > 0 {
+		go watcher.Watch(context.Background(), reloadInterval)
+	}
+
+	// The MQTT ingress is only enabled if an MQTT port is provided.
+	if mqttPort := os.Getenv("MQTT_PORT"); mqttPort != "" {
+		ingress, err := NewMqttIngress(":"+mqttPort, handler)
+		if err != nil {
+			log.WithField("error", err).Panicf("unable to create MQTT ingress: %s", err)
+		}
+
+		if err := ingress.Serve(); err != nil {
+			log.WithField("error", err).Panicf("unable to start MQTT ingress: %s", err)
+		}
+
+		defer ingress.Close()
+	}
+
+	// The CoAP ingress is only enabled if a CoAP port is provided.
+	if coapPort := os.Getenv("COAP_PORT"); coapPort != "" {
+		ingress, err := NewCoapIngress(":"+coapPort, handler)
+		if err != nil {
+			log.WithField("error", err).Panicf("unable to start CoAP ingress: %s", err)
+		}
+
+		ingress.Serve()
+		defer ingress.Close()
+	}
+
+	healthChecker := NewHealthChecker(handler, bridgeUrl, services)
+	router.HandleFunc("/adapter/healthz", healthChecker.ServeHealthz).Methods("GET")
+	router.HandleFunc("/adapter/readyz", healthChecker.ServeReadyz).Methods("GET")
+	router.PathPrefix("/").Handler(handler)
+
+	if adminPort != "" {
+		go func() {
+			log.Infof("Serving admin endpoints on port %s", adminPort)
+			log.Fatal(ListenAndServe(adminPort, adminRouter))
+		}()
+	}
+
+	log.Fatal(ListenAndServe(os.Getenv("PORT"), router))
+}
+
+// parseBridgeApiKey reads the Bridge API key managed by the adapter from the environment, either directly or from a file
+// (e.g., a mounted secret). Returns an empty string if the adapter doesn't manage the key.
+func parseBridgeApiKey() string {
+	if keyFile := os.Getenv("BRIDGE_API_KEY_FILE"); keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			log.WithField("error", err).Panicf("unable to read Bridge API key file: %s", err)
+		}
+
+		return strings.TrimSpace(string(key))
+	}
+
+	return os.Getenv("BRIDGE_API_KEY")
+}
+
+// parseRetryPolicy reads the retry policy of Bridge calls from the environment. Returns nil if retries are disabled, which is the
+// default (no max retries set).
+func parseRetryPolicy() *RetryPolicy {
+	maxRetries := parseCount("BRIDGE_MAX_RETRIES")
+	if maxRetries == 0 {
+		return nil
+	}
+
+	return NewRetryPolicy(maxRetries, parseDuration("BRIDGE_RETRY_BASE_DELAY"), parseDuration("BRIDGE_RETRY_MAX_DELAY"), parseDuration("BRIDGE_RETRY_TIMEOUT"))
+}
+
+// parseCircuitBreaker reads the circuit breaker settings of Bridge calls from the environment. Returns nil if the breaker is
+// disabled, which is the default (no threshold set).
+func parseCircuitBreaker() *CircuitBreaker {
+	threshold := parseCount("BRIDGE_BREAKER_THRESHOLD")
+	if threshold == 0 {
+		return nil
+	}
+
+	return NewCircuitBreaker(threshold, parseDuration("BRIDGE_BREAKER_COOLDOWN"))
+}
+
+// parseDuration reads a non-negative duration from the given environment variable. Zero if not set, which uses the default.
+func parseDuration(name string) time.Duration {
+	durationRaw := os.Getenv(name)
+	if durationRaw == "" {
+		return 0
+	}
+
+	duration, err := time.ParseDuration(durationRaw)
+	if err != nil || duration < 0 {
+		log.Panicf("invalid %s: %s", name, durationRaw)
+	}
+
+	return duration
+}
+
+// parseCount reads a non-negative integer from the given environment variable. Zero if not set, which uses the default.
+func parseCount(name string) int {
+	countRaw := os.Getenv(name)
+	if countRaw == "" {
+		return 0
+	}
+
+	count, err := strconv.Atoi(countRaw)
+	if err != nil || count < 0 {
+		log.Panicf("invalid %s: %s", name, countRaw)
 	}
 
-	log.Fatal(adapter.ListenAndServe(os.Getenv("PORT")))
+	return count
 }
@@ -0,0 +1,331 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/gorilla/mux"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const metricsNamespace = "transform_adapter"
+
+// Metrics holds the Prometheus metrics of the adapter. All methods are no-ops on a nil Metrics, so instrumented
+// code doesn't need to check whether metrics are enabled.
+type Metrics struct {
+	Registry          *prometheus.Registry
+	requests          *prometheus.CounterVec
+	inFlight          *prometheus.GaugeVec
+	bodySize          *prometheus.HistogramVec
+	transformDuration *prometheus.HistogramVec
+	transformFailures *prometheus.CounterVec
+	deviceIdFailures  *prometheus.CounterVec
+	bridgeDuration    *prometheus.HistogramVec
+	rateLimits        *prometheus.CounterVec
+	duplicates        *prometheus.CounterVec
+	bridgeRetries     *prometheus.CounterVec
+	circuitRejections *prometheus.CounterVec
+	asyncFailures     *prometheus.CounterVec
+}
+
+// NewMetrics creates the adapter metrics in a new registry.
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Number of requests handled, by route path and response status code.",
+		}, []string{"route", "status"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_in_flight",
+			Help:      "Number of requests currently being handled, by route path.",
+		}, []string{"route"}),
+		bodySize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_body_bytes",
+			Help:      "Size of the request bodies read, by route path.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{"route"}),
+		transformDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "transform_duration_seconds",
+			Help:      "Duration of transform executions, by route path and transform language.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{"route", "language"}),
+		transformFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transform_failures_total",
+			Help:      "Number of failed transform executions, by route path and transform language.",
+		}, []string{"route", "language"}),
+		deviceIdFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "device_id_failures_total",
+			Help:      "Number of requests whose device Id could not be resolved, by route path.",
+		}, []string{"route"}),
+		bridgeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "bridge_send_message_duration_seconds",
+			Help:      "Latency of Bridge SendMessage calls, by route path and Bridge status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "status"}),
+		rateLimits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rate_limited_total",
+			Help:      "Number of requests or messages rejected by rate limits, by route path and scope (route or device).",
+		}, []string{"route", "scope"}),
+		duplicates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "duplicates_total",
+			Help:      "Number of messages dropped as duplicates of already forwarded messages, by route path.",
+		}, []string{"route"}),
+		bridgeRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bridge_retries_total",
+			Help:      "Number of Bridge calls retried after a transient failure, by route path.",
+		}, []string{"route"}),
+		circuitRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bridge_circuit_rejections_total",
+			Help:      "Number of Bridge calls rejected without being attempted because the circuit breaker is open, by route path.",
+		}, []string{"route"}),
+		asyncFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "async_failures_total",
+			Help:      "Number of messages accepted by async routes that could not be sent to the Bridge, by route path.",
+		}, []string{"route"}),
+	}
+
+	metrics.Registry.MustRegister(
+		metrics.requests,
+		metrics.inFlight,
+		metrics.bodySize,
+		metrics.transformDuration,
+		metrics.transformFailures,
+		metrics.deviceIdFailures,
+		metrics.bridgeDuration,
+		metrics.rateLimits,
+		metrics.duplicates,
+		metrics.bridgeRetries,
+		metrics.circuitRejections,
+		metrics.asyncFailures,
+	)
+
+	return metrics
+}
+
+// RegisterQueue adds gauges reporting the state of the store-and-forward queue.
+func (metrics *Metrics) RegisterQueue(queue *MessageQueue) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.Registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Number of messages waiting in the store-and-forward queue.",
+		}, func() float64 { return float64(queue.Stats().Depth) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_oldest_message_age_seconds",
+			Help:      "Age of the oldest message waiting in the store-and-forward queue.",
+		}, func() float64 { return queue.Stats().OldestMessageAgeSeconds }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_dead_letters",
+			Help:      "Number of messages in the store-and-forward dead-letter store.",
+		}, func() float64 { return float64(queue.Stats().DeadLetters) }),
+	)
+}
+
+// RegisterCircuitBreaker adds a gauge reporting the state of the Bridge circuit breaker.
+func (metrics *Metrics) RegisterCircuitBreaker(breaker *CircuitBreaker) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "bridge_circuit_state",
+		Help:      "State of the Bridge circuit breaker: 0 (closed), 1 (half-open), or 2 (open).",
+	}, func() float64 { return float64(breaker.State()) }))
+}
+
+// RegisterAsyncPool adds a gauge reporting the number of messages waiting in the queue of the async worker pool.
+func (metrics *Metrics) RegisterAsyncPool(pool *AsyncPool) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "async_queue_depth",
+		Help:      "Number of messages accepted by async routes, waiting to be sent to the Bridge.",
+	}, func() float64 { return float64(pool.Depth()) }))
+}
+
+// Handler returns the HTTP handler of the metrics endpoint (/metrics), served on the admin port.
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})
+}
+
+// instrument wraps a request handler, recording the request count, status, body size, and in-flight requests of its route.
+func (metrics *Metrics) instrument(handler func(*log.Entry, http.ResponseWriter, *http.Request)) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	if metrics == nil {
+		return handler
+	}
+
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		route := routeLabel(r)
+		inFlight := metrics.inFlight.WithLabelValues(route)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+
+		statusWriter := &LoggingResponseWriter{ResponseWriter: w}
+		handler(logger, statusWriter, r)
+
+		// Handlers that only write a body respond with an implicit 200.
+		status := statusWriter.ResponseStatus
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		metrics.requests.WithLabelValues(route, strconv.Itoa(status)).Inc()
+		metrics.bodySize.WithLabelValues(route).Observe(float64(body.count))
+	}
+}
+
+// observeTransform records the duration and outcome of a transform execution in the given language that started at the given time.
+func (metrics *Metrics) observeTransform(r *http.Request, language string, startTime time.Time, err error) {
+	if metrics == nil {
+		return
+	}
+
+	route := routeLabel(r)
+	metrics.transformDuration.WithLabelValues(route, language).Observe(time.Since(startTime).Seconds())
+	if err != nil {
+		metrics.transformFailures.WithLabelValues(route, language).Inc()
+	}
+}
+
+// deviceIdFailure records a request whose device Id couldn't be resolved.
+func (metrics *Metrics) deviceIdFailure(r *http.Request) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.deviceIdFailures.WithLabelValues(routeLabel(r)).Inc()
+}
+
+// rateLimited records a request or message rejected by the rate limit of the given scope.
+func (metrics *Metrics) rateLimited(r *http.Request, scope string) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.rateLimits.WithLabelValues(routeLabel(r), scope).Inc()
+}
+
+// duplicate records a message dropped as a duplicate.
+func (metrics *Metrics) duplicate(r *http.Request) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.duplicates.WithLabelValues(routeLabel(r)).Inc()
+}
+
+// bridgeRetry records a Bridge call retried after a transient failure.
+func (metrics *Metrics) bridgeRetry(route string) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.bridgeRetries.WithLabelValues(route).Inc()
+}
+
+// circuitRejection records a Bridge call rejected by the open circuit breaker.
+func (metrics *Metrics) circuitRejection(route string) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.circuitRejections.WithLabelValues(route).Inc()
+}
+
+// asyncFailure records a message accepted by an async route that could not be sent to the Bridge.
+func (metrics *Metrics) asyncFailure(route string) {
+	if metrics == nil {
+		return
+	}
+
+	metrics.asyncFailures.WithLabelValues(route).Inc()
+}
+
+// instrumentBridgeClient wraps a Bridge client, recording the latency and status of its SendMessage calls under the given route.
+func (metrics *Metrics) instrumentBridgeClient(route string, client BridgeClient) BridgeClient {
+	if metrics == nil {
+		return client
+	}
+
+	return &meteredBridgeClient{BridgeClient: client, metrics: metrics, route: route}
+}
+
+type meteredBridgeClient struct {
+	BridgeClient
+	metrics *Metrics
+	route   string
+}
+
+func (client *meteredBridgeClient) SendMessage(ctx context.Context, deviceID string, body *bridge.MessageBody) (autorest.Response, error) {
+	startTime := time.Now()
+	bridgeResponse, err := client.BridgeClient.SendMessage(ctx, deviceID, body)
+
+	// Calls that didn't get a response from the Bridge are recorded with status "error".
+	status := "error"
+	if bridgeResponse.Response != nil {
+		status = strconv.Itoa(bridgeResponse.StatusCode)
+	}
+
+	client.metrics.bridgeDuration.WithLabelValues(client.route, status).Observe(time.Since(startTime).Seconds())
+	return bridgeResponse, err
+}
+
+// routeLabel returns the path definition of the route that matched the request, used to label its metrics.
+func routeLabel(r *http.Request) string {
+	if currentRoute := mux.CurrentRoute(r); currentRoute != nil {
+		if template, err := currentRoute.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+
+	return ""
+}
+
+// countingReader is a request body that counts the bytes read from it.
+type countingReader struct {
+	io.ReadCloser
+	count int
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.count += n
+	return n, err
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildMetricsTestAdapter(t *testing.T) (*Adapter, *Metrics) {
+	metrics := NewMetrics()
+	adapter, err := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", Transform: "{ data: { temperature: .temp } }"},
+		{Path: "/message", DeviceIdBodyQuery: ".device", AuthHeader: "key", Transform: "{ data: (.temp / 0) }"},
+		{Path: "/{id}/cel", DeviceIdPathParam: "id", AuthHeader: "key", Transform: "{'data': {'temperature': input.temp}}", TransformLanguage: TransformLanguageCel},
+	}}, "localhost:1000", &Services{Metrics: metrics})
+
+	assert.NoError(t, err)
+	adapter.GetBridgeClient = mockGetBridgeClient
+	return adapter, metrics
+}
+
+func TestMetricsRequests(t *testing.T) {
+	adapter, metrics := buildMetricsTestAdapter(t)
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/test_device/message", `{"temp": 21}`).Code)
+	assert.Equal(t, 400, sendTestMessage(adapter.Router, "/test_device/message", `{"temp"`).Code)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.requests.WithLabelValues("/{id}/message", "200")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.requests.WithLabelValues("/{id}/message", "400")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.inFlight.WithLabelValues("/{id}/message")))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.bodySize))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.transformDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.bridgeDuration))
+}
+
+func TestMetricsFailures(t *testing.T) {
+	adapter, metrics := buildMetricsTestAdapter(t)
+	assert.Equal(t, 400, sendTestMessage(adapter.Router, "/message", `{"temp": 21}`).Code)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.transformFailures.WithLabelValues("/message", "jq")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.deviceIdFailures.WithLabelValues("/message")))
+}
+
+func TestMetricsTransformLanguage(t *testing.T) {
+	adapter, metrics := buildMetricsTestAdapter(t)
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/test_device/message", `{"temp": 21}`).Code)
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/test_device/cel", `{"temp": 21}`).Code)
+
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics.transformDuration))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.transformFailures.WithLabelValues("/{id}/cel", "cel")))
+}
+
+func TestMetricsDeviceIdFailures(t *testing.T) {
+	metrics := NewMetrics()
+	adapter, _ := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+		{Path: "/message", DeviceIdBodyQuery: ".device", AuthHeader: "key"},
+	}}, "localhost:1000", &Services{Metrics: metrics})
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	assert.Equal(t, 400, sendTestMessage(adapter.Router, "/message", `{"temp": 21}`).Code)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.deviceIdFailures.WithLabelValues("/message")))
+}
+
+func TestMetricsBridgeStatus(t *testing.T) {
+	metrics := NewMetrics()
+	client := metrics.instrumentBridgeClient("/message", &BridgeWithBrokenSend{err: errors.New("throttled"), respose: autorest.Response{Response: &http.Response{StatusCode: 429}}})
+	client.SendMessage(context.Background(), "my-device", nil)
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.bridgeDuration, "transform_adapter_bridge_send_message_duration_seconds"))
+
+	client = metrics.instrumentBridgeClient("/message", &BridgeWithBrokenSend{err: errors.New("unreachable")})
+	client.SendMessage(context.Background(), "my-device", nil)
+	assert.Equal(t, 2, testutil.CollectAndCount(metrics.bridgeDuration))
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	var metrics *Metrics
+	client := &BridgeClientMock{}
+	assert.True(t, metrics.instrumentBridgeClient("/message", client) == BridgeClient(client))
+	metrics.deviceIdFailure(nil)
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	log "github.com/sirupsen/logrus"
+)
+
+// Internal headers through which MQTT publishes are passed to the route handlers. They can't be set by HTTP clients,
+// since topic routes are only registered in the MQTT router.
+const (
+	mqttApiKeyHeader   = "Mqtt-Password"
+	mqttClientIdHeader = "Mqtt-Client-Id"
+	mqttUsernameHeader = "Mqtt-Username"
+)
+
+// mqttTopicPath converts an MQTT topic route into the path under which it's registered in the MQTT router.
+// Topic levels map onto path segments, so {param} levels match any single topic level, like the + wildcard.
+func mqttTopicPath(topic string) string {
+	return "/" + topic
+}
+
+// MqttIngress is an embedded MQTT broker that feeds messages published to topic routes through the same
+// transform pipeline as HTTP requests. The MQTT password of the publishing client is used as the Bridge API key.
+// The broker only ingests messages: clients can't subscribe, so messages are never relayed to other clients.
+type MqttIngress struct {
+	server *mqtt.Server
+}
+
+// NewMqttIngress creates an MQTT broker listening on the given TCP address, serving publishes with the active adapter.
+func NewMqttIngress(address string, handler *ReloadableHandler) (*MqttIngress, error) {
+	server := mqtt.New(&mqtt.Options{
+		Logger: slog.New(slog.NewJSONHandler(log.StandardLogger().Out, &slog.HandlerOptions{Level: slog.LevelWarn})),
+	})
+
+	if err := server.AddHook(&mqttIngressHook{handler: handler}, nil); err != nil {
+		return nil, err
+	}
+
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: address})); err != nil {
+		return nil, err
+	}
+
+	return &MqttIngress{server: server}, nil
+}
+
+// Serve starts accepting MQTT connections in the background.
+func (ingress *MqttIngress) Serve() error {
+	return ingress.server.Serve()
+}
+
+// Close disconnects all clients and stops the broker.
+func (ingress *MqttIngress) Close() error {
+	return ingress.server.Close()
+}
+
+// mqttIngressHook accepts connections with a password, remembering it, and routes publishes to the active adapter.
+// Subscriptions are denied, and publishes that fail or don't match a topic route are dropped.
+type mqttIngressHook struct {
+	mqtt.HookBase
+	handler   *ReloadableHandler
+	passwords sync.Map // *mqtt.Client -> []byte
+}
+
+func (hook *mqttIngressHook) ID() string {
+	return "transform-adapter"
+}
+
+func (hook *mqttIngressHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{mqtt.OnConnectAuthenticate, mqtt.OnACLCheck, mqtt.OnDisconnect, mqtt.OnPublish}, []byte{b})
+}
+
+// OnConnectAuthenticate rejects anonymous clients. The password is the API key of the client, which is checked by the Bridge
+// (or against the device key table, if the adapter manages the Bridge API key) for each published message.
+func (hook *mqttIngressHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pk.Connect.PasswordFlag || len(pk.Connect.Password) == 0 {
+		return false
+	}
+
+	hook.passwords.Store(cl, pk.Connect.Password)
+	return true
+}
+
+// OnACLCheck allows clients to publish, and denies all subscriptions, since messages may carry the credentials of devices.
+func (hook *mqttIngressHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return write
+}
+
+func (hook *mqttIngressHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	hook.passwords.Delete(cl)
+}
+
+// OnPublish serves a publish through the matching topic route. The response status is mapped onto the reason code of the
+// PUBACK, which is only sent for QoS 1 and 2 publishes of MQTT 5 clients. Failed publishes of other clients are rejected,
+// so the broker drops them instead of acknowledging them. Messages are never retained.
+func (hook *mqttIngressHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	pk.FixedHeader.Retain = false
+	adapter, release := hook.handler.Acquire()
+	defer release()
+	if adapter == nil {
+		return pk, mqttPublishError(cl, pk, packets.ErrServerUnavailable)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, mqttTopicPath(pk.TopicName), io.NopCloser(bytes.NewReader(pk.Payload)))
+	if err != nil {
+		return pk, mqttPublishError(cl, pk, packets.ErrTopicNameInvalid)
+	}
+
+	var match mux.RouteMatch
+	if !adapter.MqttRouter.Match(req, &match) {
+		return pk, mqttPublishError(cl, pk, packets.ErrTopicNameInvalid)
+	}
+
+	password, _ := hook.passwords.Load(cl)
+	if password != nil {
+		req.Header.Set(mqttApiKeyHeader, string(password.([]byte)))
+	}
+
+	req.Header.Set(mqttClientIdHeader, cl.ID)
+	req.Header.Set(mqttUsernameHeader, string(cl.Properties.Username))
+	if pk.Properties.ContentType != "" {
+		req.Header.Set("Content-Type", pk.Properties.ContentType)
+	}
+
+	response := newBufferedResponseWriter()
+	adapter.MqttRouter.ServeHTTP(response, req)
+	if code := mqttReasonCode(response.status); code != nil {
+		return pk, mqttPublishError(cl, pk, *code)
+	}
+
+	return pk, nil
+}
+
+// mqttPublishError returns the error through which OnPublish fails a publish. The broker only reports reason codes in the
+// PUBACK of QoS 1 and 2 publishes of MQTT 5 clients, and otherwise goes on to deliver the publish, so other publishes are
+// rejected instead.
+func mqttPublishError(cl *mqtt.Client, pk packets.Packet, code packets.Code) error {
+	if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+		return code
+	}
+
+	return packets.ErrRejectPacket
+}
+
+// mqttReasonCode maps the response status of a route handler onto an MQTT reason code. Returns nil on success.
+func mqttReasonCode(status int) *packets.Code {
+	var code packets.Code
+	switch {
+	case status == 0 || (status >= 200 && status < 300):
+		return nil
+	case status == http.StatusBadRequest:
+		code = packets.ErrPayloadFormatInvalid
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		code = packets.ErrNotAuthorized
+	case status == http.StatusTooManyRequests:
+		code = packets.ErrQuotaExceeded
+	case status == http.StatusServiceUnavailable:
+		code = packets.ErrServerBusy
+	default:
+		code = packets.ErrUnspecifiedError
+	}
+
+	return &code
+}
@@ -0,0 +1,301 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMqttClient is a minimal MQTT 5 (or 3.1.1) client that publishes with QoS 1 and waits for the PUBACK.
+type testMqttClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	version byte
+}
+
+// mqttPublishedRecorder is a broker hook that records the topics of the publishes delivered to subscribers.
+type mqttPublishedRecorder struct {
+	mqtt.HookBase
+	mutex  sync.Mutex
+	topics []string
+}
+
+func (hook *mqttPublishedRecorder) ID() string {
+	return "published-recorder"
+}
+
+func (hook *mqttPublishedRecorder) Provides(b byte) bool {
+	return b == mqtt.OnPublished
+}
+
+func (hook *mqttPublishedRecorder) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	hook.topics = append(hook.topics, pk.TopicName)
+}
+
+func (hook *mqttPublishedRecorder) Topics() []string {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	return hook.topics
+}
+
+// startTestMqttIngress starts an in-process broker on a free local port, serving the given adapter.
+func startTestMqttIngress(t *testing.T, adapter *Adapter) string {
+	_, address := startTestMqttIngressWithHook(t, adapter, nil)
+	return address
+}
+
+// startTestMqttIngressWithHook starts an in-process broker with an additional hook, if not nil, returning the broker and its address.
+func startTestMqttIngressWithHook(t *testing.T, adapter *Adapter, hook mqtt.Hook) (*MqttIngress, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	handler := &ReloadableHandler{}
+	handler.Swap(adapter)
+	ingress, err := NewMqttIngress(address, handler)
+	require.NoError(t, err)
+	if hook != nil {
+		require.NoError(t, ingress.server.AddHook(hook, nil))
+	}
+
+	require.NoError(t, ingress.Serve())
+	t.Cleanup(func() { ingress.Close() })
+	return ingress, address
+}
+
+func connectTestMqttClient(t *testing.T, address string, password string) *testMqttClient {
+	client, code := dialTestMqttClient(t, address, 5, password)
+	require.Equal(t, packets.CodeSuccess.Code, code)
+	return client
+}
+
+// dialTestMqttClient connects a client of the given protocol version (4 for MQTT 3.1.1, 5 for MQTT 5), returning the reason
+// code of its CONNACK.
+func dialTestMqttClient(t *testing.T, address string, version byte, password string) (*testMqttClient, byte) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	connect := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: version,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			ClientIdentifier: "test-client",
+			Clean:            true,
+			Keepalive:        30,
+			UsernameFlag:     true,
+			Username:         []byte("test-user"),
+			PasswordFlag:     password != "",
+			Password:         []byte(password),
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, connect.ConnectEncode(&buf))
+	_, err = conn.Write(buf.Bytes())
+	require.NoError(t, err)
+
+	client := &testMqttClient{conn: conn, reader: bufio.NewReader(conn), version: version}
+	connack := client.readPacket(t)
+	require.Equal(t, packets.Connack, connack.FixedHeader.Type)
+	require.NoError(t, connack.ConnackDecode(connack.Payload))
+	return client, connack.ReasonCode
+}
+
+// publish sends a QoS 1 publish, returning the reason code of its PUBACK.
+func (client *testMqttClient) publish(t *testing.T, topic string, payload string) byte {
+	client.writePublish(t, packets.FixedHeader{Type: packets.Publish, Qos: 1}, topic, payload)
+	puback := client.readPacket(t)
+	require.Equal(t, packets.Puback, puback.FixedHeader.Type)
+	require.NoError(t, puback.PubackDecode(puback.Payload))
+	return puback.ReasonCode
+}
+
+// publishRetained sends a retained QoS 0 publish, which isn't acknowledged, and waits until the broker processed it.
+func (client *testMqttClient) publishRetained(t *testing.T, topic string, payload string) {
+	client.writePublish(t, packets.FixedHeader{Type: packets.Publish, Retain: true}, topic, payload)
+
+	// Packets of a client are processed in order, so the publish was processed once the ping is answered.
+	_, err := client.conn.Write([]byte{packets.Pingreq << 4, 0})
+	require.NoError(t, err)
+	require.Equal(t, packets.Pingresp, client.readPacket(t).FixedHeader.Type)
+}
+
+func (client *testMqttClient) writePublish(t *testing.T, header packets.FixedHeader, topic string, payload string) {
+	publish := packets.Packet{FixedHeader: header, ProtocolVersion: client.version, TopicName: topic, Payload: []byte(payload)}
+	if header.Qos > 0 {
+		publish.PacketID = 1
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, publish.PublishEncode(&buf))
+	_, err := client.conn.Write(buf.Bytes())
+	require.NoError(t, err)
+}
+
+// subscribe subscribes to a topic filter, returning the reason code of its SUBACK.
+func (client *testMqttClient) subscribe(t *testing.T, filter string) byte {
+	subscribe := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		ProtocolVersion: client.version,
+		PacketID:        2,
+		Filters:         packets.Subscriptions{{Filter: filter}},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, subscribe.SubscribeEncode(&buf))
+	_, err := client.conn.Write(buf.Bytes())
+	require.NoError(t, err)
+
+	suback := client.readPacket(t)
+	require.Equal(t, packets.Suback, suback.FixedHeader.Type)
+	require.NoError(t, suback.SubackDecode(suback.Payload))
+	require.Len(t, suback.ReasonCodes, 1)
+	return suback.ReasonCodes[0]
+}
+
+// readPacket reads the next control packet, leaving its variable header and payload undecoded in the Payload field.
+func (client *testMqttClient) readPacket(t *testing.T) packets.Packet {
+	header, err := client.reader.ReadByte()
+	require.NoError(t, err)
+	pk := packets.Packet{ProtocolVersion: client.version}
+	require.NoError(t, pk.FixedHeader.Decode(header))
+
+	length, multiplier := 0, 1
+	for {
+		b, err := client.reader.ReadByte()
+		require.NoError(t, err)
+		length += int(b&127) * multiplier
+		multiplier *= 128
+		if b&128 == 0 {
+			break
+		}
+	}
+
+	pk.FixedHeader.Remaining = length
+	pk.Payload = make([]byte, length)
+	_, err = io.ReadFull(client.reader, pk.Payload)
+	require.NoError(t, err)
+	return pk
+}
+
+func TestMqttIngress(t *testing.T) {
+	client := &BridgeClientMock{}
+	adapter, err := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Topic: "devices/{id}/telemetry", DeviceIdPathParam: "id", Transform: "{ data: { temperature: .temp } }"},
+	}}, "localhost:1000")
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+	mqttClient := connectTestMqttClient(t, startTestMqttIngress(t, adapter), "my_key")
+
+	assert.Equal(t, packets.CodeSuccess.Code, mqttClient.publish(t, "devices/my-device/telemetry", `{"temp": 21}`))
+	assert.Equal(t, "my-device", client.LastSendMessageDeviceId)
+	assert.Equal(t, float64(21), client.LastSendMessageBody.Data["temperature"])
+	assert.Equal(t, autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"x-api-key": "my_key"}), client.LastAuthorizer)
+
+	// Malformed payloads are rejected with an MQTT 5 reason code.
+	assert.Equal(t, packets.ErrPayloadFormatInvalid.Code, mqttClient.publish(t, "devices/my-device/telemetry", `{"temp"`))
+
+	// Topics without a route are rejected.
+	client.LastSendMessageDeviceId = ""
+	assert.Equal(t, packets.ErrTopicNameInvalid.Code, mqttClient.publish(t, "devices/my-device/other", `{"temp": 21}`))
+	assert.Empty(t, client.LastSendMessageDeviceId)
+}
+
+func TestMqttIngressRejectsAnonymousClients(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Topic: "devices/{id}/telemetry", DeviceIdPathParam: "id"},
+	}}, "localhost:1000")
+
+	_, code := dialTestMqttClient(t, startTestMqttIngress(t, adapter), 5, "")
+	assert.Equal(t, packets.ErrBadUsernameOrPassword.Code, code)
+}
+
+func TestMqttIngressDeniesSubscriptions(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Topic: "devices/{id}/telemetry", DeviceIdPathParam: "id"},
+	}}, "localhost:1000")
+
+	address := startTestMqttIngress(t, adapter)
+	assert.Equal(t, packets.ErrNotAuthorized.Code, connectTestMqttClient(t, address, "my_key").subscribe(t, "#"))
+
+	v3Client, code := dialTestMqttClient(t, address, 4, "my_key")
+	require.Equal(t, packets.CodeSuccess.Code, code)
+	assert.Equal(t, packets.ErrUnspecifiedError.Code, v3Client.subscribe(t, "devices/+/telemetry"))
+}
+
+// MQTT 3.1.1 clients get no reason codes, so failed publishes must be dropped by the broker instead of delivered.
+func TestMqttIngressDropsFailedPublishes(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Topic: "devices/{id}/telemetry", DeviceIdPathParam: "id"},
+	}}, "localhost:1000")
+
+	recorder := &BridgeClientRecorder{FailingDevices: map[string]int{"failing-device": 401}}
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+
+	published := &mqttPublishedRecorder{}
+	ingress, address := startTestMqttIngressWithHook(t, adapter, published)
+	client, code := dialTestMqttClient(t, address, 4, "my_key")
+	require.Equal(t, packets.CodeSuccess.Code, code)
+
+	client.publishRetained(t, "devices/failing-device/telemetry", `{"temp": 21}`)
+	client.publishRetained(t, "devices/my-device/other", `{"temp": 21}`)
+	assert.Empty(t, published.Topics())
+	assert.Empty(t, ingress.server.Topics.Messages("devices/failing-device/telemetry"))
+	assert.Empty(t, ingress.server.Topics.Messages("devices/my-device/other"))
+
+	// Successful publishes go on, but aren't retained either.
+	client.publishRetained(t, "devices/my-device/telemetry", `{"temp": 21}`)
+	assert.Equal(t, []string{"devices/my-device/telemetry"}, published.Topics())
+	assert.Empty(t, ingress.server.Topics.Messages("devices/my-device/telemetry"))
+}
+
+func TestMqttIngressBridgeFailure(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Topic: "devices/{id}/telemetry", DeviceIdPathParam: "id"},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = func() BridgeClient {
+		return &BridgeWithBrokenSend{err: errors.New("unauthorized"), respose: autorest.Response{Response: &http.Response{StatusCode: 401}}}
+	}
+
+	mqttClient := connectTestMqttClient(t, startTestMqttIngress(t, adapter), "wrong_key")
+	assert.Equal(t, packets.ErrNotAuthorized.Code, mqttClient.publish(t, "devices/my-device/telemetry", `{"temp": 21}`))
+}
+
+func TestMqttTopicRoutesNotReachableThroughHttp(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Topic: "devices/{id}/telemetry", DeviceIdPathParam: "id"},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	assert.Equal(t, 404, sendTestMessage(adapter.Router, "/devices/my-device/telemetry", `{"temp": 21}`).Code)
+}
+
+func TestMqttReasonCode(t *testing.T) {
+	assert.Nil(t, mqttReasonCode(200))
+	assert.Nil(t, mqttReasonCode(202))
+	assert.Equal(t, packets.ErrQuotaExceeded, *mqttReasonCode(429))
+	assert.Equal(t, packets.ErrServerBusy, *mqttReasonCode(503))
+	assert.Equal(t, packets.ErrUnspecifiedError, *mqttReasonCode(500))
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+// Presets of routes receiving the webhooks of LoRaWAN network servers.
+const (
+	PresetTtnV3Uplink        = "ttn-v3-uplink"
+	PresetChirpStackV4Uplink = "chirpstack-v4-uplink"
+)
+
+// Preset supplies the route parameters needed to receive the webhooks of a well-known service. Parameters defined by the route
+// take precedence over the ones of its preset.
+type Preset struct {
+	Transform         string // jq query mapping the webhook body into a telemetry body, including its creation time
+	DeviceIdBodyQuery string // jq query picking the device Id from the webhook body
+}
+
+// presets are the built-in route presets, by name. Telemetry comes from the payload decoded by the network server, and the
+// LoRaWAN metadata (device EUI, frame port and counter, and the gateway with the strongest signal) is sent as message properties.
+var presets = map[string]Preset{
+	// Uplink messages of The Things Stack (The Things Network v3) webhooks.
+	PresetTtnV3Uplink: {
+		Transform: `(.uplink_message.rx_metadata // [] | max_by(.rssi // .channel_rssi)) as $gateway
+| {
+	data: (.uplink_message.decoded_payload // {}),
+	properties: ({
+		devEui: .end_device_ids.dev_eui,
+		applicationId: .end_device_ids.application_ids.application_id,
+		fPort: .uplink_message.f_port,
+		fCnt: .uplink_message.f_cnt,
+		gatewayId: $gateway.gateway_ids.gateway_id,
+		rssi: ($gateway.rssi // $gateway.channel_rssi),
+		snr: $gateway.snr
+	} | with_entries(select(.value != null) | .value |= tostring)),
+	creationTimeUtc: (.uplink_message.received_at // .received_at)
+}`,
+		DeviceIdBodyQuery: ".end_device_ids.device_id",
+	},
+	// Uplink events of ChirpStack v4 HTTP integrations, with the JSON encoding. The integration posts all events to the same URL,
+	// with the type of event in the event query parameter, so other events are rejected.
+	PresetChirpStackV4Uplink: {
+		Transform: `if ($query.event // "up") != "up" then error("expected an uplink event, got: \($query.event)") else . end
+| (.rxInfo // [] | max_by(.rssi)) as $gateway
+| {
+	data: (.object // {}),
+	properties: ({
+		devEui: .deviceInfo.devEui,
+		applicationId: .deviceInfo.applicationId,
+		fPort: .fPort,
+		fCnt: .fCnt,
+		gatewayId: $gateway.gatewayId,
+		rssi: $gateway.rssi,
+		snr: $gateway.snr
+	} | with_entries(select(.value != null) | .value |= tostring)),
+	creationTimeUtc: .time
+}`,
+		DeviceIdBodyQuery: ".deviceInfo.devEui",
+	},
+}
+
+// applyPresets fills the parameters of D2C message routes with the ones of their preset, unless the route defines them. The
+// transform of the preset is used if the route doesn't define any transform, and its device Id query if the route doesn't define
+// where the device Id comes from. Unknown presets, and routes in another language than jq without a transform, are left for
+// validation to report.
+func (config *ConfigRaw) applyPresets() {
+	for i := range config.D2CMessages {
+		message := &config.D2CMessages[i]
+		preset, ok := presets[message.Preset]
+		if !ok {
+			continue
+		}
+
+		if !definesTransform(message) && (message.TransformLanguage == "" || message.TransformLanguage == TransformLanguageJq) {
+			message.Transform = preset.Transform
+		}
+
+		if message.DeviceIdPathParam == "" && message.DeviceIdBodyQuery == "" {
+			message.DeviceIdBodyQuery = preset.DeviceIdBodyQuery
+		}
+	}
+}
+
+// definesTransform returns whether a route defines its own transform, replacing the one of its preset.
+func definesTransform(message *D2CMessageRaw) bool {
+	return message.Transform != "" || message.TransformFile != "" || message.TransformWasm != ""
+}
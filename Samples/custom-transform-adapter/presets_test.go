@@ -0,0 +1,167 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildPresetTestAdapter loads a config with the given D2C message routes, with presets applied as in config files.
+func buildPresetTestAdapter(t *testing.T, recorder *BridgeClientRecorder, messages ...D2CMessageRaw) *Adapter {
+	configRaw := &ConfigRaw{D2CMessages: messages}
+	configRaw.applyPresets()
+	require.NoError(t, validate(configRaw))
+
+	d2cMessages, err := processD2CMessages("", configRaw.D2CMessages)
+	require.NoError(t, err)
+
+	adapter, err := NewAdapter(&Config{D2CMessages: d2cMessages}, "localhost:1000")
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+	return adapter
+}
+
+// sendPresetFixture sends the content of a webhook fixture to a route, returning the message forwarded for the given device.
+func sendPresetFixture(t *testing.T, adapter *Adapter, recorder *BridgeClientRecorder, path string, fixture string, deviceId string) *bridge.MessageBody {
+	body, err := os.ReadFile(fixture)
+	require.NoError(t, err)
+
+	response := sendTestMessage(adapter.Router, path, string(body))
+	require.Equal(t, 200, response.Code, response.Body.String())
+	require.Len(t, recorder.Messages[deviceId], 1)
+	return recorder.Messages[deviceId][0]
+}
+
+func messageProperties(message *bridge.MessageBody) map[string]string {
+	properties := make(map[string]string, len(message.Properties))
+	for name, value := range message.Properties {
+		properties[name] = *value
+	}
+
+	return properties
+}
+
+// The fixture follows the uplink message sample of The Things Stack documentation, received by two gateways.
+func TestPresetTtnV3Uplink(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter := buildPresetTestAdapter(t, recorder, D2CMessageRaw{Path: "/ttn", Preset: PresetTtnV3Uplink, AuthHeader: "key"})
+	message := sendPresetFixture(t, adapter, recorder, "/ttn", "ttn_v3_uplink_mock.json", "eui-0004a30b001c0530")
+
+	assert.Equal(t, map[string]interface{}{"batteryVoltage": 3.6, "humidity": 59.5, "temperature": 21.5}, message.Data)
+	assert.Equal(t, map[string]string{
+		"devEui":        "0004A30B001C0530",
+		"applicationId": "greenhouse-sensors",
+		"fPort":         "2",
+		"fCnt":          "1384",
+		"gatewayId":     "rooftop-gateway",
+		"rssi":          "-64",
+		"snr":           "9.5",
+	}, messageProperties(message))
+
+	require.NotNil(t, message.CreationTimeUtc)
+	assert.True(t, time.Date(2022, 12, 7, 10, 15, 8, 949437924, time.UTC).Equal(message.CreationTimeUtc.Time))
+}
+
+// The fixture follows the uplink event sample of the ChirpStack v4 documentation, with the object decoded by a device profile codec.
+func TestPresetChirpStackV4Uplink(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter := buildPresetTestAdapter(t, recorder, D2CMessageRaw{Path: "/chirpstack", Preset: PresetChirpStackV4Uplink, AuthHeader: "key"})
+	message := sendPresetFixture(t, adapter, recorder, "/chirpstack", "chirpstack_v4_uplink_mock.json", "0101010101010101")
+
+	assert.Equal(t, map[string]interface{}{"humidity": 59.5, "temperature": 21.5}, message.Data)
+	assert.Equal(t, map[string]string{
+		"devEui":        "0101010101010101",
+		"applicationId": "17c82e96-be03-4f38-aef3-f83d48582d97",
+		"fPort":         "1",
+		"fCnt":          "10",
+		"gatewayId":     "0016c001f153a14c",
+		"rssi":          "-36",
+		"snr":           "10.5",
+	}, messageProperties(message))
+
+	require.NotNil(t, message.CreationTimeUtc)
+	assert.True(t, time.Date(2022, 7, 18, 9, 34, 15, 775023242, time.UTC).Equal(message.CreationTimeUtc.Time))
+
+	// The integration posts all events to the same URL.
+	response := sendTestMessage(adapter.Router, "/chirpstack?event=join", `{"deviceInfo": {"devEui": "0101010101010101"}, "devAddr": "00189440"}`)
+	assert.Equal(t, 400, response.Code)
+	assert.Contains(t, response.Body.String(), "expected an uplink event, got: join")
+	assert.Len(t, recorder.Messages["0101010101010101"], 1)
+}
+
+func TestPresetOverrides(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter := buildPresetTestAdapter(t, recorder, D2CMessageRaw{
+		Path:              "/{id}/ttn",
+		Preset:            PresetTtnV3Uplink,
+		AuthHeader:        "key",
+		DeviceIdPathParam: "id",
+		Transform:         ".uplink_message.frm_payload | frombase64bytes | { data: { temperature: (readint16be(0) / 100) } }",
+	})
+
+	message := sendPresetFixture(t, adapter, recorder, "/my-device/ttn", "ttn_v3_uplink_mock.json", "my-device")
+	assert.Equal(t, map[string]interface{}{"temperature": 21.5}, message.Data)
+	assert.Nil(t, message.CreationTimeUtc)
+}
+
+func TestPresetWithoutDecodedPayload(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter := buildPresetTestAdapter(t, recorder, D2CMessageRaw{Path: "/ttn", Preset: PresetTtnV3Uplink, AuthHeader: "key"})
+
+	response := sendTestMessage(adapter.Router, "/ttn", `{"end_device_ids": {"device_id": "device"}, "uplink_message": {"f_port": 1, "frm_payload": "AQ=="}}`)
+	assert.Equal(t, 200, response.Code)
+	require.Len(t, recorder.Messages["device"], 1)
+	assert.Equal(t, map[string]interface{}{}, recorder.Messages["device"][0].Data)
+	assert.Equal(t, map[string]string{"fPort": "1"}, messageProperties(recorder.Messages["device"][0]))
+}
+
+func TestValidatePreset(t *testing.T) {
+	err := validate(&ConfigRaw{D2CMessages: []D2CMessageRaw{{Path: "/message", AuthHeader: "key", Preset: "lorawan"}}})
+	assert.EqualError(t, err, "transform-adapter: preset must be either ttn-v3-uplink or chirpstack-v4-uplink in D2C message definition /message")
+
+	err = validate(&ConfigRaw{ReportedProperties: []D2CMessageRaw{{Path: "/properties", AuthHeader: "key", Preset: PresetTtnV3Uplink}}})
+	assert.EqualError(t, err, "transform-adapter: preset may only be defined in D2C message definitions, found in reported properties definition /properties")
+}
+
+func TestLoadConfigWithPreset(t *testing.T) {
+	configPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(configPath, "config.json"), []byte(`{
+		"d2cMessages": [{ "path": "/ttn", "preset": "ttn-v3-uplink", "authHeader": "key" }]
+	}`), 0644))
+
+	config, err := LoadConfig(configPath, "config.json")
+	require.NoError(t, err)
+	assert.Equal(t, presets[PresetTtnV3Uplink].Transform, config.D2CMessages[0].Transform)
+	assert.Equal(t, ".end_device_ids.device_id", config.D2CMessages[0].DeviceIdBodyQuery)
+}
+
+func TestLoadConfigWithPresetTransformLanguage(t *testing.T) {
+	configPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(configPath, "config.json"), []byte(`{
+		"d2cMessages": [{ "path": "/ttn", "preset": "ttn-v3-uplink", "authHeader": "key", "transformLanguage": "cel" }]
+	}`), 0644))
+
+	// The jq transform of the preset can't be run as CEL.
+	_, err := LoadConfig(configPath, "config.json")
+	assert.EqualError(t, err, "transform-adapter: transformLanguage cel requires a transform or transformFile, since the transform of preset ttn-v3-uplink is written in jq, in D2C message definition /ttn")
+
+	require.NoError(t, os.WriteFile(filepath.Join(configPath, "config.json"), []byte(`{
+		"d2cMessages": [
+			{ "path": "/ttn", "preset": "ttn-v3-uplink", "authHeader": "key", "transformLanguage": "cel", "transform": "{'data': input.uplink_message.decoded_payload}" },
+			{ "path": "/chirpstack", "preset": "chirpstack-v4-uplink", "authHeader": "key", "transformLanguage": "jq" }
+		]
+	}`), 0644))
+
+	config, err := LoadConfig(configPath, "config.json")
+	require.NoError(t, err)
+	assert.Equal(t, "{'data': input.uplink_message.decoded_payload}", config.D2CMessages[0].Transform)
+	assert.Equal(t, ".end_device_ids.device_id", config.D2CMessages[0].DeviceIdBodyQuery)
+	assert.Equal(t, presets[PresetChirpStackV4Uplink].Transform, config.D2CMessages[1].Transform)
+}
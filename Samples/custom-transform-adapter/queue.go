@@ -0,0 +1,540 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	queueFileName          = "queue.db"
+	defaultQueueMaxSize    = 100000
+	defaultQueueTTL        = 24 * time.Hour
+	queueBatchSize         = 100
+	queuePollInterval      = time.Second
+	queueMinRetryDelay     = time.Second
+	queueMaxRetryDelay     = 5 * time.Minute
+	queueSendTimeout       = 30 * time.Second
+	queueMessagesBucket    = "messages"
+	queueDeadLettersBucket = "dead-letters"
+)
+
+// ErrQueueFull is returned when a message is enqueued in a queue that reached its maximum size.
+var ErrQueueFull = errors.New("transform-adapter: store-and-forward queue is full")
+
+// QueuedMessage is a message stored in the queue, waiting to be forwarded to the Bridge.
+type QueuedMessage struct {
+	Route      string              `json:"route"` // Path definition of the route that received the message
+	DeviceId   string              `json:"deviceId"`
+	ApiKey     string              `json:"apiKey"`
+	Body       *bridge.MessageBody `json:"body"`
+	EnqueuedAt time.Time           `json:"enqueuedAt"`
+
+	// W3C trace context of the request that enqueued the message, so forwarding it continues the same trace.
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+}
+
+// DeadLetter is a message that could not be forwarded to the Bridge, along with the reason why.
+type DeadLetter struct {
+	Message        QueuedMessage `json:"message"`
+	Reason         string        `json:"reason"`
+	DeadLetteredAt time.Time     `json:"deadLetteredAt"`
+}
+
+// QueueStats describes the current state of the queue.
+type QueueStats struct {
+	Depth                   int     `json:"depth"`
+	OldestMessageAgeSeconds float64 `json:"oldestMessageAgeSeconds"`
+	DeadLetters             int     `json:"deadLetters"`
+}
+
+// QueueSendFunc forwards a message to the Bridge, returning the Bridge status code if a response was received.
+type QueueSendFunc func(ctx context.Context, message *QueuedMessage) (int, error)
+
+// MessageQueue is a durable on-disk queue of messages to be forwarded to the Bridge. Messages are forwarded in order
+// for each device. If forwarding a message fails with a transient error, the device is retried with exponential backoff,
+// without blocking other devices. Messages that fail permanently or expire are moved to a dead-letter store.
+type MessageQueue struct {
+	db      *bolt.DB
+	send    QueueSendFunc
+	maxSize int
+	ttl     time.Duration
+	wake    chan struct{}
+
+	// The mutex guards the counters and backoffs below. It's never held while waiting for a storage transaction, since
+	// transactions wait for each other.
+	mutex       sync.Mutex
+	depth       int
+	reserved    int // Messages being enqueued, counted against the maximum size until they're stored
+	deadLetters int
+	backoffs    map[string]*deviceBackoff // Retry state of devices whose last message failed with a transient error
+}
+
+type deviceBackoff struct {
+	attempts  int
+	nextRetry time.Time
+}
+
+// NewMessageQueue opens (or creates) the queue stored in the given directory. A zero max size or TTL uses the default value.
+func NewMessageQueue(dir string, maxSize int, ttl time.Duration, send QueueSendFunc) (*MessageQueue, error) {
+	if maxSize == 0 {
+		maxSize = defaultQueueMaxSize
+	}
+
+	if ttl == 0 {
+		ttl = defaultQueueTTL
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, queueFileName), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("transform-adapter: failed to open store-and-forward queue: %w", err)
+	}
+
+	queue := &MessageQueue{
+		db:       db,
+		send:     send,
+		maxSize:  maxSize,
+		ttl:      ttl,
+		wake:     make(chan struct{}, 1),
+		backoffs: make(map[string]*deviceBackoff),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		messages, err := tx.CreateBucketIfNotExists([]byte(queueMessagesBucket))
+		if err != nil {
+			return err
+		}
+
+		deadLetters, err := tx.CreateBucketIfNotExists([]byte(queueDeadLettersBucket))
+		if err != nil {
+			return err
+		}
+
+		queue.depth = messages.Stats().KeyN
+		queue.deadLetters = deadLetters.Stats().KeyN
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("transform-adapter: failed to initialize store-and-forward queue: %w", err)
+	}
+
+	log.Infof("Store-and-forward queue opened with %d messages and %d dead letters", queue.depth, queue.deadLetters)
+	return queue, nil
+}
+
+// Close closes the underlying queue storage.
+func (queue *MessageQueue) Close() error {
+	return queue.db.Close()
+}
+
+// Enqueue durably stores a message to be forwarded to the Bridge. Fails with ErrQueueFull if the queue reached its maximum size.
+func (queue *MessageQueue) Enqueue(message *QueuedMessage) error {
+	value, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	queue.mutex.Lock()
+	if queue.depth+queue.reserved >= queue.maxSize {
+		queue.mutex.Unlock()
+		return ErrQueueFull
+	}
+
+	queue.reserved++
+	queue.mutex.Unlock()
+
+	err = queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(queueMessagesBucket))
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(sequenceKey(sequence), value)
+	})
+
+	queue.mutex.Lock()
+	queue.reserved--
+	if err == nil {
+		queue.depth++
+	}
+
+	queue.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Wake up the drain loop without blocking, if it isn't already awake.
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Full returns whether the queue reached its maximum size, in which case new messages are rejected.
+func (queue *MessageQueue) Full() bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.depth+queue.reserved >= queue.maxSize
+}
+
+// Stats returns the current queue depth, the age of the oldest queued message, and the number of dead letters.
+func (queue *MessageQueue) Stats() QueueStats {
+	queue.mutex.Lock()
+	stats := QueueStats{Depth: queue.depth, DeadLetters: queue.deadLetters}
+	queue.mutex.Unlock()
+
+	queue.db.View(func(tx *bolt.Tx) error {
+		if _, value := tx.Bucket([]byte(queueMessagesBucket)).Cursor().First(); value != nil {
+			var message QueuedMessage
+			if err := json.Unmarshal(value, &message); err == nil {
+				stats.OldestMessageAgeSeconds = time.Since(message.EnqueuedAt).Seconds()
+			}
+		}
+
+		return nil
+	})
+
+	return stats
+}
+
+// ServeStats is an HTTP handler that responds with the queue stats.
+func (queue *MessageQueue) ServeStats(w http.ResponseWriter, r *http.Request) {
+	respondJson(log.NewEntry(log.StandardLogger()), w, http.StatusOK, queue.Stats())
+}
+
+// Drain forwards queued messages to the Bridge until the context is canceled.
+func (queue *MessageQueue) Drain(ctx context.Context) {
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep draining while messages are being forwarded, waiting otherwise.
+		for queue.drainOnce(ctx) > 0 {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-queue.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainOnce attempts to forward a batch of queued messages, in order, skipping devices that are in backoff.
+// Returns the number of messages removed from the queue (forwarded or dead-lettered).
+func (queue *MessageQueue) drainOnce(ctx context.Context) int {
+	removed := 0
+	blockedDevices := make(map[string]bool)
+	var lastKey []byte
+
+	for ctx.Err() == nil {
+		keys, messages, err := queue.readBatch(lastKey)
+		if err != nil {
+			log.WithField("error", err).Errorf("Failed to read store-and-forward queue: %s", err)
+			return removed
+		}
+
+		if len(keys) == 0 {
+			return removed
+		}
+
+		for i, message := range messages {
+			if ctx.Err() != nil {
+				return removed
+			}
+
+			// Keep messages of a device in order: once a message is skipped or fails, the remaining messages of the device wait.
+			if blockedDevices[message.DeviceId] || queue.inBackoff(message.DeviceId) {
+				blockedDevices[message.DeviceId] = true
+				continue
+			}
+
+			if time.Since(message.EnqueuedAt) > queue.ttl {
+				queue.deadLetter(keys[i], message, "message expired")
+				removed++
+				continue
+			}
+
+			if queue.forward(ctx, keys[i], message) {
+				removed++
+			} else {
+				blockedDevices[message.DeviceId] = true
+			}
+		}
+
+		lastKey = keys[len(keys)-1]
+	}
+
+	return removed
+}
+
+// forward sends a message to the Bridge, removing it from the queue on success or permanent failure.
+// Returns whether the message was removed from the queue.
+func (queue *MessageQueue) forward(ctx context.Context, key []byte, message *QueuedMessage) bool {
+	sendCtx, cancel := context.WithTimeout(ctx, queueSendTimeout)
+	defer cancel()
+
+	statusCode, err := queue.send(sendCtx, message)
+	if err == nil {
+		queue.resetBackoff(message.DeviceId)
+		queue.remove(key)
+		return true
+	}
+
+	if !isTransientStatus(statusCode) {
+		queue.resetBackoff(message.DeviceId)
+		queue.deadLetter(key, message, fmt.Sprintf("call to Device Bridge failed with status %d: %s", statusCode, err))
+		return true
+	}
+
+	delay := queue.backoff(message.DeviceId)
+	log.WithField("error", err).Warnf("Failed to forward queued message for device %s with status %d, retrying in %s: %s", message.DeviceId, statusCode, delay, err)
+	return false
+}
+
+// readBatch reads the next batch of queued messages after the given key (or from the start, if nil).
+func (queue *MessageQueue) readBatch(afterKey []byte) ([][]byte, []*QueuedMessage, error) {
+	var keys [][]byte
+	var messages []*QueuedMessage
+
+	err := queue.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(queueMessagesBucket)).Cursor()
+		key, value := cursor.First()
+		if afterKey != nil {
+			if key, value = cursor.Seek(afterKey); key != nil && string(key) == string(afterKey) {
+				key, value = cursor.Next()
+			}
+		}
+
+		for ; key != nil && len(keys) < queueBatchSize; key, value = cursor.Next() {
+			var message QueuedMessage
+			if err := json.Unmarshal(value, &message); err != nil {
+				return fmt.Errorf("malformed queued message: %w", err)
+			}
+
+			keys = append(keys, append([]byte(nil), key...))
+			messages = append(messages, &message)
+		}
+
+		return nil
+	})
+
+	return keys, messages, err
+}
+
+// remove deletes a message from the queue.
+func (queue *MessageQueue) remove(key []byte) {
+	err := queue.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(queueMessagesBucket)).Delete(key)
+	})
+
+	if err != nil {
+		log.WithField("error", err).Errorf("Failed to remove message from store-and-forward queue: %s", err)
+		return
+	}
+
+	queue.mutex.Lock()
+	queue.depth--
+	queue.mutex.Unlock()
+}
+
+// deadLetter moves a message from the queue to the dead-letter store. If the dead-letter store exceeds the maximum
+// queue size, the oldest dead letters are discarded.
+func (queue *MessageQueue) deadLetter(key []byte, message *QueuedMessage, reason string) {
+	log.Errorf("Moving queued message for device %s to dead letters: %s", message.DeviceId, reason)
+
+	value, err := json.Marshal(DeadLetter{Message: *message, Reason: reason, DeadLetteredAt: time.Now()})
+	if err != nil {
+		log.WithField("error", err).Errorf("Failed to encode dead letter: %s", err)
+		return
+	}
+
+	// Only the drain loop adds dead letters, so the count can't change before the transaction commits.
+	queue.mutex.Lock()
+	excess := queue.deadLetters + 1 - queue.maxSize
+	queue.mutex.Unlock()
+
+	discarded := 0
+	err = queue.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(queueMessagesBucket)).Delete(key); err != nil {
+			return err
+		}
+
+		deadLetters := tx.Bucket([]byte(queueDeadLettersBucket))
+		sequence, err := deadLetters.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		if err := deadLetters.Put(sequenceKey(sequence), value); err != nil {
+			return err
+		}
+
+		cursor := deadLetters.Cursor()
+		for oldest, _ := cursor.First(); oldest != nil && discarded < excess; oldest, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+
+			discarded++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithField("error", err).Errorf("Failed to move message to dead letters: %s", err)
+		return
+	}
+
+	queue.mutex.Lock()
+	queue.depth--
+	queue.deadLetters += 1 - discarded
+	queue.mutex.Unlock()
+}
+
+func (queue *MessageQueue) inBackoff(deviceId string) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	backoff, ok := queue.backoffs[deviceId]
+	return ok && time.Now().Before(backoff.nextRetry)
+}
+
+// backoff records a failed attempt for a device, returning the delay until its next retry.
+func (queue *MessageQueue) backoff(deviceId string) time.Duration {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	backoff, ok := queue.backoffs[deviceId]
+	if !ok {
+		backoff = &deviceBackoff{}
+		queue.backoffs[deviceId] = backoff
+	}
+
+	delay := queueMaxRetryDelay
+	if backoff.attempts < 20 && queueMinRetryDelay<<backoff.attempts < queueMaxRetryDelay {
+		delay = queueMinRetryDelay << backoff.attempts
+	}
+
+	backoff.attempts++
+	backoff.nextRetry = time.Now().Add(delay)
+	return delay
+}
+
+func (queue *MessageQueue) resetBackoff(deviceId string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	delete(queue.backoffs, deviceId)
+}
+
+// NewBridgeQueueSender returns a queue send function that forwards messages to the Bridge, authenticated with the API key of each message.
+// Messages queued without an API key (when the adapter manages the Bridge API key) are authenticated with bridgeApiKey.
+func NewBridgeQueueSender(getBridgeClient func() BridgeClient, bridgeApiKey string, metrics *Metrics) QueueSendFunc {
+	return func(ctx context.Context, message *QueuedMessage) (int, error) {
+		apiKey := message.ApiKey
+		if apiKey == "" {
+			apiKey = bridgeApiKey
+		}
+
+		bridgeClient := metrics.instrumentBridgeClient(message.Route, authorizeBridgeClient(getBridgeClient(), apiKey))
+		bridgeResponse, err := bridgeClient.SendMessage(extractTraceContext(ctx, message.TraceContext), message.DeviceId, message.Body)
+		if err != nil && bridgeResponse != (autorest.Response{}) {
+			return bridgeResponse.StatusCode, err
+		}
+
+		return 0, err
+	}
+}
+
+// enqueueMessage resolves the API key and device Id of a store-and-forward request and adds the message to the queue.
+// Responds with 202 once the message is durably stored, or 503 if the queue is full.
+func (adapter *Adapter) enqueueMessage(logger *log.Entry, w http.ResponseWriter, r *http.Request, message AugmentedD2CMessage, jsonBody interface{}, bridgePayload *bridge.MessageBody) {
+	apiKey, err := resolveApiKey(r, message.AuthHeader, message.AuthQueryParam)
+	if err != nil {
+		respondError(logger, w, http.StatusBadRequest, err)
+		return
+	}
+
+	deviceId, err := adapter.resolveDeviceId(r, message.DeviceIdPathParam, message.DeviceIdBodyQueryId, jsonBody)
+	if err != nil {
+		respondError(logger, w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := adapter.authorizeDevice(r, deviceId, apiKey); err != nil {
+		respondError(logger, w, requestErrorStatus(err), err)
+		return
+	}
+
+	if err := adapter.limitDevice(r, message, deviceId); err != nil {
+		respondRequestError(logger, w, err)
+		return
+	}
+
+	dedupKey, err := adapter.dedupKey(r, message, deviceId, jsonBody)
+	if err != nil {
+		respondError(logger, w, http.StatusBadRequest, err)
+		return
+	}
+
+	if adapter.reserveDedupKey(logger, dedupKey) {
+		adapter.Services.Metrics.duplicate(r)
+		logger.Infof("Dropped duplicate message for device %s", deviceId)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// The adapter-managed Bridge API key isn't stored with the message, it's provided by the sender when forwarding it.
+	if adapter.Services.BridgeApiKey != "" {
+		apiKey = ""
+	}
+
+	err = adapter.Services.Queue.Enqueue(&QueuedMessage{Route: routeLabel(r), DeviceId: deviceId, ApiKey: apiKey, Body: bridgePayload, EnqueuedAt: time.Now(), TraceContext: injectTraceContext(r.Context())})
+	if err != nil {
+		adapter.releaseDedupKey(dedupKey)
+	}
+
+	if errors.Is(err, ErrQueueFull) {
+		respondError(logger, w, http.StatusServiceUnavailable, errors.New("store-and-forward queue is full"))
+		return
+	} else if err != nil {
+		respondError(logger, w, http.StatusInternalServerError, fmt.Errorf("failed to enqueue message: %w", err))
+		return
+	}
+
+	// Once durably enqueued, the message is considered forwarded.
+	adapter.recordForwarded(logger, message, dedupKey)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// isTransientStatus returns whether a failed Bridge call with the given status code (or 0, if no response was received) should be retried.
+func isTransientStatus(statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// sequenceKey encodes a sequence number as a key that sorts in insertion order.
+func sequenceKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
@@ -0,0 +1,207 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	"github.com/stretchr/testify/assert"
+)
+
+// QueueSenderMock records the messages forwarded by a queue, failing with the configured status for some devices.
+type QueueSenderMock struct {
+	mutex        sync.Mutex
+	Sent         []*QueuedMessage
+	FailingCodes map[string]int
+}
+
+func (sender *QueueSenderMock) Send(ctx context.Context, message *QueuedMessage) (int, error) {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	if code, ok := sender.FailingCodes[message.DeviceId]; ok {
+		return code, errors.New("send failed")
+	}
+
+	sender.Sent = append(sender.Sent, message)
+	return 200, nil
+}
+
+func (sender *QueueSenderMock) SentIds() []string {
+	var ids []string
+	for _, message := range sender.Sent {
+		ids = append(ids, message.DeviceId+":"+message.Body.Data["seq"].(string))
+	}
+
+	return ids
+}
+
+func newTestQueue(t *testing.T, dir string, maxSize int, ttl time.Duration) (*MessageQueue, *QueueSenderMock) {
+	sender := &QueueSenderMock{FailingCodes: make(map[string]int)}
+	queue, err := NewMessageQueue(dir, maxSize, ttl, sender.Send)
+	assert.NoError(t, err)
+	return queue, sender
+}
+
+func enqueueTestMessage(t *testing.T, queue *MessageQueue, deviceId string, seq string) {
+	err := queue.Enqueue(&QueuedMessage{DeviceId: deviceId, ApiKey: "key", Body: &bridge.MessageBody{Data: map[string]interface{}{"seq": seq}}, EnqueuedAt: time.Now()})
+	assert.NoError(t, err)
+}
+
+func TestStoreAndForwardRoute(t *testing.T) {
+	queue, sender := newTestQueue(t, t.TempDir(), 0, 0)
+	defer queue.Close()
+
+	adapter, err := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", Transform: "{ data: { seq: .seq } }", StoreAndForward: true},
+	}}, "localhost:1000", &Services{Queue: queue})
+
+	assert.NoError(t, err)
+	recorder := sendTestMessage(adapter.Router, "/test_device/message", `{"seq": "1"}`)
+	assert.Equal(t, 202, recorder.Code)
+	assert.Equal(t, 1, queue.Stats().Depth)
+
+	assert.Equal(t, 1, queue.drainOnce(context.Background()))
+	assert.Equal(t, []string{"test_device:1"}, sender.SentIds())
+	assert.Equal(t, "test_key", sender.Sent[0].ApiKey)
+	assert.Equal(t, 0, queue.Stats().Depth)
+}
+
+func TestStoreAndForwardRouteWithoutQueue(t *testing.T) {
+	_, err := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", StoreAndForward: true},
+	}}, "localhost:1000")
+
+	assert.EqualError(t, err, "transform-adapter: route /{id}/message uses store-and-forward, but no queue is configured")
+}
+
+func TestStoreAndForwardQueueFull(t *testing.T) {
+	queue, _ := newTestQueue(t, t.TempDir(), 1, 0)
+	defer queue.Close()
+
+	adapter, _ := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", StoreAndForward: true},
+	}}, "localhost:1000", &Services{Queue: queue})
+
+	assert.Equal(t, 202, sendTestMessage(adapter.Router, "/test_device/message", `{}`).Code)
+	recorder := sendTestMessage(adapter.Router, "/test_device/message", `{}`)
+	assert.Equal(t, 503, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "store-and-forward queue is full")
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	queue, _ := newTestQueue(t, dir, 0, 0)
+	enqueueTestMessage(t, queue, "a", "1")
+	enqueueTestMessage(t, queue, "a", "2")
+	assert.NoError(t, queue.Close())
+
+	queue, sender := newTestQueue(t, dir, 0, 0)
+	defer queue.Close()
+	assert.Equal(t, 2, queue.Stats().Depth)
+	assert.Greater(t, queue.Stats().OldestMessageAgeSeconds, float64(0))
+	assert.Equal(t, 2, queue.drainOnce(context.Background()))
+	assert.Equal(t, []string{"a:1", "a:2"}, sender.SentIds())
+}
+
+func TestQueueKeepsDeviceOrderOnTransientFailure(t *testing.T) {
+	queue, sender := newTestQueue(t, t.TempDir(), 0, 0)
+	defer queue.Close()
+	enqueueTestMessage(t, queue, "a", "1")
+	enqueueTestMessage(t, queue, "b", "1")
+	enqueueTestMessage(t, queue, "a", "2")
+	enqueueTestMessage(t, queue, "b", "2")
+
+	// Messages of the failing device stay in the queue, without blocking other devices.
+	sender.FailingCodes["a"] = 503
+	assert.Equal(t, 2, queue.drainOnce(context.Background()))
+	assert.Equal(t, []string{"b:1", "b:2"}, sender.SentIds())
+	assert.Equal(t, 2, queue.Stats().Depth)
+
+	// The failing device is not retried until its backoff expires.
+	delete(sender.FailingCodes, "a")
+	assert.Equal(t, 0, queue.drainOnce(context.Background()))
+	queue.backoffs["a"].nextRetry = time.Now()
+	assert.Equal(t, 2, queue.drainOnce(context.Background()))
+	assert.Equal(t, []string{"b:1", "b:2", "a:1", "a:2"}, sender.SentIds())
+}
+
+func TestQueueDeadLetters(t *testing.T) {
+	queue, sender := newTestQueue(t, t.TempDir(), 0, time.Hour)
+	defer queue.Close()
+
+	// Expired message.
+	queue.Enqueue(&QueuedMessage{DeviceId: "a", Body: &bridge.MessageBody{}, EnqueuedAt: time.Now().Add(-2 * time.Hour)})
+
+	// Permanent failure.
+	sender.FailingCodes["b"] = 400
+	enqueueTestMessage(t, queue, "b", "1")
+
+	assert.Equal(t, 2, queue.drainOnce(context.Background()))
+	assert.Empty(t, sender.Sent)
+	assert.Equal(t, QueueStats{Depth: 0, DeadLetters: 2}, queue.Stats())
+}
+
+func TestQueueDiscardsOldestDeadLetters(t *testing.T) {
+	queue, sender := newTestQueue(t, t.TempDir(), 2, 0)
+	defer queue.Close()
+	sender.FailingCodes["a"] = 404
+
+	for i := 0; i < 3; i++ {
+		enqueueTestMessage(t, queue, "a", "1")
+		queue.drainOnce(context.Background())
+	}
+
+	assert.Equal(t, 2, queue.Stats().DeadLetters)
+}
+
+// Enqueuing while the drain loop dead-letters messages must neither deadlock nor race (run with -race).
+func TestQueueConcurrentEnqueueAndDeadLetter(t *testing.T) {
+	const enqueuers, messages = 4, 800
+	queue, sender := newTestQueue(t, t.TempDir(), 0, 0)
+	sender.FailingCodes["a"] = 400
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < enqueuers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < messages/enqueuers; j++ {
+					enqueueTestMessage(t, queue, "a", "1")
+				}
+			}()
+		}
+
+		for deadLettered := 0; deadLettered < messages; {
+			deadLettered += queue.drainOnce(context.Background())
+		}
+
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		// Closing the queue would wait for the deadlocked transactions.
+		t.Fatal("enqueue and dead-lettering deadlocked")
+	}
+
+	assert.Equal(t, QueueStats{Depth: 0, DeadLetters: messages}, queue.Stats())
+	queue.Close()
+}
+
+func TestIsTransientStatus(t *testing.T) {
+	assert.True(t, isTransientStatus(0))
+	assert.True(t, isTransientStatus(429))
+	assert.True(t, isTransientStatus(503))
+	assert.False(t, isTransientStatus(400))
+	assert.False(t, isTransientStatus(401))
+}
@@ -0,0 +1,274 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRateLimitMaxDevices = 10000
+
+const (
+	rateLimitScopeRoute  = "route"
+	rateLimitScopeDevice = "device"
+)
+
+// RateLimit is a token-bucket rate limit: requests are admitted at Rate per second on average, with bursts of up to Burst requests.
+type RateLimit struct {
+	Rate       float64 // Tokens added to the bucket per second
+	Burst      int     // Capacity of the bucket
+	MaxDevices int     // Maximum number of devices whose bucket is tracked, for per-device limits
+}
+
+// RateLimitError is returned when a request exceeds the rate limit of its route or device.
+type RateLimitError struct {
+	Scope      string        // "route" or "device"
+	RetryAfter time.Duration // Time until the next request would be admitted
+}
+
+func (err *RateLimitError) Error() string {
+	return fmt.Sprintf("%s rate limit exceeded", err.Scope)
+}
+
+// tokenBucket is the state of a rate limit. Tokens are refilled lazily, when a request is admitted.
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// take admits a request if the bucket has a token left, otherwise returning the time until it does.
+func (bucket *tokenBucket) take(limit *RateLimit, now time.Time) (time.Duration, bool) {
+	if bucket.updatedAt.IsZero() {
+		bucket.tokens = float64(limit.Burst)
+	} else if elapsed := now.Sub(bucket.updatedAt).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+elapsed*limit.Rate)
+	}
+
+	bucket.updatedAt = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0, true
+	}
+
+	return time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second)), false
+}
+
+// RouteRateLimiter limits the requests of a route as a whole.
+type RouteRateLimiter struct {
+	limit  RateLimit
+	mutex  sync.Mutex
+	bucket tokenBucket
+}
+
+// NewRouteRateLimiter creates a route rate limiter. Returns nil if limit is nil, which admits all requests.
+func NewRouteRateLimiter(limit *RateLimit) *RouteRateLimiter {
+	if limit == nil {
+		return nil
+	}
+
+	return &RouteRateLimiter{limit: *limit}
+}
+
+// allow admits a request or returns a *RateLimitError.
+func (limiter *RouteRateLimiter) allow(now time.Time) error {
+	if limiter == nil {
+		return nil
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if retryAfter, ok := limiter.bucket.take(&limiter.limit, now); !ok {
+		return &RateLimitError{Scope: rateLimitScopeRoute, RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// DeviceRateLimiter limits the requests of each device of a route separately. The buckets of up to MaxDevices devices are kept
+// in memory, evicting the least recently seen devices first. An evicted device starts over with a full bucket, so MaxDevices
+// should exceed the number of devices that are active within the time it takes to refill a bucket.
+type DeviceRateLimiter struct {
+	limit   RateLimit
+	mutex   sync.Mutex
+	buckets map[string]*list.Element
+	recency *list.List // Device buckets, from most to least recently seen
+}
+
+type deviceBucket struct {
+	deviceId string
+	bucket   tokenBucket
+}
+
+// NewDeviceRateLimiter creates a per-device rate limiter. Returns nil if limit is nil, which admits all requests.
+func NewDeviceRateLimiter(limit *RateLimit) *DeviceRateLimiter {
+	if limit == nil {
+		return nil
+	}
+
+	return &DeviceRateLimiter{limit: *limit, buckets: make(map[string]*list.Element), recency: list.New()}
+}
+
+// allow admits a request of a device or returns a *RateLimitError.
+func (limiter *DeviceRateLimiter) allow(deviceId string, now time.Time) error {
+	if limiter == nil {
+		return nil
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	element, ok := limiter.buckets[deviceId]
+	if ok {
+		limiter.recency.MoveToFront(element)
+	} else {
+		if limiter.recency.Len() >= limiter.limit.MaxDevices {
+			oldest := limiter.recency.Back()
+			limiter.recency.Remove(oldest)
+			delete(limiter.buckets, oldest.Value.(*deviceBucket).deviceId)
+		}
+
+		element = limiter.recency.PushFront(&deviceBucket{deviceId: deviceId})
+		limiter.buckets[deviceId] = element
+	}
+
+	if retryAfter, ok := element.Value.(*deviceBucket).bucket.take(&limiter.limit, now); !ok {
+		return &RateLimitError{Scope: rateLimitScopeDevice, RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// RateLimiters keeps the rate limiters of routes, keyed by route path, across configuration reloads. A reload reuses the limiters
+// of a route whose limits didn't change, so it doesn't refill their buckets.
+type RateLimiters struct {
+	mutex   sync.Mutex
+	routes  map[string]*RouteRateLimiter
+	devices map[string]*DeviceRateLimiter
+}
+
+// NewRateLimiters creates an empty set of route rate limiters.
+func NewRateLimiters() *RateLimiters {
+	return &RateLimiters{routes: make(map[string]*RouteRateLimiter), devices: make(map[string]*DeviceRateLimiter)}
+}
+
+// route returns the route rate limiter of a route path, replacing the current one if its limit changed. A nil set creates a new
+// limiter every time.
+func (limiters *RateLimiters) route(path string, limit *RateLimit) *RouteRateLimiter {
+	if limiters == nil {
+		return NewRouteRateLimiter(limit)
+	}
+
+	limiters.mutex.Lock()
+	defer limiters.mutex.Unlock()
+
+	if limit == nil {
+		delete(limiters.routes, path)
+		return nil
+	}
+
+	limiter := limiters.routes[path]
+	if limiter == nil || limiter.limit != *limit {
+		limiter = NewRouteRateLimiter(limit)
+		limiters.routes[path] = limiter
+	}
+
+	return limiter
+}
+
+// device returns the per-device rate limiter of a route path, replacing the current one if its limit changed. A nil set creates a
+// new limiter every time.
+func (limiters *RateLimiters) device(path string, limit *RateLimit) *DeviceRateLimiter {
+	if limiters == nil {
+		return NewDeviceRateLimiter(limit)
+	}
+
+	limiters.mutex.Lock()
+	defer limiters.mutex.Unlock()
+
+	if limit == nil {
+		delete(limiters.devices, path)
+		return nil
+	}
+
+	limiter := limiters.devices[path]
+	if limiter == nil || limiter.limit != *limit {
+		limiter = NewDeviceRateLimiter(limit)
+		limiters.devices[path] = limiter
+	}
+
+	return limiter
+}
+
+// retain discards the limiters of the routes whose paths aren't given, once they are removed from the configuration.
+func (limiters *RateLimiters) retain(paths []string) {
+	if limiters == nil {
+		return
+	}
+
+	retained := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		retained[path] = true
+	}
+
+	limiters.mutex.Lock()
+	defer limiters.mutex.Unlock()
+
+	for path := range limiters.routes {
+		if !retained[path] {
+			delete(limiters.routes, path)
+		}
+	}
+
+	for path := range limiters.devices {
+		if !retained[path] {
+			delete(limiters.devices, path)
+		}
+	}
+}
+
+// withRouteRateLimit wraps the handler of a route, rejecting requests beyond the rate limit of the route with 429.
+func withRouteRateLimit(limiter *RouteRateLimiter, metrics *Metrics, handler func(*log.Entry, http.ResponseWriter, *http.Request)) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	if limiter == nil {
+		return handler
+	}
+
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		if err := limiter.allow(time.Now()); err != nil {
+			metrics.rateLimited(r, rateLimitScopeRoute)
+			respondRequestError(logger, w, err)
+			return
+		}
+
+		handler(logger, w, r)
+	}
+}
+
+// limitDevice admits a message of a device to be sent to the Bridge, according to the per-device rate limit of its route.
+func (adapter *Adapter) limitDevice(r *http.Request, message AugmentedD2CMessage, deviceId string) error {
+	err := message.DeviceLimiter.allow(deviceId, time.Now())
+	if err != nil {
+		adapter.Services.Metrics.rateLimited(r, rateLimitScopeDevice)
+	}
+
+	return err
+}
+
+// respondRequestError responds with the status of a failure to resolve the device Id, credentials, or rate limit of a request,
+// telling rate-limited clients when to retry.
+func respondRequestError(logger *log.Entry, w http.ResponseWriter, err error) {
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimitErr.RetryAfter.Seconds()))))
+	}
+
+	respondError(logger, w, requestErrorStatus(err), err)
+}
@@ -0,0 +1,151 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := &RateLimit{Rate: 2, Burst: 3}
+	bucket := tokenBucket{}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		_, ok := bucket.take(limit, now)
+		assert.True(t, ok)
+	}
+
+	retryAfter, ok := bucket.take(limit, now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	_, ok = bucket.take(limit, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	// The bucket never holds more than the burst.
+	for i := 0; i < 3; i++ {
+		_, ok := bucket.take(limit, now.Add(time.Hour))
+		assert.True(t, ok)
+	}
+
+	_, ok = bucket.take(limit, now.Add(time.Hour))
+	assert.False(t, ok)
+}
+
+func TestDeviceRateLimiterEviction(t *testing.T) {
+	limiter := NewDeviceRateLimiter(&RateLimit{Rate: 1, Burst: 1, MaxDevices: 2})
+	now := time.Now()
+
+	assert.NoError(t, limiter.allow("device-1", now))
+	assert.NoError(t, limiter.allow("device-2", now))
+	assert.Error(t, limiter.allow("device-1", now))
+
+	// device-2 is the least recently seen device, so it's evicted and starts over with a full bucket.
+	assert.NoError(t, limiter.allow("device-3", now))
+	assert.Len(t, limiter.buckets, 2)
+	assert.NoError(t, limiter.allow("device-2", now))
+	assert.Equal(t, &RateLimitError{Scope: "device", RetryAfter: time.Second}, limiter.allow("device-3", now))
+
+	var unlimited *DeviceRateLimiter
+	assert.NoError(t, unlimited.allow("device-1", now))
+}
+
+func TestRouteRateLimit(t *testing.T) {
+	metrics := NewMetrics()
+	adapter, _ := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", RouteRateLimit: &RateLimit{Rate: 0.1, Burst: 2}},
+	}}, "localhost:1000", &Services{Metrics: metrics})
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/device-1/message", `{"data": {}}`).Code)
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/device-2/message", `{"data": {}}`).Code)
+
+	response := sendTestMessage(adapter.Router, "/device-3/message", `{"data": {}}`)
+	assert.Equal(t, 429, response.Code)
+	assert.Equal(t, "10", response.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error": "route rate limit exceeded"}`, response.Body.String())
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.rateLimits.WithLabelValues("/{id}/message", "route")))
+}
+
+func TestDeviceRateLimit(t *testing.T) {
+	client := &BridgeClientMock{}
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/message", DeviceIdBodyQuery: ".device", AuthHeader: "key", DeviceRateLimit: &RateLimit{Rate: 1, Burst: 1, MaxDevices: 100}},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/message", `{"device": "device-1"}`).Code)
+
+	client.LastSendMessageDeviceId = ""
+	response := sendTestMessage(adapter.Router, "/message", `{"device": "device-1"}`)
+	assert.Equal(t, 429, response.Code)
+	assert.Equal(t, "1", response.Header().Get("Retry-After"))
+	assert.Empty(t, client.LastSendMessageDeviceId)
+
+	// Other devices have their own bucket.
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/message", `{"device": "device-2"}`).Code)
+}
+
+func TestRateLimitsKeptAcrossReloads(t *testing.T) {
+	services := &Services{RateLimiters: NewRateLimiters()}
+	buildAdapter := func(routeLimit *RateLimit, deviceLimit *RateLimit) *Adapter {
+		adapter, err := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+			{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", RouteRateLimit: routeLimit},
+			{Path: "/message", DeviceIdBodyQuery: ".device", AuthHeader: "key", DeviceRateLimit: deviceLimit},
+		}}, "localhost:1000", services)
+
+		require.NoError(t, err)
+		adapter.GetBridgeClient = mockGetBridgeClient
+		return adapter
+	}
+
+	adapter := buildAdapter(&RateLimit{Rate: 0.1, Burst: 1}, &RateLimit{Rate: 0.1, Burst: 1, MaxDevices: 100})
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/device-1/message", `{"data": {}}`).Code)
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/message", `{"device": "device-1"}`).Code)
+
+	// Reloading the same limits keeps the buckets.
+	adapter = buildAdapter(&RateLimit{Rate: 0.1, Burst: 1}, &RateLimit{Rate: 0.1, Burst: 1, MaxDevices: 100})
+	assert.Equal(t, 429, sendTestMessage(adapter.Router, "/device-1/message", `{"data": {}}`).Code)
+	assert.Equal(t, 429, sendTestMessage(adapter.Router, "/message", `{"device": "device-1"}`).Code)
+
+	// Changing the limits starts over.
+	adapter = buildAdapter(&RateLimit{Rate: 0.1, Burst: 2}, &RateLimit{Rate: 0.1, Burst: 2, MaxDevices: 100})
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/device-1/message", `{"data": {}}`).Code)
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/message", `{"device": "device-1"}`).Code)
+
+	// Removing the limits discards them.
+	buildAdapter(nil, nil)
+	assert.Empty(t, services.RateLimiters.routes)
+	assert.Empty(t, services.RateLimiters.devices)
+}
+
+func TestDeviceRateLimitFanOut(t *testing.T) {
+	recorder := &BridgeClientRecorder{}
+	adapter, err := NewAdapter(&Config{D2CMessages: []D2CMessage{{
+		Path:              "/batch",
+		DeviceIdBodyQuery: ".device",
+		AuthHeader:        "key",
+		Transform:         ".readings[] | { device, data: { t } }",
+		FanOut:            true,
+		DeviceRateLimit:   &RateLimit{Rate: 1, Burst: 1, MaxDevices: 100},
+	}}}, "localhost:1000")
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+	response := sendTestMessage(adapter.Router, "/batch", `{"readings": [{"device": "d1", "t": 1}, {"device": "d1", "t": 2}, {"device": "d2", "t": 3}]}`)
+	assert.Equal(t, 207, response.Code)
+
+	var body FanOutResponseBody
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equal(t, 2, body.Succeeded)
+	assert.Equal(t, 1, body.Failed)
+	assert.Len(t, recorder.Messages["d1"], 1)
+	assert.Len(t, recorder.Messages["d2"], 1)
+}
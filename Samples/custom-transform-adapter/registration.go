@@ -0,0 +1,160 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultRegistrationCacheSize = 100000
+
+// AutoRegisterOptions describes how the devices of a route are registered before their first message is forwarded, so they're
+// assigned to a device template instead of landing in IoT Central unassigned.
+type AutoRegisterOptions struct {
+	ModelId      string // Model Id with which devices are registered
+	ModelIdQuery string // Query computing the model Id from the request body, instead of a fixed one
+}
+
+// RegistrationError is returned when the Bridge fails to register a device.
+type RegistrationError struct {
+	Response autorest.Response
+	Err      error
+}
+
+func (err *RegistrationError) Error() string {
+	return fmt.Sprintf("device registration failed: %s", err.Err)
+}
+
+func (err *RegistrationError) Unwrap() error {
+	return err.Err
+}
+
+// RegistrationCache keeps the Ids of the devices registered by the adapter, so each device is registered once. Concurrent first
+// messages of a device share a single registration call. Up to maxDevices devices are kept, evicting the least recently seen
+// devices first. An evicted device is registered again, which the Bridge accepts for already registered devices.
+type RegistrationCache struct {
+	maxDevices int
+	flights    singleflight.Group
+
+	mutex   sync.Mutex
+	devices map[string]*list.Element
+	recency *list.List // Device Ids, from most to least recently seen
+}
+
+// NewRegistrationCache creates a cache of up to maxDevices registered devices. A zero max uses the default value.
+func NewRegistrationCache(maxDevices int) *RegistrationCache {
+	if maxDevices == 0 {
+		maxDevices = defaultRegistrationCacheSize
+	}
+
+	return &RegistrationCache{maxDevices: maxDevices, devices: make(map[string]*list.Element), recency: list.New()}
+}
+
+// contains returns whether a device was registered.
+func (cache *RegistrationCache) contains(deviceId string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.devices[deviceId]
+	if ok {
+		cache.recency.MoveToFront(element)
+	}
+
+	return ok
+}
+
+// add records a registered device.
+func (cache *RegistrationCache) add(deviceId string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if _, ok := cache.devices[deviceId]; ok {
+		return
+	}
+
+	if cache.recency.Len() >= cache.maxDevices {
+		delete(cache.devices, cache.recency.Remove(cache.recency.Back()).(string))
+	}
+
+	cache.devices[deviceId] = cache.recency.PushFront(deviceId)
+}
+
+// register calls the given registration function unless the device is already registered. Concurrent callers for the same
+// device wait for a single call and share its outcome.
+func (cache *RegistrationCache) register(deviceId string, register func() (autorest.Response, error)) (autorest.Response, error) {
+	if cache.contains(deviceId) {
+		return autorest.Response{}, nil
+	}
+
+	result, err, _ := cache.flights.Do(deviceId, func() (interface{}, error) {
+		// The device may have been registered by a call that completed since it was checked.
+		if cache.contains(deviceId) {
+			return autorest.Response{}, nil
+		}
+
+		bridgeResponse, err := register()
+		if err == nil {
+			cache.add(deviceId)
+		}
+
+		return bridgeResponse, err
+	})
+
+	return result.(autorest.Response), err
+}
+
+// registerDevice registers a device with the model Id of its route, if the route auto-registers devices and the device wasn't
+// registered yet. Returns a *RegistrationError if the Bridge call fails.
+func (adapter *Adapter) registerDevice(logger *log.Entry, r *http.Request, message AugmentedD2CMessage, bridgeClient BridgeClient, deviceId string, input interface{}) error {
+	if message.AutoRegister == nil || adapter.Services.Registrations.contains(deviceId) {
+		return nil
+	}
+
+	modelId := message.AutoRegister.ModelId
+	if message.ModelIdQueryId != "" {
+		result, err := adapter.Engine.ExecuteWithVariables(message.ModelIdQueryId, input, requestVariables(r))
+		if err != nil {
+			return fmt.Errorf("model Id query failed: %w", err)
+		}
+
+		var ok bool
+		if modelId, ok = result.(string); !ok || modelId == "" {
+			return errors.New("expected result from model Id query to be a non-empty string")
+		}
+	}
+
+	bridgeResponse, err := adapter.Services.Registrations.register(deviceId, func() (autorest.Response, error) {
+		bridgeResponse, err := bridgeClient.Register(r.Context(), deviceId, &bridge.RegistrationBody{ModelID: &modelId})
+		if err == nil {
+			logger.Infof("Registered device %s with model %s", deviceId, modelId)
+		}
+
+		return bridgeResponse, err
+	})
+
+	if err != nil {
+		return &RegistrationError{Response: bridgeResponse, Err: fmt.Errorf("call to Device Bridge failed: %w", err)}
+	}
+
+	return nil
+}
+
+// registrationErrorStatus returns the status of a failure to register a device: the Bridge status if the Bridge call failed,
+// or 400 if the model Id couldn't be computed.
+func registrationErrorStatus(err error) int {
+	var registrationErr *RegistrationError
+	if errors.As(err, &registrationErr) {
+		return bridgeStatusCode(registrationErr.Response)
+	}
+
+	return http.StatusBadRequest
+}
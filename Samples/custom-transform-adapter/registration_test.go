@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// BridgeRegistrationRecorder records the devices registered through it, failing the registration of the given devices.
+type BridgeRegistrationRecorder struct {
+	BridgeClientMock
+	mutex          sync.Mutex
+	Registered     map[string][]string // Model Ids with which each device was registered
+	FailingDevices map[string]int
+}
+
+func (client *BridgeRegistrationRecorder) Register(ctx context.Context, deviceID string, body *bridge.RegistrationBody) (autorest.Response, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if status, ok := client.FailingDevices[deviceID]; ok {
+		return autorest.Response{Response: &http.Response{StatusCode: status}}, errors.New("registration failed")
+	}
+
+	if client.Registered == nil {
+		client.Registered = make(map[string][]string)
+	}
+
+	client.Registered[deviceID] = append(client.Registered[deviceID], *body.ModelID)
+	return autorest.Response{}, nil
+}
+
+func TestAutoRegister(t *testing.T) {
+	client := &BridgeRegistrationRecorder{FailingDevices: map[string]int{"failing-device": 403}}
+	adapter, err := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", AutoRegister: &AutoRegisterOptions{ModelId: "dtmi:example:sensor;1"}},
+		{Path: "/message", DeviceIdBodyQuery: ".device", AuthHeader: "key", AutoRegister: &AutoRegisterOptions{ModelIdQuery: ".model"}},
+	}}, "localhost:1000", &Services{Registrations: NewRegistrationCache(0)})
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+
+	// Devices are registered before their first message only.
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/device-1/message", `{"data": {}}`).Code)
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/device-1/message", `{"data": {}}`).Code)
+	assert.Equal(t, []string{"dtmi:example:sensor;1"}, client.Registered["device-1"])
+	assert.Equal(t, "device-1", client.LastSendMessageDeviceId)
+
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/message", `{"device": "device-2", "model": "dtmi:example:meter;1", "data": {}}`).Code)
+	assert.Equal(t, []string{"dtmi:example:meter;1"}, client.Registered["device-2"])
+
+	response := sendTestMessage(adapter.Router, "/message", `{"device": "device-3", "data": {}}`)
+	assert.Equal(t, 400, response.Code)
+	assert.JSONEq(t, `{"error": "expected result from model Id query to be a non-empty string"}`, response.Body.String())
+
+	// Failed registrations fail the message with the Bridge status, and are attempted again on the next message.
+	client.LastSendMessageDeviceId = ""
+	response = sendTestMessage(adapter.Router, "/failing-device/message", `{"data": {}}`)
+	assert.Equal(t, 403, response.Code)
+	assert.JSONEq(t, `{"error": "device registration failed: call to Device Bridge failed: registration failed"}`, response.Body.String())
+	assert.Empty(t, client.LastSendMessageDeviceId)
+
+	delete(client.FailingDevices, "failing-device")
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/failing-device/message", `{"data": {}}`).Code)
+	assert.Len(t, client.Registered["failing-device"], 1)
+}
+
+func TestRegistrationCacheSingleFlight(t *testing.T) {
+	cache := NewRegistrationCache(0)
+	var calls int32
+	register := func() (autorest.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return autorest.Response{}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.register("device", register)
+			assert.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+	_, err := cache.register("device", register)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRegistrationCacheEviction(t *testing.T) {
+	cache := NewRegistrationCache(2)
+	cache.add("device-1")
+	cache.add("device-2")
+	assert.True(t, cache.contains("device-1"))
+
+	// device-2 is the least recently seen device, so it's evicted.
+	cache.add("device-3")
+	assert.False(t, cache.contains("device-2"))
+	assert.True(t, cache.contains("device-1"))
+	assert.True(t, cache.contains("device-3"))
+}
+
+func TestRegistrationCacheRequired(t *testing.T) {
+	_, err := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/message", DeviceIdBodyQuery: ".device", AuthHeader: "key", AutoRegister: &AutoRegisterOptions{ModelId: "dtmi:example:sensor;1"}},
+	}}, "localhost:1000")
+
+	assert.EqualError(t, err, "transform-adapter: route /message uses autoRegister, but no registration cache is configured")
+}
@@ -0,0 +1,174 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReloadableHandler is an HTTP handler that serves requests with the currently active adapter.
+// The active adapter can be atomically swapped at runtime. Requests that are already being processed
+// keep the adapter (routes, transforms, etc.) they started with.
+type ReloadableHandler struct {
+	current atomic.Pointer[Adapter]
+	// Requests acquire the active adapter with a read lock, so no request acquires an adapter after it's swapped out.
+	swapMutex sync.RWMutex
+}
+
+// Swap replaces the active adapter, returning the previous one, if any.
+func (handler *ReloadableHandler) Swap(adapter *Adapter) *Adapter {
+	handler.swapMutex.Lock()
+	defer handler.swapMutex.Unlock()
+
+	return handler.current.Swap(adapter)
+}
+
+// Current returns the active adapter, or nil if none has been loaded yet.
+func (handler *ReloadableHandler) Current() *Adapter {
+	return handler.current.Load()
+}
+
+// Acquire returns the active adapter to serve a request, or nil if none has been loaded yet. The returned function must be
+// called once the request is served, so the adapter can be closed after it's swapped out.
+func (handler *ReloadableHandler) Acquire() (*Adapter, func()) {
+	handler.swapMutex.RLock()
+	defer handler.swapMutex.RUnlock()
+
+	adapter := handler.current.Load()
+	if adapter == nil {
+		return nil, func() {}
+	}
+
+	adapter.requests.Add(1)
+	return adapter, adapter.requests.Done
+}
+
+func (handler *ReloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	adapter, release := handler.Acquire()
+	defer release()
+	if adapter == nil {
+		http.Error(w, "adapter configuration not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	adapter.Router.ServeHTTP(w, r)
+}
+
+// ConfigWatcher loads the adapter configuration and reloads it whenever the config file or any of the transform files it references change.
+// If a new configuration fails to load or validate, the previous one is kept active.
+type ConfigWatcher struct {
+	configPath      string
+	configFileName  string
+	handler         *ReloadableHandler
+	build           func(*Config) (*Adapter, error)
+	mutex           sync.Mutex
+	lastFingerprint string
+}
+
+func NewConfigWatcher(configPath string, configFileName string, handler *ReloadableHandler, build func(*Config) (*Adapter, error)) *ConfigWatcher {
+	return &ConfigWatcher{
+		configPath:     configPath,
+		configFileName: configFileName,
+		handler:        handler,
+		build:          build,
+	}
+}
+
+// Reload loads the configuration from disk, builds a new adapter for it, and makes it the active one.
+func (watcher *ConfigWatcher) Reload() error {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+
+	// Take the fingerprint before loading, so changes made while the config is being loaded are picked up by the next check.
+	watcher.lastFingerprint = watcher.fingerprint()
+
+	config, err := LoadConfig(watcher.configPath, watcher.configFileName)
+	if err != nil {
+		return err
+	}
+
+	adapter, err := watcher.build(config)
+	if err != nil {
+		return err
+	}
+
+	// The previous adapter is closed in the background, once the requests it's still serving complete.
+	if previous := watcher.handler.Swap(adapter); previous != nil {
+		go previous.Close()
+	}
+
+	return nil
+}
+
+// Watch checks for configuration changes at the given interval, until the context is canceled.
+func (watcher *ConfigWatcher) Watch(ctx context.Context, interval time.Duration) {
+	log.Infof("Watching configuration for changes every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			watcher.check()
+		}
+	}
+}
+
+// check reloads the configuration if any of the watched files changed since the last load attempt.
+// Returns whether a reload was attempted.
+func (watcher *ConfigWatcher) check() bool {
+	watcher.mutex.Lock()
+	changed := watcher.fingerprint() != watcher.lastFingerprint
+	watcher.mutex.Unlock()
+
+	if !changed {
+		return false
+	}
+
+	log.Info("Configuration change detected, reloading")
+
+	if err := watcher.Reload(); err != nil {
+		log.WithField("error", err).Errorf("Failed to reload configuration, keeping previous configuration: %s", err)
+	} else {
+		log.Info("Configuration reloaded")
+	}
+
+	return true
+}
+
+// fingerprint returns a hash of the contents of the config file and of all files it references.
+// Files that can't be read are hashed as missing, so their later creation is detected as a change.
+func (watcher *ConfigWatcher) fingerprint() string {
+	hash := sha256.New()
+	files := []string{watcher.configFileName}
+
+	if configRaw, err := readConfigRaw(watcher.configPath, watcher.configFileName); err == nil {
+		files = append(files, configRaw.referencedFiles()...)
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(filepath.Join(watcher.configPath, file))
+		if err != nil {
+			fmt.Fprintf(hash, "%s:missing\n", file)
+			continue
+		}
+
+		fmt.Fprintf(hash, "%s:%d\n", file, len(content))
+		hash.Write(content)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, dir string, name string, content string) {
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+}
+
+func buildTestWatcher(t *testing.T, dir string) (*ConfigWatcher, *ReloadableHandler) {
+	handler := &ReloadableHandler{}
+	watcher := NewConfigWatcher(dir, "config.json", handler, func(config *Config) (*Adapter, error) {
+		adapter, err := NewAdapter(config, "localhost:1000")
+		if err == nil {
+			adapter.GetBridgeClient = mockGetBridgeClient
+		}
+
+		return adapter, err
+	})
+
+	return watcher, handler
+}
+
+func sendTestMessage(handler http.Handler, path string, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	req.Header.Add("key", "test_key")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestReloadableHandlerNotLoaded(t *testing.T) {
+	recorder := sendTestMessage(&ReloadableHandler{}, "/test_device/message", "{}")
+	assert.Equal(t, 503, recorder.Code)
+}
+
+func TestConfigWatcherReloadsChangedConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "config.json", `{"d2cMessages": [{"path": "/{id}/message", "deviceIdPathParam": "id", "authHeader": "key"}]}`)
+	watcher, handler := buildTestWatcher(t, dir)
+	assert.NoError(t, watcher.Reload())
+	assert.False(t, watcher.check())
+	assert.Equal(t, 200, sendTestMessage(handler, "/test_device/message", "{}").Code)
+	assert.Equal(t, 404, sendTestMessage(handler, "/test_device/telemetry", "{}").Code)
+
+	writeTestFile(t, dir, "config.json", `{"d2cMessages": [{"path": "/{id}/telemetry", "deviceIdPathParam": "id", "authHeader": "key"}]}`)
+	assert.True(t, watcher.check())
+	assert.Equal(t, 404, sendTestMessage(handler, "/test_device/message", "{}").Code)
+	assert.Equal(t, 200, sendTestMessage(handler, "/test_device/telemetry", "{}").Code)
+}
+
+func TestConfigWatcherReloadsChangedTransformFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "config.json", `{"d2cMessages": [{"path": "/{id}/message", "deviceIdPathParam": "id", "authHeader": "key", "transformFile": "transform.jq"}]}`)
+	writeTestFile(t, dir, "transform.jq", "{ data: .a }")
+	watcher, handler := buildTestWatcher(t, dir)
+	assert.NoError(t, watcher.Reload())
+	sendTestMessage(handler, "/test_device/message", `{"a": {"temperature": 1}, "b": {"temperature": 2}}`)
+	assert.Equal(t, float64(1), mockBridgeClient.LastSendMessageBody.Data["temperature"])
+
+	writeTestFile(t, dir, "transform.jq", "{ data: .b }")
+	assert.True(t, watcher.check())
+	sendTestMessage(handler, "/test_device/message", `{"a": {"temperature": 1}, "b": {"temperature": 2}}`)
+	assert.Equal(t, float64(2), mockBridgeClient.LastSendMessageBody.Data["temperature"])
+}
+
+func TestConfigWatcherKeepsPreviousConfigOnError(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "config.json", `{"d2cMessages": [{"path": "/{id}/message", "deviceIdPathParam": "id", "authHeader": "key"}]}`)
+	watcher, handler := buildTestWatcher(t, dir)
+	assert.NoError(t, watcher.Reload())
+	previous := handler.Current()
+
+	// Fails validation.
+	writeTestFile(t, dir, "config.json", `{"d2cMessages": [{"path": "/{id}/telemetry", "deviceIdPathParam": "id"}]}`)
+	assert.True(t, watcher.check())
+	assert.True(t, previous == handler.Current())
+
+	// Fails transform compilation.
+	writeTestFile(t, dir, "config.json", `{"d2cMessages": [{"path": "/{id}/telemetry", "deviceIdPathParam": "id", "authHeader": "key", "transform": ".{a}"}]}`)
+	assert.True(t, watcher.check())
+	assert.True(t, previous == handler.Current())
+	assert.Equal(t, 200, sendTestMessage(handler, "/test_device/message", "{}").Code)
+
+	// A failed attempt is not retried until the files change again.
+	assert.False(t, watcher.check())
+}
+
+func TestConfigWatcherDetectsMissingTransformFileCreation(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "config.json", `{"d2cMessages": [{"path": "/{id}/message", "deviceIdPathParam": "id", "authHeader": "key", "transformFile": "transform.jq"}]}`)
+	watcher, handler := buildTestWatcher(t, dir)
+	assert.Error(t, watcher.Reload())
+	assert.Nil(t, handler.Current())
+
+	writeTestFile(t, dir, "transform.jq", "{ data: . }")
+	assert.True(t, watcher.check())
+	assert.NotNil(t, handler.Current())
+}
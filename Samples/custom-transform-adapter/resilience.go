@@ -0,0 +1,279 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryBaseDelay   = 100 * time.Millisecond
+	defaultRetryMaxDelay    = 2 * time.Second
+	defaultRetryTimeout     = 10 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned by Bridge calls rejected without being attempted, because the circuit breaker is open.
+var ErrCircuitOpen = errors.New("the Bridge is unavailable, circuit breaker is open")
+
+// RetryPolicy describes how Bridge calls failing with a transient status (429 or 503) are retried, with jittered exponential backoff.
+type RetryPolicy struct {
+	MaxRetries int           // Maximum number of retries after the first attempt
+	BaseDelay  time.Duration // Maximum delay before the first retry, doubled on each retry
+	MaxDelay   time.Duration // Cap of the delay between retries
+	Timeout    time.Duration // Time after which no more retries are attempted, if the request has no earlier deadline
+}
+
+// NewRetryPolicy creates a retry policy. Zero durations use the default values.
+func NewRetryPolicy(maxRetries int, baseDelay time.Duration, maxDelay time.Duration, timeout time.Duration) *RetryPolicy {
+	if baseDelay == 0 {
+		baseDelay = defaultRetryBaseDelay
+	}
+
+	if maxDelay == 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+
+	if timeout == 0 {
+		timeout = defaultRetryTimeout
+	}
+
+	return &RetryPolicy{MaxRetries: maxRetries, BaseDelay: baseDelay, MaxDelay: maxDelay, Timeout: timeout}
+}
+
+// delay returns the time to wait before the given retry (starting at 0), using "full jitter": a random delay up to the backoff.
+// A Retry-After from the Bridge is honored as the minimum delay.
+func (policy *RetryPolicy) delay(retry int, bridgeResponse autorest.Response) time.Duration {
+	backoff := policy.MaxDelay
+	if retry < 30 && policy.BaseDelay<<retry < policy.MaxDelay {
+		backoff = policy.BaseDelay << retry
+	}
+
+	delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+	if bridgeResponse.Response != nil {
+		if seconds, err := strconv.Atoi(bridgeResponse.Header.Get("Retry-After")); err == nil && time.Duration(seconds)*time.Second > delay {
+			delay = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return delay
+}
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // Calls are attempted
+	CircuitHalfOpen                     // A single probe call is attempted, to check whether the Bridge recovered
+	CircuitOpen                         // Calls are rejected without being attempted
+)
+
+func (state CircuitState) String() string {
+	return [...]string{"closed", "half-open", "open"}[state]
+}
+
+// CircuitBreaker stops calling the Bridge while it's consistently failing, so requests fail fast instead of piling up. It opens after
+// a number of consecutive failures (5xx responses or no response at all) and, after a cooldown, lets a single probe call through:
+// the circuit closes if it succeeds, or opens again otherwise.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker creates a circuit breaker opening after the given number of consecutive failures. Zero values use the defaults.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold == 0 {
+		threshold = defaultBreakerThreshold
+	}
+
+	if cooldown == 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// State returns the current state of the breaker.
+func (breaker *CircuitBreaker) State() CircuitState {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.state
+}
+
+// allow returns whether a call may be attempted. Once the cooldown of an open breaker is over, only one call is allowed until its
+// outcome is recorded.
+func (breaker *CircuitBreaker) allow(now time.Time) bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.state == CircuitOpen && now.Sub(breaker.openedAt) >= breaker.cooldown {
+		breaker.transition(CircuitHalfOpen)
+	}
+
+	switch breaker.state {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		if breaker.probing {
+			return false
+		}
+
+		breaker.probing = true
+		return true
+	default:
+		return false
+	}
+}
+
+// record updates the breaker with the outcome of an allowed call.
+func (breaker *CircuitBreaker) record(failed bool, now time.Time) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.probing = false
+	if !failed {
+		breaker.failures = 0
+		if breaker.state != CircuitClosed {
+			breaker.transition(CircuitClosed)
+		}
+
+		return
+	}
+
+	breaker.failures++
+	if breaker.state == CircuitHalfOpen || (breaker.state == CircuitClosed && breaker.failures >= breaker.threshold) {
+		breaker.openedAt = now
+		breaker.transition(CircuitOpen)
+	}
+}
+
+// release lets another call be allowed in place of an allowed call whose outcome says nothing about the Bridge, e.g., because the
+// request was cancelled. The state of the breaker is left unchanged.
+func (breaker *CircuitBreaker) release() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.probing = false
+}
+
+// transition changes the state of the breaker, logging it. Must be called with the mutex held.
+func (breaker *CircuitBreaker) transition(state CircuitState) {
+	entry := log.WithFields(log.Fields{"previousState": breaker.state.String(), "state": state.String(), "failures": breaker.failures})
+	if state == CircuitOpen {
+		entry.Warnf("Bridge circuit breaker opened after %d consecutive failures", breaker.failures)
+	} else {
+		entry.Infof("Bridge circuit breaker is %s", state)
+	}
+
+	breaker.state = state
+}
+
+// isBridgeFailure returns whether the outcome of a Bridge call means that the Bridge is failing, as opposed to rejecting the call.
+func isBridgeFailure(bridgeResponse autorest.Response, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return bridgeResponse.Response == nil || bridgeResponse.StatusCode >= 500
+}
+
+// isRetriableStatus returns whether a Bridge call that failed with the given status code should be retried.
+func isRetriableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// withResilience wraps a Bridge client, retrying its device-to-cloud calls according to the retry policy and guarding them with the
+// circuit breaker. Either of them may be nil.
+func withResilience(client BridgeClient, retry *RetryPolicy, breaker *CircuitBreaker, metrics *Metrics, route string) BridgeClient {
+	if retry == nil && breaker == nil {
+		return client
+	}
+
+	return &resilientBridgeClient{BridgeClient: client, retry: retry, breaker: breaker, metrics: metrics, route: route}
+}
+
+type resilientBridgeClient struct {
+	BridgeClient
+	retry   *RetryPolicy
+	breaker *CircuitBreaker
+	metrics *Metrics
+	route   string
+}
+
+func (client *resilientBridgeClient) SendMessage(ctx context.Context, deviceID string, body *bridge.MessageBody) (autorest.Response, error) {
+	return client.call(ctx, func() (autorest.Response, error) {
+		return client.BridgeClient.SendMessage(ctx, deviceID, body)
+	})
+}
+
+func (client *resilientBridgeClient) UpdateReportedProperties(ctx context.Context, deviceID string, body *bridge.ReportedPropertiesPatch) (autorest.Response, error) {
+	return client.call(ctx, func() (autorest.Response, error) {
+		return client.BridgeClient.UpdateReportedProperties(ctx, deviceID, body)
+	})
+}
+
+// call attempts a Bridge call, retrying it while it fails with a retriable status and the next attempt can start before the deadline,
+// which is the deadline of the request or the retry timeout, whichever comes first.
+func (client *resilientBridgeClient) call(ctx context.Context, attempt func() (autorest.Response, error)) (autorest.Response, error) {
+	maxRetries := 0
+	var deadline time.Time
+	if client.retry != nil {
+		maxRetries = client.retry.MaxRetries
+		deadline = time.Now().Add(client.retry.Timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+	}
+
+	for retry := 0; ; retry++ {
+		if client.breaker != nil && !client.breaker.allow(time.Now()) {
+			client.metrics.circuitRejection(client.route)
+			return autorest.Response{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}}, ErrCircuitOpen
+		}
+
+		bridgeResponse, err := attempt()
+		if client.breaker != nil {
+			if ctx.Err() != nil {
+				client.breaker.release()
+			} else {
+				client.breaker.record(isBridgeFailure(bridgeResponse, err), time.Now())
+			}
+		}
+
+		if err == nil || retry >= maxRetries || bridgeResponse.Response == nil || !isRetriableStatus(bridgeResponse.StatusCode) {
+			return bridgeResponse, err
+		}
+
+		delay := client.retry.delay(retry, bridgeResponse)
+		if time.Now().Add(delay).After(deadline) {
+			return bridgeResponse, err
+		}
+
+		log.WithFields(log.Fields{"route": client.route, "status": bridgeResponse.StatusCode, "retry": retry + 1}).Infof("Retrying Bridge call in %s: %s", delay, err)
+		client.metrics.bridgeRetry(client.route)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return bridgeResponse, err
+		case <-timer.C:
+		}
+	}
+}
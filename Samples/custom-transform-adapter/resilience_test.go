@@ -0,0 +1,174 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// BridgeWithScriptedSend responds to SendMessage calls with the given status codes in order, then with 200.
+type BridgeWithScriptedSend struct {
+	BridgeClientMock
+	statuses []int
+	calls    int
+}
+
+func (client *BridgeWithScriptedSend) SendMessage(ctx context.Context, deviceID string, body *bridge.MessageBody) (autorest.Response, error) {
+	client.calls++
+	if len(client.statuses) == 0 {
+		return autorest.Response{Response: &http.Response{StatusCode: 200}}, nil
+	}
+
+	status := client.statuses[0]
+	client.statuses = client.statuses[1:]
+	if status == 0 {
+		return autorest.Response{}, errors.New("connection refused")
+	}
+
+	return autorest.Response{Response: &http.Response{StatusCode: status, Header: http.Header{}}}, errors.New("bridge error")
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := NewRetryPolicy(5, 100*time.Millisecond, time.Second, 0)
+	for retry, backoff := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 20; i++ {
+			delay := policy.delay(retry, autorest.Response{})
+			assert.GreaterOrEqual(t, delay, time.Duration(0))
+			assert.LessOrEqual(t, delay, backoff)
+		}
+	}
+
+	// Retry-After from the Bridge is the minimum delay.
+	response := autorest.Response{Response: &http.Response{StatusCode: 429, Header: http.Header{"Retry-After": []string{"2"}}}}
+	assert.Equal(t, 2*time.Second, policy.delay(0, response))
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	metrics := NewMetrics()
+	client := &BridgeWithScriptedSend{statuses: []int{503, 429}}
+	resilient := withResilience(client, NewRetryPolicy(3, time.Millisecond, time.Millisecond, 0), nil, metrics, "/message")
+
+	_, err := resilient.SendMessage(context.Background(), "device", &bridge.MessageBody{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, client.calls)
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.bridgeRetries.WithLabelValues("/message")))
+
+	// Other failures aren't retried.
+	client = &BridgeWithScriptedSend{statuses: []int{400}}
+	resilient = withResilience(client, NewRetryPolicy(3, time.Millisecond, time.Millisecond, 0), nil, nil, "/message")
+	response, err := resilient.SendMessage(context.Background(), "device", &bridge.MessageBody{})
+	assert.Error(t, err)
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Equal(t, 1, client.calls)
+
+	// Retries stop after the max retries.
+	client = &BridgeWithScriptedSend{statuses: []int{503, 503, 503}}
+	resilient = withResilience(client, NewRetryPolicy(1, time.Millisecond, time.Millisecond, 0), nil, nil, "/message")
+	response, _ = resilient.SendMessage(context.Background(), "device", &bridge.MessageBody{})
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Equal(t, 2, client.calls)
+}
+
+func TestRetryDeadline(t *testing.T) {
+	client := &BridgeWithScriptedSend{statuses: []int{503, 503, 503}}
+	resilient := withResilience(client, NewRetryPolicy(3, time.Hour, time.Hour, 0), nil, nil, "/message")
+
+	// A retry that wouldn't start before the request deadline isn't attempted.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	startTime := time.Now()
+	response, err := resilient.SendMessage(ctx, "device", &bridge.MessageBody{})
+	assert.Error(t, err)
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Less(t, time.Since(startTime), 50*time.Millisecond)
+	assert.LessOrEqual(t, client.calls, 2)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Minute)
+	now := time.Now()
+
+	assert.True(t, breaker.allow(now))
+	breaker.record(true, now)
+	assert.True(t, breaker.allow(now))
+	breaker.record(false, now)
+
+	// Only consecutive failures open the breaker.
+	for i := 0; i < 2; i++ {
+		assert.True(t, breaker.allow(now))
+		breaker.record(true, now)
+	}
+
+	assert.Equal(t, CircuitOpen, breaker.State())
+	assert.False(t, breaker.allow(now.Add(30*time.Second)))
+
+	// After the cooldown, a single probe is allowed. A failed probe opens the breaker again.
+	assert.True(t, breaker.allow(now.Add(time.Minute)))
+	assert.Equal(t, CircuitHalfOpen, breaker.State())
+	assert.False(t, breaker.allow(now.Add(time.Minute)))
+	breaker.record(true, now.Add(time.Minute))
+	assert.Equal(t, CircuitOpen, breaker.State())
+	assert.False(t, breaker.allow(now.Add(90*time.Second)))
+
+	// A successful probe closes it.
+	assert.True(t, breaker.allow(now.Add(2*time.Minute)))
+	breaker.record(false, now.Add(2*time.Minute))
+	assert.Equal(t, CircuitClosed, breaker.State())
+	assert.True(t, breaker.allow(now.Add(2*time.Minute)))
+}
+
+func TestCircuitBreakerCancelledProbe(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute)
+	openedAt := time.Now().Add(-time.Hour)
+	breaker.allow(openedAt)
+	breaker.record(true, openedAt)
+	client := withResilience(&BridgeWithScriptedSend{statuses: []int{0}}, nil, breaker, NewMetrics(), "/{id}/message")
+
+	// A probe cancelled by its request neither closes nor reopens the breaker, and lets another probe through.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.SendMessage(ctx, "device", &bridge.MessageBody{})
+	assert.EqualError(t, err, "connection refused")
+	assert.Equal(t, CircuitHalfOpen, breaker.State())
+
+	_, err = client.SendMessage(context.Background(), "device", &bridge.MessageBody{})
+	assert.NoError(t, err)
+	assert.Equal(t, CircuitClosed, breaker.State())
+}
+
+func TestCircuitBreakerFailsFast(t *testing.T) {
+	metrics := NewMetrics()
+	breaker := NewCircuitBreaker(2, time.Hour)
+	metrics.RegisterCircuitBreaker(breaker)
+	client := &BridgeWithScriptedSend{statuses: []int{500, 0, 500}}
+	adapter, _ := NewAdapterWithServices(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key"},
+	}}, "localhost:1000", &Services{Metrics: metrics, Breaker: breaker})
+
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+	assert.Equal(t, 500, sendTestMessage(adapter.Router, "/device/message", `{"data": {}}`).Code)
+	assert.Equal(t, 500, sendTestMessage(adapter.Router, "/device/message", `{"data": {}}`).Code)
+
+	response := sendTestMessage(adapter.Router, "/device/message", `{"data": {}}`)
+	assert.Equal(t, 503, response.Code)
+	assert.JSONEq(t, `{"error": "call to Device Bridge failed: the Bridge is unavailable, circuit breaker is open"}`, response.Body.String())
+	assert.Equal(t, 2, client.calls)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.circuitRejections.WithLabelValues("/{id}/message")))
+
+	expected := `
+		# HELP transform_adapter_bridge_circuit_state State of the Bridge circuit breaker: 0 (closed), 1 (half-open), or 2 (open).
+		# TYPE transform_adapter_bridge_circuit_state gauge
+		transform_adapter_bridge_circuit_state 2
+	`
+	assert.NoError(t, testutil.GatherAndCompare(metrics.Registry, strings.NewReader(expected), "transform_adapter_bridge_circuit_state"))
+}
@@ -3,14 +3,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/go-autorest/autorest"
@@ -20,14 +24,26 @@ import (
 	"github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter/lib/bridge"
 	"github.com/mitchellh/mapstructure"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const maxBodySize = 1024 * 1024 // 1 MiB
 
+// requestVariableNames are the jq variables through which transforms can access request metadata.
+var requestVariableNames = []string{"$headers", "$query", "$path", "$route", "$claims"}
+
 type BridgeClient interface {
 	SetAuthorizer(autorest.Authorizer)
 	SetRetryAttempts(int)
 	SendMessage(context.Context, string, *bridge.MessageBody) (autorest.Response, error)
+	UpdateReportedProperties(context.Context, string, *bridge.ReportedPropertiesPatch) (autorest.Response, error)
+	Register(context.Context, string, *bridge.RegistrationBody) (autorest.Response, error)
+	CreateOrUpdateMethodsSubscription(context.Context, string, *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error)
+	CreateOrUpdateC2DMessageSubscription(context.Context, string, *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error)
+	CreateOrUpdateDesiredPropertiesSubscription(context.Context, string, *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error)
+	DeleteMethodsSubscription(context.Context, string) (autorest.Response, error)
+	DeleteC2DMessageSubscription(context.Context, string) (autorest.Response, error)
+	DeleteDesiredPropertiesSubscription(context.Context, string) (autorest.Response, error)
 	GetBaseURI() string
 }
 
@@ -47,6 +63,38 @@ func (client *BridgeClientAutorest) SendMessage(ctx context.Context, deviceID st
 	return client.BaseClient.SendMessage(ctx, deviceID, body)
 }
 
+func (client *BridgeClientAutorest) UpdateReportedProperties(ctx context.Context, deviceID string, body *bridge.ReportedPropertiesPatch) (autorest.Response, error) {
+	return client.BaseClient.UpdateReportedProperties(ctx, deviceID, body)
+}
+
+func (client *BridgeClientAutorest) Register(ctx context.Context, deviceID string, body *bridge.RegistrationBody) (autorest.Response, error) {
+	return client.BaseClient.Register(ctx, deviceID, body)
+}
+
+func (client *BridgeClientAutorest) CreateOrUpdateMethodsSubscription(ctx context.Context, deviceID string, body *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error) {
+	return client.BaseClient.CreateOrUpdateMethodsSubscription(ctx, deviceID, body)
+}
+
+func (client *BridgeClientAutorest) CreateOrUpdateC2DMessageSubscription(ctx context.Context, deviceID string, body *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error) {
+	return client.BaseClient.CreateOrUpdateC2DMessageSubscription(ctx, deviceID, body)
+}
+
+func (client *BridgeClientAutorest) CreateOrUpdateDesiredPropertiesSubscription(ctx context.Context, deviceID string, body *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error) {
+	return client.BaseClient.CreateOrUpdateDesiredPropertiesSubscription(ctx, deviceID, body)
+}
+
+func (client *BridgeClientAutorest) DeleteMethodsSubscription(ctx context.Context, deviceID string) (autorest.Response, error) {
+	return client.BaseClient.DeleteMethodsSubscription(ctx, deviceID)
+}
+
+func (client *BridgeClientAutorest) DeleteC2DMessageSubscription(ctx context.Context, deviceID string) (autorest.Response, error) {
+	return client.BaseClient.DeleteC2DMessageSubscription(ctx, deviceID)
+}
+
+func (client *BridgeClientAutorest) DeleteDesiredPropertiesSubscription(ctx context.Context, deviceID string) (autorest.Response, error) {
+	return client.BaseClient.DeleteDesiredPropertiesSubscription(ctx, deviceID)
+}
+
 func (client *BridgeClientAutorest) GetBaseURI() string {
 	return client.BaseURI
 }
@@ -54,7 +102,33 @@ func (client *BridgeClientAutorest) GetBaseURI() string {
 type Adapter struct {
 	GetBridgeClient func() BridgeClient
 	Router          *mux.Router
+	MqttRouter      *mux.Router // Router of MQTT topic routes, which can't be reached through HTTP
+	CoapRouter      *mux.Router // Router of device-to-cloud path routes, which are also exposed as CoAP resources
 	Engine          *TransformEngine
+	HttpClient      *http.Client    // Client used to forward cloud-to-device events to their target
+	DeviceKeys      *DeviceKeyTable // Keys of devices authenticating with the adapter, if it manages the Bridge API key
+	Services        *Services
+
+	wasmTransforms []*WasmTransform // WebAssembly modules of the routes, released when the adapter is closed
+	requests       sync.WaitGroup   // Requests being served, acquired through the ReloadableHandler
+	routePaths     []string         // Paths of the device-to-cloud routes, whose rate limiters are kept across reloads
+}
+
+// Services are long-lived components shared by all adapters built over the lifetime of the process, surviving configuration reloads.
+type Services struct {
+	Queue   *MessageQueue // Store-and-forward queue. Nil if not configured
+	Metrics *Metrics      // Prometheus metrics. Nil if disabled
+	Dedup   DedupStore    // Idempotency keys of forwarded messages. Nil if not configured
+	Async   *AsyncPool    // Workers sending the messages of async routes. Nil if not configured
+
+	Registrations *RegistrationCache // Devices registered by the adapter. Nil if not configured
+	RateLimiters  *RateLimiters      // Rate limiters of routes, kept across reloads. Nil if they start over with every adapter
+
+	Retry   *RetryPolicy    // Retries of Bridge calls failing with a transient status. Nil if disabled
+	Breaker *CircuitBreaker // Circuit breaker guarding Bridge calls. Nil if disabled
+
+	// API key used for all Bridge calls, if the adapter manages it. Devices then authenticate with their own keys instead of the Bridge key.
+	BridgeApiKey string
 }
 
 // AugmentedD2CMessage represents a D2C message route definition augmented to include the Id of the cached transform queries.
@@ -62,54 +136,232 @@ type AugmentedD2CMessage struct {
 	D2CMessage
 	TransformId         string
 	DeviceIdBodyQueryId string
+	DedupKeyQueryId     string
+	ModelIdQueryId      string
+	WasmTransform       *WasmTransform
+	RouteLimiter        *RouteRateLimiter
+	DeviceLimiter       *DeviceRateLimiter
 }
 
-// NewAdapter builds a transform adapter for a given configuration.
+// NewAdapter builds a transform adapter for a given configuration, without any shared services.
 func NewAdapter(config *Config, bridgeEndpoint string) (*Adapter, error) {
+	return NewAdapterWithServices(config, bridgeEndpoint, &Services{})
+}
+
+// NewAdapterWithServices builds a transform adapter for a given configuration, using the given shared services.
+func NewAdapterWithServices(config *Config, bridgeEndpoint string, services *Services) (_ *Adapter, err error) {
 	log.Infof("Initializing adapter for Bridge %s", bridgeEndpoint)
 
 	if bridgeEndpoint == "" {
 		return nil, errors.New("transform-adapter: missing Bridge URL")
 	}
 
-	adapter := Adapter{
-		Engine: NewTransformEngine(),
-		Router: mux.NewRouter(),
+	adapter := &Adapter{
+		Engine:     NewTransformEngine(requestVariableNames...),
+		Router:     mux.NewRouter(),
+		MqttRouter: mux.NewRouter(),
+		CoapRouter: mux.NewRouter(),
 		GetBridgeClient: func() BridgeClient {
 			return &BridgeClientAutorest{bridge.NewWithBaseURI(bridgeEndpoint)}
 		},
+		HttpClient: &http.Client{Timeout: targetRequestTimeout},
+		Services:   services,
+		DeviceKeys: config.DeviceKeys,
+	}
+
+	// The WebAssembly modules compiled before a failure are released.
+	defer func() {
+		if err != nil {
+			adapter.Close()
+		}
+	}()
+
+	if services.BridgeApiKey != "" && config.DeviceKeys == nil {
+		return nil, errors.New("transform-adapter: the adapter manages the Bridge API key, but no deviceKeysFile is configured")
+	}
+
+	if services.BridgeApiKey == "" && config.DeviceKeys != nil {
+		return nil, errors.New("transform-adapter: deviceKeysFile requires the adapter to manage the Bridge API key")
+	}
+
+	c2dRoutes, err := adapter.augmentC2DRoutes(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Callback routes are registered first, so they take precedence over the parameterized paths of other routes.
+	for _, route := range c2dRoutes {
+		adapter.Router.HandleFunc(route.CallbackPath, withLogging(services.Metrics.instrument(adapter.buildC2DCallbackHandler(route)))).Methods("POST")
 	}
 
 	for _, message := range config.D2CMessages {
-		log.Infof("Initializing route %s", message.Path)
-		augmentedMessage := AugmentedD2CMessage{D2CMessage: message}
-
-		// Initialize cache for request body transform.
-		if message.Transform != "" {
-			augmentedMessage.TransformId = uuid.New().String()
-			if err := adapter.Engine.AddTransform(augmentedMessage.TransformId, message.Transform); err != nil {
-				return nil, fmt.Errorf("transform-adapter: failed to add request body transform for route %s: %s", message.Path, err)
-			}
-		} else {
-			log.Warnf("Empty transform. Route %s will be set as pass-through", message.Path)
+		augmentedMessage, err := adapter.augmentD2CMessage(message)
+		if err != nil {
+			return nil, err
 		}
 
-		// Initialize cache for device Id transform.
-		if message.DeviceIdBodyQuery != "" {
-			augmentedMessage.DeviceIdBodyQueryId = uuid.New().String()
-			if err := adapter.Engine.AddTransform(augmentedMessage.DeviceIdBodyQueryId, message.DeviceIdBodyQuery); err != nil {
-				return nil, fmt.Errorf("transform-adapter: failed to add device Id query transform for route %s: %s", message.Path, err)
-			}
+		if message.StoreAndForward && services.Queue == nil {
+			return nil, fmt.Errorf("transform-adapter: route %s uses store-and-forward, but no queue is configured", augmentedMessage.Path)
+		}
+
+		if message.DedupKeyQuery != "" && services.Dedup == nil {
+			return nil, fmt.Errorf("transform-adapter: route %s uses deduplication, but no deduplication store is configured", augmentedMessage.Path)
+		}
+
+		if message.AutoRegister != nil && services.Registrations == nil {
+			return nil, fmt.Errorf("transform-adapter: route %s uses autoRegister, but no registration cache is configured", augmentedMessage.Path)
+		}
+
+		if message.Mode == DeliveryModeAsync && services.Async == nil {
+			return nil, fmt.Errorf("transform-adapter: route %s uses async mode, but no async worker pool is configured", augmentedMessage.Path)
 		}
 
 		handler := adapter.buildD2CMessageHandler(augmentedMessage)
-		adapter.Router.HandleFunc(message.Path, withLogging(handler)).Methods("POST")
+		if message.FanOut {
+			handler = adapter.buildFanOutHandler(augmentedMessage)
+		} else if message.Batch {
+			handler = adapter.buildBatchHandler(augmentedMessage)
+		}
+
+		handler = withRouteRateLimit(augmentedMessage.RouteLimiter, services.Metrics, withRouteAuthentication(message, handler))
+		adapter.registerD2CRoute(augmentedMessage, withLogging(services.Metrics.instrument(handler)))
+	}
+
+	for _, message := range config.ReportedProperties {
+		augmentedMessage, err := adapter.augmentD2CMessage(message)
+		if err != nil {
+			return nil, err
+		}
+
+		handler := withRouteRateLimit(augmentedMessage.RouteLimiter, services.Metrics, withRouteAuthentication(message, adapter.buildReportedPropertiesHandler(augmentedMessage)))
+		adapter.registerD2CRoute(augmentedMessage, withLogging(services.Metrics.instrument(handler)))
+	}
+
+	for _, route := range c2dRoutes {
+		adapter.Router.HandleFunc(route.Path, withLogging(services.Metrics.instrument(adapter.buildC2DSubscriptionHandler(route)))).Methods("POST", "DELETE")
 	}
 
-	return &adapter, nil
+	services.RateLimiters.retain(adapter.routePaths)
+	return adapter, nil
 }
 
-func (adapter *Adapter) ListenAndServe(port string) error {
+// Close waits for the requests being served by the adapter to complete, then releases the WebAssembly runtimes of its routes.
+// The adapter must not serve requests afterwards.
+func (adapter *Adapter) Close() {
+	adapter.requests.Wait()
+	for _, wasmTransform := range adapter.wasmTransforms {
+		if err := wasmTransform.Close(); err != nil {
+			log.Warnf("Failed to close WebAssembly module: %s", err)
+		}
+	}
+
+	adapter.wasmTransforms = nil
+}
+
+// withRouteAuthentication wraps the handler of a device-to-cloud route with the signature and bearer token checks of the route, if any.
+func withRouteAuthentication(message D2CMessage, handler func(*log.Entry, http.ResponseWriter, *http.Request)) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	if message.Signature != nil {
+		handler = withSignatureVerification(message.Signature, handler)
+	}
+
+	if message.Jwt != nil {
+		handler = withJwtAuthentication(message.Jwt, handler)
+	}
+
+	return handler
+}
+
+// registerD2CRoute registers the handler of a device-to-cloud route. MQTT topic routes are only registered in the MQTT router,
+// while path routes are registered in the HTTP router, and also in the CoAP router if they can authenticate CoAP requests.
+func (adapter *Adapter) registerD2CRoute(message AugmentedD2CMessage, handler http.HandlerFunc) {
+	if message.Topic != "" {
+		adapter.MqttRouter.HandleFunc(message.Path, handler).Methods("POST")
+		return
+	}
+
+	adapter.Router.HandleFunc(message.Path, handler).Methods("POST")
+	if !coapAuthenticated(message.D2CMessage) {
+		log.Warnf("Route %s isn't exposed through CoAP, since CoAP requests can only be authenticated with authQueryParam", message.Path)
+		return
+	}
+
+	adapter.CoapRouter.HandleFunc(message.Path, handler).Methods("POST")
+}
+
+// coapAuthenticated returns whether CoAP requests to a route can be authenticated. CoAP requests only carry their URI path, query,
+// and content format, so headers, signatures, and bearer tokens aren't available.
+func coapAuthenticated(message D2CMessage) bool {
+	return message.AuthQueryParam != "" && message.Signature == nil && message.Jwt == nil
+}
+
+// augmentD2CMessage compiles the queries of a route definition, adding them to the transform engine.
+// MQTT topic routes are converted into paths of the MQTT router, authenticated with the MQTT password.
+func (adapter *Adapter) augmentD2CMessage(message D2CMessage) (AugmentedD2CMessage, error) {
+	if message.Topic != "" {
+		message.Path, message.AuthHeader = mqttTopicPath(message.Topic), mqttApiKeyHeader
+	}
+
+	log.Infof("Initializing route %s", message.Path)
+	augmentedMessage := AugmentedD2CMessage{
+		D2CMessage:    message,
+		RouteLimiter:  adapter.Services.RateLimiters.route(message.Path, message.RouteRateLimit),
+		DeviceLimiter: adapter.Services.RateLimiters.device(message.Path, message.DeviceRateLimit),
+	}
+
+	adapter.routePaths = append(adapter.routePaths, message.Path)
+
+	// Without a device key, the Bridge can only be called with the adapter-managed API key.
+	if (message.Signature != nil || message.Jwt != nil) && message.AuthHeader == "" && message.AuthQueryParam == "" && adapter.Services.BridgeApiKey == "" {
+		return augmentedMessage, fmt.Errorf("transform-adapter: route %s is authenticated only by its signature or bearer token, which requires the adapter to manage the Bridge API key", message.Path)
+	}
+
+	// Initialize cache for request body transform.
+	if message.Wasm != nil {
+		wasmTransform, err := NewWasmTransform(message.Wasm)
+		if err != nil {
+			return augmentedMessage, fmt.Errorf("transform-adapter: failed to compile WebAssembly module for route %s: %s", message.Path, err)
+		}
+
+		augmentedMessage.WasmTransform = wasmTransform
+		adapter.wasmTransforms = append(adapter.wasmTransforms, wasmTransform)
+	} else if message.Transform != "" {
+		augmentedMessage.TransformId = uuid.New().String()
+		if err := adapter.Engine.AddTransformWithLanguage(augmentedMessage.TransformId, message.TransformLanguage, message.Transform); err != nil {
+			return augmentedMessage, fmt.Errorf("transform-adapter: failed to add request body transform for route %s: %s", message.Path, err)
+		}
+	} else {
+		log.Warnf("Empty transform. Route %s will be set as pass-through", message.Path)
+	}
+
+	// Initialize cache for dedup key query.
+	if message.DedupKeyQuery != "" {
+		augmentedMessage.DedupKeyQueryId = uuid.New().String()
+		if err := adapter.Engine.AddTransform(augmentedMessage.DedupKeyQueryId, message.DedupKeyQuery); err != nil {
+			return augmentedMessage, fmt.Errorf("transform-adapter: failed to add dedup key query for route %s: %s", message.Path, err)
+		}
+	}
+
+	// Initialize cache for model Id query.
+	if message.AutoRegister != nil && message.AutoRegister.ModelIdQuery != "" {
+		augmentedMessage.ModelIdQueryId = uuid.New().String()
+		if err := adapter.Engine.AddTransform(augmentedMessage.ModelIdQueryId, message.AutoRegister.ModelIdQuery); err != nil {
+			return augmentedMessage, fmt.Errorf("transform-adapter: failed to add model Id query for route %s: %s", message.Path, err)
+		}
+	}
+
+	// Initialize cache for device Id transform.
+	if message.DeviceIdBodyQuery != "" {
+		augmentedMessage.DeviceIdBodyQueryId = uuid.New().String()
+		if err := adapter.Engine.AddTransform(augmentedMessage.DeviceIdBodyQueryId, message.DeviceIdBodyQuery); err != nil {
+			return augmentedMessage, fmt.Errorf("transform-adapter: failed to add device Id query transform for route %s: %s", message.Path, err)
+		}
+	}
+
+	return augmentedMessage, nil
+}
+
+// ListenAndServe serves the given handler on the specified port.
+func ListenAndServe(port string, handler http.Handler) error {
 	portInt, err := strconv.Atoi(port)
 
 	if err != nil {
@@ -117,103 +369,120 @@ func (adapter *Adapter) ListenAndServe(port string) error {
 	}
 
 	log.Infof("Server listening on port %d", portInt)
-	return http.ListenAndServe(fmt.Sprintf(":%d", portInt), adapter.Router)
+	return http.ListenAndServe(fmt.Sprintf(":%d", portInt), handler)
 }
 
-// buildD2CMessageHandler builds the HTTP handler for a given C2D route definition.
+// buildD2CMessageHandler builds the HTTP handler for a given D2C route definition.
+// In store-and-forward and async routes, messages are queued instead of sent to the Bridge, responding with 202.
 func (adapter *Adapter) buildD2CMessageHandler(message AugmentedD2CMessage) func(*log.Entry, http.ResponseWriter, *http.Request) {
 	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
-		var jsonBody map[string]interface{}
-		if err := decodeJsonBody(w, r, &jsonBody); err != nil {
-			respondError(logger, w, http.StatusBadRequest, fmt.Errorf("failed to decode JSON body: %w", err))
+		jsonBody, transformedPayload, err := adapter.transformRequestBody(w, r, message)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
 			return
 		}
 
-		// Execute body transformation if one was provided. If not, the route is pass-through.
-		var transformedPayload interface{}
-		if message.TransformId != "" {
-			var err error
-			transformedPayload, err = adapter.Engine.Execute(message.TransformId, jsonBody)
+		bridgePayload, err := toMessageBody(transformedPayload)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
+			return
+		}
 
-			if err != nil {
-				respondError(logger, w, http.StatusBadRequest, fmt.Errorf("payload transformation failed: %w", err))
-				return
-			}
-		} else {
-			transformedPayload = jsonBody
+		if message.StoreAndForward {
+			adapter.enqueueMessage(logger, w, r, message, jsonBody, bridgePayload)
+			return
 		}
 
-		if err := decodeDateTimeField(&transformedPayload, "creationTimeUtc"); err != nil {
-			respondError(logger, w, http.StatusBadRequest, fmt.Errorf("failed to parse \"creationTimeUtc\": %w", err))
+		bridgeClient, deviceId, err := adapter.resolveBridgeRequest(r, message, jsonBody)
+		if err != nil {
+			respondRequestError(logger, w, err)
 			return
 		}
 
-		// Convert transformation output to Autorest typed input.
-		var bridgePayload bridge.MessageBody
-		if err := mapstructure.Decode(transformedPayload, &bridgePayload); err != nil {
-			respondError(logger, w, http.StatusBadRequest, fmt.Errorf("failed to transform payload to expected Device Bridge format: %w", err))
+		dedupKey, err := adapter.dedupKey(r, message, deviceId, jsonBody)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
 			return
 		}
 
-		bridgeClient := adapter.GetBridgeClient()
+		async := message.Mode == DeliveryModeAsync
+		if adapter.reserveDedupKey(logger, dedupKey) {
+			adapter.Services.Metrics.duplicate(r)
+			logger.Infof("Dropped duplicate message for device %s", deviceId)
+			if async {
+				w.WriteHeader(http.StatusAccepted)
+			} else {
+				w.WriteHeader(http.StatusOK)
+			}
 
-		// Extracts the API key from the query parameter or header.
-		var apiKey string
-		if message.AuthQueryParam != "" {
-			values, ok := r.URL.Query()[message.AuthQueryParam]
+			return
+		}
 
-			if !ok || len(values) < 1 {
-				respondError(logger, w, http.StatusBadRequest, fmt.Errorf("expected auth query parameter \"%s\" to be defined", message.AuthQueryParam))
-				return
-			}
+		if err := adapter.registerDevice(logger, r, message, bridgeClient, deviceId, jsonBody); err != nil {
+			adapter.releaseDedupKey(dedupKey)
+			respondError(logger, w, registrationErrorStatus(err), err)
+			return
+		}
 
-			apiKey = values[0]
-		} else if message.AuthHeader != "" {
-			apiKey = r.Header.Get(message.AuthHeader)
-		} else {
-			respondError(logger, w, http.StatusBadRequest, errors.New("no auth method specified"))
+		if async {
+			adapter.submitAsync(logger, w, r, message, bridgeClient, deviceId, dedupKey, bridgePayload)
 			return
 		}
 
-		bridgeClient.SetAuthorizer(autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{
-			"x-api-key": apiKey,
-		}))
+		if bridgeResponse, err := bridgeClient.SendMessage(r.Context(), deviceId, bridgePayload); err != nil {
+			adapter.releaseDedupKey(dedupKey)
+			respondBridgeError(logger, w, bridgeResponse, err)
+			return
+		}
 
-		var deviceId string
-		switch {
-		case message.DeviceIdBodyQueryId != "":
-			queriedDeviceId, err := adapter.Engine.Execute(message.DeviceIdBodyQueryId, jsonBody)
-			if err != nil {
-				respondError(logger, w, http.StatusBadRequest, fmt.Errorf("device Id body query failed: %w", err))
-				return
-			}
+		adapter.recordForwarded(logger, message, dedupKey)
+		w.WriteHeader(http.StatusOK)
+	}
+}
 
-			var ok bool
-			if deviceId, ok = queriedDeviceId.(string); !ok || deviceId == "" {
-				respondError(logger, w, http.StatusBadRequest, errors.New("expected result from device Id body query to be string"))
-				return
-			}
-		case message.DeviceIdPathParam != "":
-			var ok bool
-			if deviceId, ok = mux.Vars(r)[message.DeviceIdPathParam]; !ok {
-				respondError(logger, w, http.StatusBadRequest, fmt.Errorf("expected device Id in \"%s\" path parameter", message.DeviceIdPathParam))
-				return
-			}
-		default:
-			respondError(logger, w, http.StatusBadRequest, errors.New("no device Id specified"))
+// toMessageBody converts a transformation output into the Autorest typed input of the Bridge send message call.
+func toMessageBody(transformedPayload interface{}) (*bridge.MessageBody, error) {
+	if err := decodeDateTimeField(&transformedPayload, "creationTimeUtc"); err != nil {
+		return nil, fmt.Errorf("failed to parse \"creationTimeUtc\": %w", err)
+	}
+
+	var bridgePayload bridge.MessageBody
+	if err := mapstructure.Decode(transformedPayload, &bridgePayload); err != nil {
+		return nil, fmt.Errorf("failed to transform payload to expected Device Bridge format: %w", err)
+	}
+
+	return &bridgePayload, nil
+}
+
+// buildReportedPropertiesHandler builds the HTTP handler for a given reported properties route definition.
+func (adapter *Adapter) buildReportedPropertiesHandler(message AugmentedD2CMessage) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		jsonBody, transformedPayload, err := adapter.transformRequestBody(w, r, message)
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, err)
 			return
 		}
 
-		bridgeClient.SetRetryAttempts(1) // Don't retry (the Bridge already has internal retries)
+		// Convert transformation output to Autorest typed input.
+		var bridgePayload bridge.ReportedPropertiesPatch
+		if err := mapstructure.Decode(transformedPayload, &bridgePayload); err != nil {
+			respondError(logger, w, http.StatusBadRequest, fmt.Errorf("failed to transform payload to expected Device Bridge format: %w", err))
+			return
+		}
 
-		if bridgeResponse, err := bridgeClient.SendMessage(r.Context(), deviceId, &bridgePayload); err != nil {
-			// We return the Bridge status code if we have it
-			responseStatusCode := http.StatusInternalServerError
-			if bridgeResponse != (autorest.Response{}) {
-				responseStatusCode = bridgeResponse.StatusCode
-			}
+		if bridgePayload.Patch == nil {
+			respondError(logger, w, http.StatusBadRequest, errors.New("expected transformed payload to contain a \"patch\" object"))
+			return
+		}
 
-			respondError(logger, w, responseStatusCode, fmt.Errorf("call to Device Bridge failed: %w", err))
+		bridgeClient, deviceId, err := adapter.resolveBridgeRequest(r, message, jsonBody)
+		if err != nil {
+			respondRequestError(logger, w, err)
+			return
+		}
+
+		if bridgeResponse, err := bridgeClient.UpdateReportedProperties(r.Context(), deviceId, &bridgePayload); err != nil {
+			respondBridgeError(logger, w, bridgeResponse, err)
 			return
 		}
 
@@ -221,6 +490,224 @@ func (adapter *Adapter) buildD2CMessageHandler(message AugmentedD2CMessage) func
 	}
 }
 
+// transformRequestBody decodes the request body, according to the route input format, and executes the route body transformation.
+// Returns both the decoded body and the transformation output.
+func (adapter *Adapter) transformRequestBody(w http.ResponseWriter, r *http.Request, message AugmentedD2CMessage) (interface{}, interface{}, error) {
+	// WebAssembly modules take the raw body, and their output takes the place of the decoded body in the rest of the route.
+	if message.WasmTransform != nil {
+		transformedPayload, err := adapter.executeWasmTransform(w, r, message.WasmTransform)
+		return transformedPayload, transformedPayload, err
+	}
+
+	jsonBody, err := decodeRequestBody(w, r, message.Input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Execute body transformation if one was provided. If not, the route is pass-through.
+	if message.TransformId == "" {
+		return jsonBody, jsonBody, nil
+	}
+
+	_, done := adapter.startTransform(r, message.TransformLanguage)
+	transformedPayload, err := adapter.Engine.ExecuteWithVariables(message.TransformId, jsonBody, requestVariables(r))
+	done(err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("payload transformation failed: %w", err)
+	}
+
+	return jsonBody, transformedPayload, nil
+}
+
+// executeWasmTransform reads the raw request body and transforms it with the WebAssembly module of a route.
+func (adapter *Adapter) executeWasmTransform(w http.ResponseWriter, r *http.Request, wasmTransform *WasmTransform) (interface{}, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	ctx, done := adapter.startTransform(r, wasmTransformLanguage)
+	transformedPayload, err := wasmTransform.Execute(ctx, body, r.Header)
+	done(err)
+	if err != nil {
+		return nil, fmt.Errorf("payload transformation failed: %w", err)
+	}
+
+	return transformedPayload, nil
+}
+
+// startTransform starts tracing and measuring the execution of a route transform in the given language (jq if empty).
+// Returns the context of the transform span, and a function that must be called with the outcome of the execution once
+// it completes.
+func (adapter *Adapter) startTransform(r *http.Request, language string) (context.Context, func(error)) {
+	if language == "" {
+		language = TransformLanguageJq
+	}
+
+	startTime := time.Now()
+	ctx, span := startSpan(r.Context(), "transform", attribute.String("transform.language", language))
+	return ctx, func(err error) {
+		endSpan(span, err)
+		adapter.Services.Metrics.observeTransform(r, language, startTime, err)
+	}
+}
+
+// resolveBridgeRequest resolves the target device Id and builds a Bridge client authenticated on its behalf (see authorizeDevice),
+// once the message is admitted by the per-device rate limit of the route.
+func (adapter *Adapter) resolveBridgeRequest(r *http.Request, message AugmentedD2CMessage, jsonBody interface{}) (BridgeClient, string, error) {
+	apiKey, err := resolveApiKey(r, message.AuthHeader, message.AuthQueryParam)
+	if err != nil {
+		return nil, "", err
+	}
+
+	deviceId, err := adapter.resolveDeviceId(r, message.DeviceIdPathParam, message.DeviceIdBodyQueryId, jsonBody)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if apiKey, err = adapter.authorizeDevice(r, deviceId, apiKey); err != nil {
+		return nil, "", err
+	}
+
+	if err := adapter.limitDevice(r, message, deviceId); err != nil {
+		return nil, "", err
+	}
+
+	return adapter.newBridgeClient(r, apiKey), deviceId, nil
+}
+
+// resolveApiKey extracts the API key from the query parameter or header. Requests authenticated by their signature or bearer token
+// may not carry one.
+func resolveApiKey(r *http.Request, authHeader string, authQueryParam string) (string, error) {
+	if authQueryParam != "" {
+		values, ok := r.URL.Query()[authQueryParam]
+
+		if !ok || len(values) < 1 {
+			return "", fmt.Errorf("expected auth query parameter \"%s\" to be defined", authQueryParam)
+		}
+
+		return values[0], nil
+	} else if authHeader != "" {
+		return r.Header.Get(authHeader), nil
+	} else if authenticatedByRoute(r) {
+		// Routes authenticated only by their signature or bearer token don't carry an API key (see authorizeDevice).
+		return "", nil
+	}
+
+	return "", errors.New("no auth method specified")
+}
+
+// resolveDeviceId extracts the device Id from the path parameter or by executing the device Id query over the request body.
+func (adapter *Adapter) resolveDeviceId(r *http.Request, deviceIdPathParam string, deviceIdBodyQueryId string, jsonBody interface{}) (_ string, err error) {
+	_, span := startSpan(r.Context(), "resolve device Id")
+	defer func() {
+		endSpan(span, err)
+		if err != nil {
+			adapter.Services.Metrics.deviceIdFailure(r)
+		}
+	}()
+
+	switch {
+	case deviceIdBodyQueryId != "":
+		queriedDeviceId, err := adapter.Engine.ExecuteWithVariables(deviceIdBodyQueryId, jsonBody, requestVariables(r))
+		if err != nil {
+			return "", fmt.Errorf("device Id body query failed: %w", err)
+		}
+
+		if deviceId, ok := queriedDeviceId.(string); ok && deviceId != "" {
+			return deviceId, nil
+		}
+
+		return "", errors.New("expected result from device Id body query to be string")
+	case deviceIdPathParam != "":
+		if deviceId, ok := mux.Vars(r)[deviceIdPathParam]; ok {
+			return deviceId, nil
+		}
+
+		return "", fmt.Errorf("expected device Id in \"%s\" path parameter", deviceIdPathParam)
+	default:
+		return "", errors.New("no device Id specified")
+	}
+}
+
+// requestVariables returns the values of the request metadata variables available to transforms:
+//   - $headers: request headers, with lowercase names. Multiple values of the same header are joined by commas.
+//   - $query: query parameters. Only the first value of each parameter is included.
+//   - $path: path parameters.
+//   - $route: path definition of the route that matched the request.
+func requestVariables(r *http.Request) map[string]interface{} {
+	headers := make(map[string]interface{}, len(r.Header))
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+
+	query := make(map[string]interface{})
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query[name] = values[0]
+		}
+	}
+
+	path := make(map[string]interface{})
+	for name, value := range mux.Vars(r) {
+		path[name] = value
+	}
+
+	// Claims are null for requests that weren't authenticated with a bearer token.
+	var claims interface{}
+	if tokenClaims := jwtClaims(r); tokenClaims != nil {
+		claims = map[string]interface{}(tokenClaims)
+	}
+
+	var route interface{}
+	if currentRoute := mux.CurrentRoute(r); currentRoute != nil {
+		if template, err := currentRoute.GetPathTemplate(); err == nil {
+			route = template
+		}
+	}
+
+	return map[string]interface{}{
+		"$headers": headers,
+		"$query":   query,
+		"$path":    path,
+		"$route":   route,
+		"$claims":  claims,
+	}
+}
+
+// newBridgeClient builds a Bridge client authenticated with the given API key, recording metrics under the route of the request.
+// Its device-to-cloud calls are retried and guarded by the circuit breaker, if configured.
+func (adapter *Adapter) newBridgeClient(r *http.Request, apiKey string) BridgeClient {
+	route := routeLabel(r)
+	services := adapter.Services
+	client := services.Metrics.instrumentBridgeClient(route, authorizeBridgeClient(adapter.GetBridgeClient(), apiKey))
+	return withResilience(client, services.Retry, services.Breaker, services.Metrics, route)
+}
+
+// authorizeBridgeClient sets up a Bridge client to authenticate with the given API key.
+func authorizeBridgeClient(bridgeClient BridgeClient, apiKey string) BridgeClient {
+	bridgeClient.SetAuthorizer(autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{
+		"x-api-key": apiKey,
+	}))
+	// Autorest doesn't retry, so transient failures are only retried by withResilience, according to the configured retry policy.
+	bridgeClient.SetRetryAttempts(1)
+	return bridgeClient
+}
+
+// respondBridgeError responds with the error of a failed Bridge call.
+func respondBridgeError(logger *log.Entry, w http.ResponseWriter, bridgeResponse autorest.Response, err error) {
+	respondError(logger, w, bridgeStatusCode(bridgeResponse), fmt.Errorf("call to Device Bridge failed: %w", err))
+}
+
+// bridgeStatusCode returns the status code of a failed Bridge call. We return the Bridge status code if we have it.
+func bridgeStatusCode(bridgeResponse autorest.Response) int {
+	if bridgeResponse != (autorest.Response{}) {
+		return bridgeResponse.StatusCode
+	}
+
+	return http.StatusInternalServerError
+}
+
 // LoggingResponseWriter is an HTTP response writer extended to capture the response status.
 type LoggingResponseWriter struct {
 	http.ResponseWriter
@@ -232,20 +719,60 @@ func (r *LoggingResponseWriter) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// bufferedResponseWriter captures the response of a route handler serving a message received through a protocol other than HTTP.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: http.Header{}}
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
 // withLogging wraps a request handler, logging the request, response, and injecting a logger with request context.
+// The request is traced in a server span. If the request is part of a trace, its trace Id is used as the request Id.
 func withLogging(handler func(*log.Entry, http.ResponseWriter, *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
-		logger := log.WithField("request_id", makeShortId())
+		r, span := startRequestSpan(r)
+		requestId := traceId(span)
+		if requestId == "" {
+			requestId = makeShortId()
+		}
+
+		logger := log.WithField("request_id", requestId)
 		logger.Infof("HTTP request. Path %s", r.URL.Path)
 		loggingResponseWriter := &LoggingResponseWriter{ResponseWriter: w}
 		handler(logger, loggingResponseWriter, r)
+		endRequestSpan(span, loggingResponseWriter.ResponseStatus)
 		duration := time.Since(startTime).String()
 		logger.Infof("HTTP response. Path %s, status %d, duration %s", r.URL.Path, loggingResponseWriter.ResponseStatus, duration)
 	}
 }
 
-func decodeJsonBody(w http.ResponseWriter, r *http.Request, output *map[string]interface{}) error {
+func decodeJsonBody(w http.ResponseWriter, r *http.Request, output *map[string]interface{}) (err error) {
+	_, span := startSpan(r.Context(), "decode JSON body")
+	defer func() { endSpan(span, err) }()
+
 	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
 	decoder := json.NewDecoder(r.Body)
 	return decoder.Decode(output)
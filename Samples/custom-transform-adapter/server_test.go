@@ -15,9 +15,16 @@ import (
 )
 
 type BridgeClientMock struct {
-	LastSendMessageBody     *bridge.MessageBody
-	LastSendMessageDeviceId string
-	LastAuthorizer          autorest.Authorizer
+	LastSendMessageBody                  *bridge.MessageBody
+	LastSendMessageDeviceId              string
+	LastUpdateReportedPropertiesBody     *bridge.ReportedPropertiesPatch
+	LastUpdateReportedPropertiesDeviceId string
+	LastSubscriptionType                 string
+	LastSubscriptionDeviceId             string
+	LastSubscriptionBody                 *bridge.SubscriptionCreateOrUpdateBody
+	LastRegisterDeviceId                 string
+	LastRegisterBody                     *bridge.RegistrationBody
+	LastAuthorizer                       autorest.Authorizer
 }
 
 func (client *BridgeClientMock) SetAuthorizer(authorizer autorest.Authorizer) {
@@ -33,6 +40,57 @@ func (client *BridgeClientMock) SendMessage(ctx context.Context, deviceID string
 	return autorest.Response{}, nil
 }
 
+func (client *BridgeClientMock) UpdateReportedProperties(ctx context.Context, deviceID string, body *bridge.ReportedPropertiesPatch) (autorest.Response, error) {
+	client.LastUpdateReportedPropertiesBody = body
+	client.LastUpdateReportedPropertiesDeviceId = deviceID
+	return autorest.Response{}, nil
+}
+
+func (client *BridgeClientMock) Register(ctx context.Context, deviceID string, body *bridge.RegistrationBody) (autorest.Response, error) {
+	client.LastRegisterDeviceId = deviceID
+	client.LastRegisterBody = body
+	return autorest.Response{}, nil
+}
+
+func (client *BridgeClientMock) createOrUpdateSubscription(subscriptionType string, deviceID string, body *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error) {
+	client.LastSubscriptionType = subscriptionType
+	client.LastSubscriptionDeviceId = deviceID
+	client.LastSubscriptionBody = body
+	status := "Starting"
+	return bridge.DeviceSubscriptionWithStatus{DeviceID: &deviceID, SubscriptionType: &subscriptionType, CallbackURL: body.CallbackURL, Status: &status}, nil
+}
+
+func (client *BridgeClientMock) deleteSubscription(subscriptionType string, deviceID string) (autorest.Response, error) {
+	client.LastSubscriptionType = subscriptionType
+	client.LastSubscriptionDeviceId = deviceID
+	client.LastSubscriptionBody = nil
+	return autorest.Response{}, nil
+}
+
+func (client *BridgeClientMock) CreateOrUpdateMethodsSubscription(ctx context.Context, deviceID string, body *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error) {
+	return client.createOrUpdateSubscription("Methods", deviceID, body)
+}
+
+func (client *BridgeClientMock) CreateOrUpdateC2DMessageSubscription(ctx context.Context, deviceID string, body *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error) {
+	return client.createOrUpdateSubscription("C2DMessages", deviceID, body)
+}
+
+func (client *BridgeClientMock) CreateOrUpdateDesiredPropertiesSubscription(ctx context.Context, deviceID string, body *bridge.SubscriptionCreateOrUpdateBody) (bridge.DeviceSubscriptionWithStatus, error) {
+	return client.createOrUpdateSubscription("DesiredProperties", deviceID, body)
+}
+
+func (client *BridgeClientMock) DeleteMethodsSubscription(ctx context.Context, deviceID string) (autorest.Response, error) {
+	return client.deleteSubscription("Methods", deviceID)
+}
+
+func (client *BridgeClientMock) DeleteC2DMessageSubscription(ctx context.Context, deviceID string) (autorest.Response, error) {
+	return client.deleteSubscription("C2DMessages", deviceID)
+}
+
+func (client *BridgeClientMock) DeleteDesiredPropertiesSubscription(ctx context.Context, deviceID string) (autorest.Response, error) {
+	return client.deleteSubscription("DesiredProperties", deviceID)
+}
+
 func (client *BridgeClientMock) GetBaseURI() string {
 	return "test"
 }
@@ -53,6 +111,10 @@ func (client *BridgeWithBrokenSend) SendMessage(ctx context.Context, deviceID st
 	return client.respose, client.err
 }
 
+func (client *BridgeWithBrokenSend) UpdateReportedProperties(ctx context.Context, deviceID string, body *bridge.ReportedPropertiesPatch) (autorest.Response, error) {
+	return client.respose, client.err
+}
+
 func TestNewAdapterFromConfigBridgeUrl(t *testing.T) {
 	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
 		{
@@ -455,3 +517,167 @@ func TestMultipleRoutes(t *testing.T) {
 	assert.Equal(t, "body_id", mockBridgeClient.LastSendMessageDeviceId)
 	assert.Equal(t, float64(30), mockBridgeClient.LastSendMessageBody.Data["humidity"])
 }
+
+func TestReportedPropertiesTransform(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{ReportedProperties: []D2CMessage{
+		{
+			Path:              "/{id}/properties",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			Transform:         "{ patch: .state }",
+		},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	var jsonBody = []byte(`{ "state": {"firmware": "1.0.2"} }`)
+	req, _ := http.NewRequest("POST", "/test_device_properties/properties", bytes.NewBuffer(jsonBody))
+	req.Header.Add("key", "test_key")
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "test_device_properties", mockBridgeClient.LastUpdateReportedPropertiesDeviceId)
+	assert.Equal(t, "1.0.2", mockBridgeClient.LastUpdateReportedPropertiesBody.Patch["firmware"])
+}
+
+func TestReportedPropertiesDeviceIdBodyQuery(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{ReportedProperties: []D2CMessage{
+		{
+			Path:              "/properties",
+			DeviceIdBodyQuery: ".device.id",
+			AuthQueryParam:    "key",
+		},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	var jsonBody = []byte(`{ "device": { "id": "body_id" }, "patch": {"serial": "ABC"}}`)
+	req, _ := http.NewRequest("POST", "/properties?key=my_key", bytes.NewBuffer(jsonBody))
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "body_id", mockBridgeClient.LastUpdateReportedPropertiesDeviceId)
+	assert.Equal(t, "ABC", mockBridgeClient.LastUpdateReportedPropertiesBody.Patch["serial"])
+}
+
+func TestReportedPropertiesMissingPatch(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{ReportedProperties: []D2CMessage{
+		{
+			Path:              "/{id}/properties",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			Transform:         "{ state: . }",
+		},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	var jsonBody = []byte(`{ "firmware": "1.0.2" }`)
+	req, _ := http.NewRequest("POST", "/test_device/properties", bytes.NewBuffer(jsonBody))
+	req.Header.Add("key", "test_key")
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 400, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "expected transformed payload to contain a \\\"patch\\\" object")
+}
+
+func TestReportedPropertiesBridgeStatusCode(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{ReportedProperties: []D2CMessage{
+		{
+			Path:              "/{id}/properties",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+		},
+	}}, "localhost:1000")
+
+	var brokenBridgeClient = BridgeWithBrokenSend{err: errors.New("unauthorized"), respose: autorest.Response{Response: &http.Response{StatusCode: 401}}}
+
+	adapter.GetBridgeClient = func() BridgeClient {
+		return &brokenBridgeClient
+	}
+
+	var jsonBody = []byte(`{ "patch": {} }`)
+	req, _ := http.NewRequest("POST", "/test_device/properties", bytes.NewBuffer(jsonBody))
+	req.Header.Add("key", "test_key")
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 401, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "call to Device Bridge failed: unauthorized")
+}
+
+func TestD2CMessagesAndReportedPropertiesRoutes(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{
+		D2CMessages: []D2CMessage{
+			{
+				Path:              "/{id}/message",
+				DeviceIdPathParam: "id",
+				AuthHeader:        "key",
+			},
+		},
+		ReportedProperties: []D2CMessage{
+			{
+				Path:              "/{id}/properties",
+				DeviceIdPathParam: "id",
+				AuthHeader:        "key",
+			},
+		},
+	}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	req, _ := http.NewRequest("POST", "/message_device/message", bytes.NewBuffer([]byte(`{ "data": {"temperature": 30} }`)))
+	req.Header.Add("key", "test_key")
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "message_device", mockBridgeClient.LastSendMessageDeviceId)
+
+	req, _ = http.NewRequest("POST", "/properties_device/properties", bytes.NewBuffer([]byte(`{ "patch": {"serial": "ABC"} }`)))
+	req.Header.Add("key", "test_key")
+	recorder = httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "properties_device", mockBridgeClient.LastUpdateReportedPropertiesDeviceId)
+}
+
+func TestTransformRequestMetadataVariables(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/{type}/{id}/message",
+			DeviceIdPathParam: "id",
+			AuthHeader:        "key",
+			Transform:         "{ data: .telemetry, properties: { deviceType: $path.type, firmware: $headers[\"x-firmware\"], timestamp: $query.ts, route: $route } }",
+		},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	var jsonBody = []byte(`{ "telemetry": {"temperature": 21} }`)
+	req, _ := http.NewRequest("POST", "/thermostat/test_device/message?ts=1234", bytes.NewBuffer(jsonBody))
+	req.Header.Add("key", "test_key")
+	req.Header.Add("X-Firmware", "1.0.2")
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "test_device", mockBridgeClient.LastSendMessageDeviceId)
+	properties := mockBridgeClient.LastSendMessageBody.Properties
+	assert.Equal(t, "thermostat", *properties["deviceType"])
+	assert.Equal(t, "1.0.2", *properties["firmware"])
+	assert.Equal(t, "1234", *properties["timestamp"])
+	assert.Equal(t, "/{type}/{id}/message", *properties["route"])
+}
+
+func TestDeviceIdBodyQueryFromHeader(t *testing.T) {
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{
+			Path:              "/message",
+			DeviceIdBodyQuery: "$headers[\"x-device-id\"] // .device.id",
+			AuthHeader:        "key",
+		},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	var jsonBody = []byte(`{ "device": { "id": "body_id" }}`)
+	req, _ := http.NewRequest("POST", "/message", bytes.NewBuffer(jsonBody))
+	req.Header.Add("key", "test_key")
+	req.Header.Add("X-Device-Id", "header_id")
+	recorder := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "header_id", mockBridgeClient.LastSendMessageDeviceId)
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSignatureAlgorithm    = "sha256"
+	defaultSignatureEncoding     = "hex"
+	defaultSignedContent         = "{body}"
+	defaultSignatureReplayWindow = 5 * time.Minute
+)
+
+// signatureAlgorithms are the hash functions supported for HMAC signatures.
+var signatureAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// signatureEncodings are the supported encodings of signatures in the signature header.
+var signatureEncodings = map[string]func(string) ([]byte, error){
+	"hex":       hex.DecodeString,
+	"base64":    base64.StdEncoding.DecodeString,
+	"base64url": base64.RawURLEncoding.DecodeString,
+}
+
+// SignatureOptions describes how the HMAC signature of the requests of a route is verified, as typically done by webhooks.
+type SignatureOptions struct {
+	Header          string        // Header containing the signature
+	Algorithm       string        // Hash function of the HMAC (sha1, sha256, or sha512)
+	Encoding        string        // Encoding of the signature (hex, base64, or base64url)
+	Prefix          string        // Prefix of the signature in the header, e.g., "sha256="
+	Secret          string        // HMAC secret
+	TimestampHeader string        // Optional header containing the time at which the request was signed
+	ReplayWindow    time.Duration // Maximum difference between the signing time and the current time
+	SignedContent   string        // Template of the signed content, with {body} and {timestamp} placeholders
+}
+
+// signatureVerifiedKey is the context key flagging requests whose signature was verified.
+type signatureVerifiedKey struct{}
+
+// withSignatureVerification wraps the handler of a route, verifying the signature of the raw request body before it's decoded.
+// Requests with a missing or invalid signature, or signed outside of the replay window, are rejected with 401.
+func withSignatureVerification(options *SignatureOptions, handler func(*log.Entry, http.ResponseWriter, *http.Request)) func(*log.Entry, http.ResponseWriter, *http.Request) {
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			respondError(logger, w, http.StatusBadRequest, fmt.Errorf("failed to read body: %w", err))
+			return
+		}
+
+		if err := options.verify(r.Header, body, time.Now()); err != nil {
+			respondError(logger, w, http.StatusUnauthorized, err)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), signatureVerifiedKey{}, true))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler(logger, w, r)
+	}
+}
+
+// signatureVerified returns whether the signature of a request was verified.
+func signatureVerified(r *http.Request) bool {
+	verified, _ := r.Context().Value(signatureVerifiedKey{}).(bool)
+	return verified
+}
+
+// verify checks the signature of a request, given its headers and raw body.
+func (options *SignatureOptions) verify(header http.Header, body []byte, now time.Time) error {
+	signatureValue := header.Get(options.Header)
+	if signatureValue == "" {
+		return fmt.Errorf("missing signature header %q", options.Header)
+	}
+
+	if !strings.HasPrefix(signatureValue, options.Prefix) {
+		return errors.New("invalid signature")
+	}
+
+	signature, err := signatureEncodings[options.Encoding](strings.TrimPrefix(signatureValue, options.Prefix))
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+
+	timestamp := ""
+	if options.TimestampHeader != "" {
+		timestamp = header.Get(options.TimestampHeader)
+		signedAt, err := parseSignatureTimestamp(timestamp)
+		if err != nil {
+			return fmt.Errorf("invalid signature timestamp: %w", err)
+		}
+
+		if age := now.Sub(signedAt); age > options.ReplayWindow || age < -options.ReplayWindow {
+			return errors.New("signature timestamp outside of the replay window")
+		}
+	}
+
+	// The template is split around the body, so the body itself is never scanned for placeholders.
+	contentPrefix, contentSuffix, _ := strings.Cut(options.SignedContent, "{body}")
+	mac := hmac.New(signatureAlgorithms[options.Algorithm], []byte(options.Secret))
+	mac.Write([]byte(strings.ReplaceAll(contentPrefix, "{timestamp}", timestamp)))
+	mac.Write(body)
+	mac.Write([]byte(strings.ReplaceAll(contentSuffix, "{timestamp}", timestamp)))
+
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// parseSignatureTimestamp parses a signing time, either as Unix time in seconds or milliseconds, or as an RFC 3339 timestamp.
+func parseSignatureTimestamp(timestamp string) (time.Time, error) {
+	if timestamp == "" {
+		return time.Time{}, errors.New("missing timestamp")
+	}
+
+	if unix, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		// Values too large to be seconds (beyond the year 33658) are milliseconds.
+		if unix > 1e12 {
+			return time.UnixMilli(unix), nil
+		}
+
+		return time.Unix(unix, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, timestamp)
+}
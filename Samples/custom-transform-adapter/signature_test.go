@@ -0,0 +1,138 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signTestContent(secret string, content string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+func TestSignatureVerify(t *testing.T) {
+	options := &SignatureOptions{Header: "X-Hub-Signature-256", Algorithm: "sha256", Encoding: "hex", Prefix: "sha256=", Secret: "secret", SignedContent: "{body}"}
+	body := []byte(`{"temp": 21}`)
+	header := http.Header{}
+	now := time.Now()
+
+	assert.EqualError(t, options.verify(header, body, now), `missing signature header "X-Hub-Signature-256"`)
+
+	header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(signTestContent("secret", string(body))))
+	assert.NoError(t, options.verify(header, body, now))
+	assert.EqualError(t, options.verify(header, []byte(`{"temp": 22}`), now), "invalid signature")
+
+	header.Set("X-Hub-Signature-256", hex.EncodeToString(signTestContent("secret", string(body))))
+	assert.EqualError(t, options.verify(header, body, now), "invalid signature")
+
+	header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(signTestContent("other", string(body))))
+	assert.EqualError(t, options.verify(header, body, now), "invalid signature")
+}
+
+func TestSignatureVerifyEncodingAndAlgorithm(t *testing.T) {
+	options := &SignatureOptions{Header: "X-Signature", Algorithm: "sha1", Encoding: "base64", Secret: "secret", SignedContent: "{body}"}
+	body := []byte("payload")
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write(body)
+
+	header := http.Header{"X-Signature": {base64.StdEncoding.EncodeToString(mac.Sum(nil))}}
+	assert.NoError(t, options.verify(header, body, time.Now()))
+
+	header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	assert.EqualError(t, options.verify(header, body, time.Now()), "invalid signature")
+}
+
+func TestSignatureVerifyTimestamp(t *testing.T) {
+	options := &SignatureOptions{Header: "X-Signature", Algorithm: "sha256", Encoding: "hex", Secret: "secret", TimestampHeader: "X-Timestamp", ReplayWindow: 5 * time.Minute, SignedContent: "v0:{timestamp}:{body}"}
+	body := []byte(`{"temp": 21}`)
+	now := time.Now()
+	signedAt := strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)
+
+	header := http.Header{}
+	header.Set("X-Timestamp", signedAt)
+	header.Set("X-Signature", hex.EncodeToString(signTestContent("secret", "v0:"+signedAt+":"+string(body))))
+	assert.NoError(t, options.verify(header, body, now))
+	assert.EqualError(t, options.verify(header, body, now.Add(10*time.Minute)), "signature timestamp outside of the replay window")
+
+	// The timestamp is part of the signed content, so it can't be refreshed by a replaying client.
+	header.Set("X-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	assert.EqualError(t, options.verify(header, body, now), "invalid signature")
+
+	header.Del("X-Timestamp")
+	assert.EqualError(t, options.verify(header, body, now), "invalid signature timestamp: missing timestamp")
+}
+
+func TestParseSignatureTimestamp(t *testing.T) {
+	expected := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, timestamp := range []string{"1714564800", "1714564800000", "2024-05-01T12:00:00Z"} {
+		parsed, err := parseSignatureTimestamp(timestamp)
+		require.NoError(t, err)
+		assert.True(t, expected.Equal(parsed), timestamp)
+	}
+
+	_, err := parseSignatureTimestamp("yesterday")
+	assert.Error(t, err)
+}
+
+func TestSignedRoute(t *testing.T) {
+	client := &BridgeClientMock{}
+	adapter, err := NewAdapterWithServices(&Config{
+		D2CMessages: []D2CMessage{{
+			Path:              "/webhook",
+			DeviceIdBodyQuery: ".device",
+			Transform:         "{ data: { temperature: .temp } }",
+			Signature:         &SignatureOptions{Header: "X-Signature", Algorithm: "sha256", Encoding: "hex", Secret: "secret", SignedContent: "{body}"},
+		}},
+		DeviceKeys: buildTestDeviceKeyTable(),
+	}, "localhost:1000", &Services{BridgeApiKey: "bridge_key"})
+
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return client }
+
+	send := func(body string, signature string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(body))
+		req.Header.Set("X-Signature", signature)
+		recorder := httptest.NewRecorder()
+		adapter.Router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	body := `{"device": "device-1", "temp": 21}`
+	assert.Equal(t, 200, send(body, hex.EncodeToString(signTestContent("secret", body))).Code)
+	assert.Equal(t, "device-1", client.LastSendMessageDeviceId)
+	assert.Equal(t, float64(21), client.LastSendMessageBody.Data["temperature"])
+	assert.Equal(t, autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"x-api-key": "bridge_key"}), client.LastAuthorizer)
+
+	client.LastSendMessageDeviceId = ""
+	response := send(`{"device": "device-2", "temp": 21}`, hex.EncodeToString(signTestContent("secret", body)))
+	assert.Equal(t, 401, response.Code)
+	assert.JSONEq(t, `{"error": "invalid signature"}`, response.Body.String())
+	assert.Empty(t, client.LastSendMessageDeviceId)
+}
+
+func TestSignedRouteRequiresManagedApiKey(t *testing.T) {
+	_, err := NewAdapter(&Config{D2CMessages: []D2CMessage{{
+		Path:              "/webhook",
+		DeviceIdBodyQuery: ".device",
+		Signature:         &SignatureOptions{Header: "X-Signature", Algorithm: "sha256", Encoding: "hex", Secret: "secret", SignedContent: "{body}"},
+	}}}, "localhost:1000")
+
+	assert.EqualError(t, err, "transform-adapter: route /webhook is authenticated only by its signature or bearer token, which requires the adapter to manage the Bridge API key")
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/Azure/go-autorest/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/iot-for-all/iotc-device-bridge/custom-transform-adapter"
+	defaultServiceName = "custom-transform-adapter"
+)
+
+// InitTracing sets up W3C trace context propagation for incoming requests and outgoing Bridge calls. If an OTLP endpoint
+// is configured (through the standard OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT environment
+// variables), spans are also exported to it. Returns a function that flushes pending spans on shutdown.
+func InitTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracing.Register(autorestTracer{})
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The service name can be overridden through the standard OTEL_SERVICE_NAME environment variable.
+	traceResource, err := resource.New(ctx, resource.WithAttributes(attribute.String("service.name", defaultServiceName)), resource.WithFromEnv())
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(traceResource))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// startSpan starts an internal span, with the given attributes, as a child of the span in the given context.
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan ends a span, recording the error of the operation it represents, if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// startRequestSpan starts the server span of an incoming request, continuing the trace of the W3C traceparent header if present.
+func startRequestSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method+" "+routeLabel(r), trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("http.route", routeLabel(r)),
+	))
+
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan ends the server span of a request, recording the response status. Server errors mark the span as failed.
+func endRequestSpan(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+
+	span.End()
+}
+
+// traceId returns the Id of the trace of a span, or an empty string if the span isn't part of a trace.
+func traceId(span trace.Span) string {
+	if spanContext := span.SpanContext(); spanContext.HasTraceID() {
+		return spanContext.TraceID().String()
+	}
+
+	return ""
+}
+
+// injectTraceContext returns the W3C trace context of the span in the given context, to be propagated through the store-and-forward queue.
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+
+	return carrier
+}
+
+// extractTraceContext returns a context continuing the trace of a W3C trace context obtained through injectTraceContext.
+func extractTraceContext(ctx context.Context, traceContext map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(traceContext))
+}
+
+// autorestTracer plugs OpenTelemetry into the tracing hooks of the Autorest-generated Bridge client, creating a client span
+// for each Bridge call and propagating its trace context to the Bridge.
+type autorestTracer struct{}
+
+func (autorestTracer) NewTransport(base *http.Transport) http.RoundTripper {
+	return &tracingTransport{base: base}
+}
+
+func (autorestTracer) StartSpan(ctx context.Context, name string) context.Context {
+	ctx, _ = otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx
+}
+
+func (autorestTracer) EndSpan(ctx context.Context, httpStatusCode int, err error) {
+	span := trace.SpanFromContext(ctx)
+	if httpStatusCode > 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", httpStatusCode))
+	}
+
+	endSpan(span, err)
+}
+
+// tracingTransport injects the trace context of outgoing requests in the W3C traceparent header.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (transport *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	otel.GetTextMapPropagator().Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	return transport.base.RoundTrip(r)
+}
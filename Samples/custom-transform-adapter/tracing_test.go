@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// setupTestTracing records all spans in memory until the end of the test.
+func setupTestTracing(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	return recorder
+}
+
+func TestTracingRequestSpans(t *testing.T) {
+	recorder := setupTestTracing(t)
+	logs := logtest.NewGlobal()
+	defer logs.Reset()
+
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", Transform: "{ data: . }"},
+	}}, "localhost:1000")
+
+	adapter.GetBridgeClient = mockGetBridgeClient
+	req, _ := http.NewRequest("POST", "/test_device/message", bytes.NewBufferString(`{"temperature": 21}`))
+	req.Header.Add("key", "test_key")
+	req.Header.Add("traceparent", testTraceparent)
+	response := httptest.NewRecorder()
+	adapter.Router.ServeHTTP(response, req)
+	assert.Equal(t, 200, response.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+		spans[span.Name()] = span
+	}
+
+	assert.Len(t, spans, 4)
+	assert.Equal(t, trace.SpanKindServer, spans["POST /{id}/message"].SpanKind())
+	assert.Equal(t, "00f067aa0ba902b7", spans["POST /{id}/message"].Parent().SpanID().String())
+	for _, name := range []string{"decode JSON body", "transform", "resolve device Id"} {
+		assert.Equal(t, spans["POST /{id}/message"].SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+	}
+
+	assert.Contains(t, spans["transform"].Attributes(), attribute.String("transform.language", "jq"))
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", logs.LastEntry().Data["request_id"])
+}
+
+func TestTracingFailedTransformSpan(t *testing.T) {
+	recorder := setupTestTracing(t)
+	adapter, _ := NewAdapter(&Config{D2CMessages: []D2CMessage{
+		{Path: "/{id}/message", DeviceIdPathParam: "id", AuthHeader: "key", Transform: "{ data: (.temperature / 0) }"},
+	}}, "localhost:1000")
+
+	assert.Equal(t, 400, sendTestMessage(adapter.Router, "/test_device/message", `{"temperature": 21}`).Code)
+	for _, span := range recorder.Ended() {
+		if span.Name() == "transform" {
+			assert.Equal(t, "Error", span.Status().Code.String())
+			return
+		}
+	}
+
+	assert.Fail(t, "transform span not recorded")
+}
+
+func TestTracingBridgeCall(t *testing.T) {
+	recorder := setupTestTracing(t)
+	var receivedTraceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedTraceparent = r.Header.Get("traceparent")
+	}))
+
+	defer server.Close()
+
+	tracer := autorestTracer{}
+	ctx := tracer.StartSpan(context.Background(), "bridge/BaseClient.SendMessage")
+	req, _ := http.NewRequestWithContext(ctx, "POST", server.URL, nil)
+	resp, err := tracer.NewTransport(http.DefaultTransport.(*http.Transport)).RoundTrip(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	tracer.EndSpan(ctx, 200, nil)
+
+	assert.Empty(t, req.Header.Get("traceparent"))
+	assert.Len(t, recorder.Ended(), 1)
+	span := recorder.Ended()[0]
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind())
+	assert.Equal(t, "00-"+span.SpanContext().TraceID().String()+"-"+span.SpanContext().SpanID().String()+"-01", receivedTraceparent)
+}
+
+func TestTracingQueueContext(t *testing.T) {
+	setupTestTracing(t)
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier{"traceparent": testTraceparent})
+	traceContext := injectTraceContext(ctx)
+	assert.Equal(t, map[string]string{"traceparent": testTraceparent}, traceContext)
+
+	extracted := trace.SpanContextFromContext(extractTraceContext(context.Background(), traceContext))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", extracted.TraceID().String())
+	assert.Nil(t, injectTraceContext(context.Background()))
+}
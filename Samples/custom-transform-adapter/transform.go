@@ -8,23 +8,69 @@ import (
 	"github.com/itchyny/gojq"
 )
 
-// TransformEngine keeps a set of pre-compiled jq queries ready for execution
+// Languages in which transforms can be written.
+const (
+	TransformLanguageJq         = "jq"
+	TransformLanguageCel        = "cel"
+	TransformLanguageGoTemplate = "gotemplate"
+)
+
+// TransformLanguage compiles queries written in one of the languages supported by the transform engine.
+type TransformLanguage interface {
+	// Compile pre-compiles a query, which may reference the given variables (e.g., "$headers").
+	Compile(query string, variables []string) (CompiledTransform, error)
+}
+
+// CompiledTransform is a query pre-compiled by a transform language.
+type CompiledTransform interface {
+	// Run executes the query over the given input, binding the variables it was compiled with to the given values. Failures
+	// are returned as error results.
+	//
+	// Thread safe.
+	Run(input interface{}, variables map[string]interface{}) TransformIter
+}
+
+// TransformIter iterates over the results of a transform.
+type TransformIter interface {
+	Next() (interface{}, bool)
+}
+
+// transformLanguages are the supported transform languages, by name.
+var transformLanguages = map[string]TransformLanguage{
+	TransformLanguageJq:         jqLanguage{},
+	TransformLanguageCel:        celLanguage{},
+	TransformLanguageGoTemplate: goTemplateLanguage{},
+}
+
+// TransformEngine keeps a set of pre-compiled queries ready for execution
 type TransformEngine struct {
-	transforms map[string]*gojq.Code
+	transforms map[string]CompiledTransform
+	variables  []string
 }
 
-func NewTransformEngine() *TransformEngine {
-	return &TransformEngine{make(map[string]*gojq.Code)}
+// NewTransformEngine builds a transform engine. The given variables (e.g., "$headers") are made available to all queries.
+func NewTransformEngine(variables ...string) *TransformEngine {
+	return &TransformEngine{make(map[string]CompiledTransform), variables}
 }
 
-// AddTransform saves a query, identified by Id, for later execution
+// AddTransform saves a jq query, identified by Id, for later execution
 func (engine *TransformEngine) AddTransform(id string, query string) error {
-	parsed, err := gojq.Parse(query)
-	if err != nil {
-		return err
+	return engine.AddTransformWithLanguage(id, TransformLanguageJq, query)
+}
+
+// AddTransformWithLanguage saves a query written in the given language, identified by Id, for later execution. An empty
+// language defaults to jq.
+func (engine *TransformEngine) AddTransformWithLanguage(id string, language string, query string) error {
+	if language == "" {
+		language = TransformLanguageJq
+	}
+
+	transformLanguage, ok := transformLanguages[language]
+	if !ok {
+		return fmt.Errorf("unsupported transform language %s", language)
 	}
 
-	compiled, err := gojq.Compile(parsed)
+	compiled, err := transformLanguage.Compile(query, engine.variables)
 	if err != nil {
 		return err
 	}
@@ -34,16 +80,28 @@ func (engine *TransformEngine) AddTransform(id string, query string) error {
 	return nil
 }
 
+// Len returns the number of compiled transforms.
+func (engine *TransformEngine) Len() int {
+	return len(engine.transforms)
+}
+
 // Execute executes the transformation identified by Id over the given input.
 //
 // Thread safe.
-func (engine *TransformEngine) Execute(id string, input map[string]interface{}) (interface{}, error) {
-	compiled, ok := engine.transforms[id]
-	if !ok {
-		return nil, fmt.Errorf("transform-adapter: transformation for id %s not found", id)
+func (engine *TransformEngine) Execute(id string, input interface{}) (interface{}, error) {
+	return engine.ExecuteWithVariables(id, input, nil)
+}
+
+// ExecuteWithVariables executes the transformation identified by Id over the given input, binding the engine variables
+// to the given values. Variables without a value are bound to null.
+//
+// Thread safe.
+func (engine *TransformEngine) ExecuteWithVariables(id string, input interface{}, variables map[string]interface{}) (interface{}, error) {
+	iter, err := engine.run(id, input, variables)
+	if err != nil {
+		return nil, err
 	}
 
-	iter := compiled.Run(input)
 	result, ok := iter.Next()
 	if !ok {
 		return nil, fmt.Errorf("transform-adapter: transform id %s generated empty result", id)
@@ -59,3 +117,90 @@ func (engine *TransformEngine) Execute(id string, input map[string]interface{})
 
 	return result, nil
 }
+
+// ExecuteAll executes the transformation identified by Id over the given input, returning all results it generates.
+// Fails if the transformation generates more than the given limit of results.
+//
+// Thread safe.
+func (engine *TransformEngine) ExecuteAll(id string, input interface{}, variables map[string]interface{}, limit int) ([]interface{}, error) {
+	iter, err := engine.run(id, input, variables)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []interface{}{}
+	for {
+		result, ok := iter.Next()
+		if !ok {
+			return results, nil
+		}
+
+		if err, ok := result.(error); ok {
+			return nil, fmt.Errorf("transform-adapter: transform id %s failed: %s", id, err)
+		}
+
+		if len(results) == limit {
+			return nil, fmt.Errorf("transform-adapter: transform id %s generated more than %d results", id, limit)
+		}
+
+		results = append(results, result)
+	}
+}
+
+// run starts the execution of the transformation identified by Id.
+func (engine *TransformEngine) run(id string, input interface{}, variables map[string]interface{}) (TransformIter, error) {
+	compiled, ok := engine.transforms[id]
+	if !ok {
+		return nil, fmt.Errorf("transform-adapter: transformation for id %s not found", id)
+	}
+
+	return compiled.Run(input, variables), nil
+}
+
+// jqLanguage compiles jq queries, which may generate any number of results. Queries can use the binary decoding functions
+// (see binaryFunctions).
+type jqLanguage struct{}
+
+func (jqLanguage) Compile(query string, variables []string) (CompiledTransform, error) {
+	parsed, err := gojq.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled, err := gojq.Compile(parsed, append(binaryFunctions(), gojq.WithVariables(variables))...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jqTransform{compiled, variables}, nil
+}
+
+type jqTransform struct {
+	code      *gojq.Code
+	variables []string
+}
+
+// Run binds the variables in the order they were compiled with.
+func (transform *jqTransform) Run(input interface{}, variables map[string]interface{}) TransformIter {
+	values := make([]interface{}, len(transform.variables))
+	for i, name := range transform.variables {
+		values[i] = variables[name]
+	}
+
+	return transform.code.Run(input, values...)
+}
+
+// singleResult iterates over the only result of a transform, for languages whose queries always generate one result.
+type singleResult struct {
+	value interface{}
+	done  bool
+}
+
+func (iter *singleResult) Next() (interface{}, bool) {
+	if iter.done {
+		return nil, false
+	}
+
+	iter.done = true
+	return iter.value, true
+}
@@ -56,3 +56,48 @@ func TestTransformEngineExecuteMultipleResults(t *testing.T) {
 	_, err := engine.Execute("multiple-results", map[string]interface{}{})
 	assert.EqualError(t, err, "transform-adapter: transform id multiple-results generated multiple results")
 }
+
+func TestTransformEngineExecuteAll(t *testing.T) {
+	engine := NewTransformEngine()
+	assert.NoError(t, engine.AddTransform("multiple-results", ".items[] | {id}"))
+	results, err := engine.ExecuteAll("multiple-results", map[string]interface{}{"items": []interface{}{
+		map[string]interface{}{"id": "a"},
+		map[string]interface{}{"id": "b"},
+	}}, nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{map[string]interface{}{"id": "a"}, map[string]interface{}{"id": "b"}}, results)
+}
+
+func TestTransformEngineExecuteAllEmpty(t *testing.T) {
+	engine := NewTransformEngine()
+	assert.NoError(t, engine.AddTransform("empty", ".items[]"))
+	results, err := engine.ExecuteAll("empty", map[string]interface{}{"items": []interface{}{}}, nil, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestTransformEngineExecuteAllLimit(t *testing.T) {
+	engine := NewTransformEngine()
+	assert.NoError(t, engine.AddTransform("infinite", "repeat(1)"))
+	_, err := engine.ExecuteAll("infinite", map[string]interface{}{}, nil, 3)
+	assert.EqualError(t, err, "transform-adapter: transform id infinite generated more than 3 results")
+}
+
+func TestTransformEngineExecuteWithVariables(t *testing.T) {
+	engine := NewTransformEngine("$a", "$b")
+	assert.NoError(t, engine.AddTransform("variables", "{ a: $a, b: $b, c: .c }"))
+	result, err := engine.ExecuteWithVariables("variables", map[string]interface{}{"c": 3}, map[string]interface{}{"$a": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": 1, "b": nil, "c": 3}, result)
+}
+
+func TestTransformEngineUndefinedVariable(t *testing.T) {
+	engine := NewTransformEngine("$a")
+	assert.Error(t, engine.AddTransform("undefined-variable", "{ b: $b }"))
+}
+
+func TestTransformEngineUnsupportedLanguage(t *testing.T) {
+	engine := NewTransformEngine()
+	assert.EqualError(t, engine.AddTransformWithLanguage("xslt", "xslt", "<xsl:stylesheet/>"), "unsupported transform language xslt")
+	assert.NoError(t, engine.AddTransformWithLanguage("default", "", "."))
+}
@@ -0,0 +1,179 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+const (
+	defaultWasmMaxMemoryMb = 16
+	defaultWasmTimeout     = time.Second
+	maxWasmMemoryMb        = 4096 // Maximum memory addressable by 32-bit WebAssembly modules
+	maxWasmStderrSize      = 1024 // Maximum number of bytes of the standard error of a failed module included in its error
+	wasmPagesPerMb         = 16   // WebAssembly memory pages are 64 KiB
+
+	// wasmTransformLanguage identifies WebAssembly transforms in traces and metrics.
+	wasmTransformLanguage = "wasm"
+)
+
+// wasmCompilationCache keeps the native code of compiled modules, so reloading a configuration doesn't compile its modules again.
+var wasmCompilationCache = wazero.NewCompilationCache()
+
+// WasmOptions describes the WebAssembly module that transforms the request bodies of a route.
+type WasmOptions struct {
+	Module      []byte        // Binary WebAssembly module
+	MaxMemoryMb int           // Maximum memory of each module instance. Zero uses the default value
+	Timeout     time.Duration // Maximum duration of each execution. Zero uses the default value
+}
+
+// WasmTransform is a pre-compiled WebAssembly module that transforms raw request bodies. Modules are WASI commands: each
+// execution runs a fresh instance of the module, which reads the request body from its standard input and writes the transformed
+// payload, as JSON, to its standard output. Request headers are available as environment variables, CGI style (e.g., the
+// Content-Type header as HTTP_CONTENT_TYPE).
+//
+// Instances have no access to the file system or the network, and are limited in memory and execution time.
+type WasmTransform struct {
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+	timeout time.Duration
+}
+
+// NewWasmTransform compiles the WebAssembly module of a route. Zero limits use the default values.
+func NewWasmTransform(options *WasmOptions) (*WasmTransform, error) {
+	maxMemoryMb := options.MaxMemoryMb
+	if maxMemoryMb == 0 {
+		maxMemoryMb = defaultWasmMaxMemoryMb
+	}
+
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = defaultWasmTimeout
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(maxMemoryMb*wasmPagesPerMb)).
+		WithCloseOnContextDone(true).
+		WithCompilationCache(wasmCompilationCache))
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	module, err := runtime.CompileModule(ctx, options.Module)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	return &WasmTransform{runtime: runtime, module: module, timeout: timeout}, nil
+}
+
+// Close releases the runtime of the module. The transform must not be executed afterwards.
+func (transform *WasmTransform) Close() error {
+	return transform.runtime.Close(context.Background())
+}
+
+// Execute runs the module over a raw request body and its headers, returning the decoded JSON output of the module.
+//
+// Thread safe.
+func (transform *WasmTransform) Execute(ctx context.Context, body []byte, header http.Header) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, transform.timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{limit: maxBodySize}
+	stderr := &limitedBuffer{limit: maxWasmStderrSize}
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithStdin(bytes.NewReader(body)).
+		WithStdout(stdout).
+		WithStderr(stderr)
+
+	for _, variable := range wasmEnvironment(header) {
+		config = config.WithEnv(variable[0], variable[1])
+	}
+
+	instance, err := transform.runtime.InstantiateModule(ctx, transform.module, config)
+	if instance != nil {
+		defer instance.Close(ctx)
+	}
+
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case 0:
+			err = nil
+		case sys.ExitCodeDeadlineExceeded:
+			return nil, fmt.Errorf("wasm module exceeded its timeout of %s", transform.timeout)
+		default:
+			err = fmt.Errorf("exit code %d", exitErr.ExitCode())
+		}
+	}
+
+	if err != nil {
+		// Traps are followed by the stack trace of the module, which is left out.
+		err = errors.New(strings.SplitN(err.Error(), "\n", 2)[0])
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("wasm module failed: %s: %s", err, message)
+		}
+
+		return nil, fmt.Errorf("wasm module failed: %s", err)
+	}
+
+	if stdout.exceeded {
+		return nil, fmt.Errorf("wasm module output exceeds the maximum size of %d bytes", maxBodySize)
+	}
+
+	var result interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return nil, fmt.Errorf("wasm module output is not valid JSON: %w", err)
+	}
+
+	return result, nil
+}
+
+// wasmEnvironment returns the environment variables of a module instance, as name-value pairs sorted by name. Each header
+// is passed as HTTP_ followed by its name in uppercase, with dashes replaced by underscores. Multiple values of the same header
+// are joined by commas.
+func wasmEnvironment(header http.Header) [][2]string {
+	variables := make([][2]string, 0, len(header))
+	for name, values := range header {
+		variables = append(variables, [2]string{"HTTP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")), strings.Join(values, ", ")})
+	}
+
+	sort.Slice(variables, func(i, j int) bool { return variables[i][0] < variables[j][0] })
+	return variables
+}
+
+// limitedBuffer is a buffer that discards writes past its limit, recording that the limit was exceeded. Writes never fail, so
+// modules aren't interrupted by the limit.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (buffer *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if remaining := buffer.limit - buffer.Len(); n > remaining {
+		buffer.exceeded = true
+		p = p[:remaining]
+	}
+
+	buffer.Buffer.Write(p)
+	return n, nil
+}
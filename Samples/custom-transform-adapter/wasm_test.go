@@ -0,0 +1,175 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// wasmSection encodes a WebAssembly module section.
+func wasmSection(id byte, content ...byte) []byte {
+	section := []byte{id}
+	for size := len(content); ; size >>= 7 {
+		if size < 0x80 {
+			section = append(section, byte(size))
+			break
+		}
+
+		section = append(section, byte(size&0x7f|0x80))
+	}
+
+	return append(section, content...)
+}
+
+// wasmName encodes a name of a WebAssembly module.
+func wasmName(name string) []byte {
+	return append([]byte{byte(len(name))}, name...)
+}
+
+// buildEchoWasmModule builds a WASI command that copies its standard input (of up to 64 KiB) to its standard output. Inputs starting
+// with L loop forever, and inputs starting with M try to grow the memory by 64 MiB, trapping if it can't.
+func buildEchoWasmModule() []byte {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+	// Types: (i32, i32, i32, i32) -> i32 for fd_read and fd_write, and () -> () for _start.
+	module = append(module, wasmSection(0x01, 0x02, 0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7f, 0x60, 0x00, 0x00)...)
+
+	imports := []byte{0x02}
+	for _, function := range []string{"fd_read", "fd_write"} {
+		imports = append(imports, wasmName("wasi_snapshot_preview1")...)
+		imports = append(imports, wasmName(function)...)
+		imports = append(imports, 0x00, 0x00)
+	}
+
+	module = append(module, wasmSection(0x02, imports...)...)
+	module = append(module, wasmSection(0x03, 0x01, 0x01)...)       // _start is of type 1
+	module = append(module, wasmSection(0x05, 0x01, 0x00, 0x01)...) // One page of memory
+
+	exports := []byte{0x02}
+	exports = append(append(exports, wasmName("memory")...), 0x02, 0x00)
+	exports = append(append(exports, wasmName("_start")...), 0x00, 0x02)
+	module = append(module, wasmSection(0x07, exports...)...)
+
+	body := []byte{
+		0x00,                                           // No locals
+		0x41, 0x00, 0x41, 0xc0, 0x00, 0x36, 0x02, 0x00, // Input buffer at 64...
+		0x41, 0x04, 0x41, 0xc0, 0xff, 0x03, 0x36, 0x02, 0x00, // ...of 65472 bytes
+		0x41, 0x00, 0x41, 0x00, 0x41, 0x01, 0x41, 0x08, 0x10, 0x00, 0x1a, // fd_read(stdin, iovs at 0, 1 iov, read size at 8)
+		0x41, 0xc0, 0x00, 0x2d, 0x00, 0x00, 0x41, 0xcc, 0x00, 0x46, // If the input starts with L...
+		0x04, 0x40, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b, // ...loop forever
+		0x41, 0xc0, 0x00, 0x2d, 0x00, 0x00, 0x41, 0xcd, 0x00, 0x46, // If the input starts with M...
+		0x04, 0x40, 0x41, 0x80, 0x08, 0x40, 0x00, 0x41, 0x7f, 0x46, // ...grow the memory by 1024 pages...
+		0x04, 0x40, 0x00, 0x0b, 0x0b, // ...trapping if it fails
+		0x41, 0x10, 0x41, 0xc0, 0x00, 0x36, 0x02, 0x00, // Output buffer at 64...
+		0x41, 0x14, 0x41, 0x08, 0x28, 0x02, 0x00, 0x36, 0x02, 0x00, // ...of the read size
+		0x41, 0x01, 0x41, 0x10, 0x41, 0x01, 0x41, 0x18, 0x10, 0x01, 0x1a, // fd_write(stdout, iovs at 16, 1 iov, written size at 24)
+		0x0b,
+	}
+
+	code := append([]byte{0x01}, wasmSection(0x00, body...)[1:]...)
+	return append(module, wasmSection(0x0a, code...)...)
+}
+
+func TestWasmTransform(t *testing.T) {
+	transform, err := NewWasmTransform(&WasmOptions{Module: buildEchoWasmModule(), Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+
+	result, err := transform.Execute(context.Background(), []byte(`{"data": {"t": 1}}`), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"data": map[string]interface{}{"t": float64(1)}}, result)
+
+	_, err = transform.Execute(context.Background(), []byte(`not JSON`), nil)
+	assert.EqualError(t, err, "wasm module output is not valid JSON: invalid character 'o' in literal null (expecting 'u')")
+
+	_, err = transform.Execute(context.Background(), []byte(`L`), nil)
+	assert.EqualError(t, err, "wasm module exceeded its timeout of 100ms")
+
+	// The memory can't grow past the limit.
+	_, err = transform.Execute(context.Background(), []byte(`M`), nil)
+	assert.EqualError(t, err, "wasm module failed: module[] function[_start] failed: wasm error: unreachable")
+
+	unlimited, err := NewWasmTransform(&WasmOptions{Module: buildEchoWasmModule(), MaxMemoryMb: 128})
+	require.NoError(t, err)
+	_, err = unlimited.Execute(context.Background(), []byte(`M`), nil)
+	assert.EqualError(t, err, "wasm module output is not valid JSON: invalid character 'M' looking for beginning of value")
+}
+
+func TestWasmTransformInvalidModule(t *testing.T) {
+	_, err := NewWasmTransform(&WasmOptions{Module: []byte("not a module")})
+	assert.Error(t, err)
+}
+
+func TestWasmEnvironment(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Add("X-Vendor-Id", "a")
+	header.Add("X-Vendor-Id", "b")
+
+	assert.Equal(t, [][2]string{
+		{"HTTP_CONTENT_TYPE", "application/octet-stream"},
+		{"HTTP_X_VENDOR_ID", "a, b"},
+	}, wasmEnvironment(header))
+}
+
+func TestWasmRoute(t *testing.T) {
+	configPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(configPath, "echo.wasm"), buildEchoWasmModule(), 0644))
+	messages, err := processD2CMessages(configPath, []D2CMessageRaw{{
+		Path:              "/message",
+		DeviceIdBodyQuery: ".properties.device",
+		AuthHeader:        "key",
+		TransformWasm:     "echo.wasm",
+		WasmTimeout:       "100ms",
+	}})
+
+	require.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, messages[0].Wasm.Timeout)
+
+	recorder := &BridgeClientRecorder{}
+	adapter, err := NewAdapter(&Config{D2CMessages: messages}, "localhost:1000")
+	require.NoError(t, err)
+	adapter.GetBridgeClient = func() BridgeClient { return recorder }
+
+	// The device Id query runs over the output of the module.
+	assert.Equal(t, 200, sendTestMessage(adapter.Router, "/message", `{"data": {"t": 1}, "properties": {"device": "device-1"}}`).Code)
+	require.Len(t, recorder.Messages["device-1"], 1)
+	assert.Equal(t, map[string]interface{}{"t": float64(1)}, recorder.Messages["device-1"][0].Data)
+
+	response := sendTestMessage(adapter.Router, "/message", `L`)
+	assert.Equal(t, 400, response.Code)
+	assert.JSONEq(t, `{"error": "payload transformation failed: wasm module exceeded its timeout of 100ms"}`, response.Body.String())
+}
+
+func TestWasmTransformClosedAfterReload(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "echo.wasm"), buildEchoWasmModule(), 0644))
+	writeTestFile(t, dir, "config.json", `{"d2cMessages": [{"path": "/message", "deviceIdBodyQuery": ".properties.device", "authHeader": "key", "transformWasm": "echo.wasm"}]}`)
+	watcher, handler := buildTestWatcher(t, dir)
+	require.NoError(t, watcher.Reload())
+
+	// A request still being served by the previous adapter keeps its module usable.
+	previous, release := handler.Acquire()
+	wasmTransform := previous.wasmTransforms[0]
+	require.NoError(t, watcher.Reload())
+	assert.False(t, previous == handler.Current())
+	assert.Equal(t, 200, sendTestMessage(handler, "/message", `{"data": {}, "properties": {"device": "device-1"}}`).Code)
+
+	time.Sleep(50 * time.Millisecond)
+	_, err := wasmTransform.Execute(context.Background(), []byte(`{}`), nil)
+	assert.NoError(t, err)
+
+	// Once the request completes, the runtime of the previous adapter is closed.
+	release()
+	assert.Eventually(t, func() bool {
+		_, err := wasmTransform.Execute(context.Background(), []byte(`{}`), nil)
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}